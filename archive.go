@@ -1 +1,466 @@
 package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// The archive formats, all but 7z are written in-process, and bundles
+// by git
+const (
+	archiveFormatTarZst = "tar.zst"
+	archiveFormatTarGz  = "tar.gz"
+	archiveFormatZip    = "zip"
+	archiveFormat7z     = "7z"
+	archiveFormatBundle = "bundle"
+)
+
+// archiveCommand is the external tool writing the 7z archives
+var archiveCommand = "/usr/bin/7z"
+
+// default7zVolumeSize is the size of the volumes of the 7z archives,
+// unless -archive.volume-size is given
+const default7zVolumeSize = 1500 * 1024 * 1024
+
+func validArchiveFormat(format string) bool {
+	switch format {
+	case archiveFormatTarZst, archiveFormatTarGz, archiveFormatZip, archiveFormat7z, archiveFormatBundle:
+		return true
+	}
+	return false
+}
+
+// validArchiveLevel returns true when the compression level is in the
+// range of the format, -1 being the default of every format
+func validArchiveLevel(format string, level int) bool {
+	if format == archiveFormatTarZst {
+		return level == -1 || (level >= 1 && level <= 22)
+	}
+	return level >= -1 && level <= 9
+}
+
+// archiveHostDir returns the directory of the archives of the git host,
+// under the archive directory, as in the storage they are uploaded to, so
+// that the archives of repositories of the same name on other git hosts
+// are kept apart
+func archiveHostDir(c *appConfig) string {
+	return filepath.Join(c.archiveDir, filepath.Base(c.backupDir))
+}
+
+// archiveNamePrefix returns what the names of the archives of a repository
+// start with, before their timestamp
+func archiveNamePrefix(namespace, dirName string) string {
+	return namespace + "-" + strings.ReplaceAll(dirName, ".git", "")
+}
+
+// archiveRepository archives a backed up repository into the archive
+// directory of the git host. The archive holds the directory of the repository, so the
+// .git directory of a clone and the contents of a mirror, along with the
+// checked out files of a clone, unless it is a bundle.
+func archiveRepository(repo *Repository, dirName, repoDir string) ([]archiveReport, []byte, error) {
+	format := appCfg.archiveFormat
+	if format == archiveFormatBundle {
+		reason := incompleteHistory(repo, repoDir)
+		if reason == "" {
+			return archiveBundle(repo, dirName, repoDir, time.Now())
+		}
+		// A bundle of a shallow or partial clone lacks the objects it
+		// refers to, and could not be unbundled
+		log.Printf("Archiving %s/%s as %s rather than as a bundle, it is a %s\n", repo.Namespace, repo.Name, archiveFormatTarZst, reason)
+		format = archiveFormatTarZst
+	}
+	archiveDirErr := os.MkdirAll(archiveHostDir(&appCfg), 0751)
+	if archiveDirErr != nil {
+		return nil, nil, archiveDirErr
+	}
+
+	suffix := "." + format + appCfg.archiveEncryption.suffix()
+	if format == archiveFormat7z && appCfg.archiveEncryptionPassword != "" {
+		suffix = ".enc" + suffix
+	}
+	now := time.Now()
+	archiveFullPath := path.Join(
+		archiveHostDir(&appCfg),
+		archiveNamePrefix(repo.Namespace, dirName)+"-"+now.Format(archiveTimeLayout)+suffix,
+	)
+
+	if format == archiveFormat7z {
+		out, err := write7zArchive(archiveFullPath, repoDir)
+		if err != nil {
+			return nil, out, err
+		}
+	} else if err := writeArchive(format, archiveFullPath, repoDir); err != nil {
+		for _, a := range getArchiveFiles(archiveFullPath) {
+			os.Remove(a.Path)
+		}
+		return nil, nil, fmt.Errorf("failed to archive %s -> %v", repoDir, err)
+	}
+	archives := getArchiveFiles(archiveFullPath)
+	if err := hashArchives(archives); err != nil {
+		return nil, nil, err
+	}
+	if err := uploadArchives(archives); err != nil {
+		return nil, nil, err
+	}
+	return archives, nil, nil
+}
+
+// incompleteHistory returns what kind of clone a repository is when it does
+// not have all of its history, a shallow or partial clone, or an empty
+// string
+func incompleteHistory(repo *Repository, repoDir string) string {
+	if strategy := repo.strategy(); strategy != (cloneStrategy{}) {
+		return strategy.String() + " clone"
+	}
+	if out, _ := execCommand(gitCommand, "-C", repoDir, "rev-parse", "--is-shallow-repository").Output(); strings.TrimSpace(string(out)) == "true" {
+		return "shallow clone"
+	}
+	if out, _ := execCommand(gitCommand, "-C", repoDir, "config", "extensions.partialClone").Output(); strings.TrimSpace(string(out)) != "" {
+		return "partial clone"
+	}
+	return ""
+}
+
+// refsFingerprint returns a fingerprint of the refs of a repository,
+// which changes whenever any ref is created, updated or deleted
+func refsFingerprint(refs map[string]string) string {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", refs[name], name)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// archiveSkipReason returns why the repository needn't be archived again,
+// or "" when it must be: its refs are the ones of its last archive, which
+// was not deleted since and, with -archive.force-after-days, is recent
+// enough
+func archiveSkipReason(repo *Repository, repoDir string, now time.Time) string {
+	rs, err := currentState.getRepo(repo)
+	if err != nil {
+		debugLogf("Could not read the state of %s/%s: %v", repo.Namespace, repo.Name, err)
+		return ""
+	}
+	if rs == nil || rs.ArchivedAt == nil || rs.ArchiveFingerprint == "" {
+		return ""
+	}
+	if appCfg.archiveForceAfterDays > 0 && now.Sub(*rs.ArchivedAt) >= time.Duration(appCfg.archiveForceAfterDays)*24*time.Hour {
+		return ""
+	}
+	for _, a := range rs.Archives {
+		// The uploaded archives are not checked
+		if strings.Contains(a, "://") {
+			continue
+		}
+		if _, err := os.Stat(a); err != nil {
+			return ""
+		}
+	}
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		debugLogf("Could not read the refs of %s: %v", repoDir, err)
+		return ""
+	}
+	if refsFingerprint(refs) != rs.ArchiveFingerprint {
+		return ""
+	}
+	return fmt.Sprintf("its refs are unchanged since its archive of %s", rs.ArchivedAt.Format(time.RFC3339))
+}
+
+// write7zArchive archives the repository with the external 7z tool, at
+// the highest compression level unless -archive.level is given
+func write7zArchive(archivePath, repoDir string) ([]byte, error) {
+	level := appCfg.archiveLevel
+	if level == -1 {
+		level = 9
+	}
+	archiveArgs := []string{"a"}
+	if appCfg.archiveEncryptionPassword != "" {
+		archiveArgs = append(archiveArgs, fmt.Sprintf("-p%s", appCfg.archiveEncryptionPassword))
+	}
+	if appCfg.archiveVolumeSize > 0 {
+		archiveArgs = append(archiveArgs, fmt.Sprintf("-v%db", appCfg.archiveVolumeSize))
+	}
+	if appCfg.archiveThreads > 0 {
+		archiveArgs = append(archiveArgs, fmt.Sprintf("-mmt=%d", appCfg.archiveThreads))
+	}
+	archiveArgs = append(archiveArgs,
+		"-t7z",
+		"-m0=lzma2",
+		fmt.Sprintf("-mx=%d", level),
+		"-mfb=64",
+		"-md=32m",
+		"-ms=on",
+		"-mhe=on",
+		archivePath,
+		repoDir,
+	)
+	return execCommand(archiveCommand, archiveArgs...).CombinedOutput()
+}
+
+// writeArchive streams the repository directory into an archive,
+// encrypted for the -archive.age-recipient or -archive.pgp-key if any,
+// and split into volumes of -archive.volume-size
+func writeArchive(format, archivePath, repoDir string) (err error) {
+	out := newVolumeWriter(archivePath, appCfg.archiveVolumeSize)
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	w, err := appCfg.archiveEncryption.encrypt(out)
+	if err != nil {
+		return err
+	}
+	if err := writeCompressed(format, w, repoDir); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// writeCompressed writes the repository directory to w in the format
+func writeCompressed(format string, w io.Writer, repoDir string) error {
+	level := appCfg.archiveLevel
+	switch format {
+	case archiveFormatTarZst:
+		zstdLevel := zstd.SpeedDefault
+		if level != -1 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		options := []zstd.EOption{zstd.WithEncoderLevel(zstdLevel)}
+		if appCfg.archiveThreads > 0 {
+			options = append(options, zstd.WithEncoderConcurrency(appCfg.archiveThreads))
+		}
+		zw, err := zstd.NewWriter(w, options...)
+		if err != nil {
+			return err
+		}
+		if err := writeTar(zw, repoDir); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	case archiveFormatTarGz:
+		gw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		if appCfg.archiveThreads > 0 {
+			if err := gw.SetConcurrency(1<<20, appCfg.archiveThreads); err != nil {
+				return err
+			}
+		}
+		if err := writeTar(gw, repoDir); err != nil {
+			gw.Close()
+			return err
+		}
+		return gw.Close()
+	case archiveFormatZip:
+		return writeZip(w, repoDir, level)
+	}
+	return fmt.Errorf("unknown archive format %s", format)
+}
+
+// walkArchive calls fn for every file of the repository directory, in
+// lexical order, with its name in the archive, rooted at the name of the
+// directory
+func walkArchive(repoDir string, fn func(name string, info fs.FileInfo, file string) error) error {
+	root := filepath.Base(repoDir)
+	return filepath.WalkDir(repoDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(repoDir, file)
+		if err != nil {
+			return err
+		}
+		return fn(path.Join(root, filepath.ToSlash(rel)), info, file)
+	})
+}
+
+func writeTar(w io.Writer, repoDir string) error {
+	tw := tar.NewWriter(w)
+	err := walkArchive(repoDir, func(name string, info fs.FileInfo, file string) error {
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(tw, file)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, repoDir string, level int) error {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	err := walkArchive(repoDir, func(name string, info fs.FileInfo, file string) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		switch {
+		case info.IsDir():
+			hdr.Name += "/"
+			_, err = zw.CreateHeader(hdr)
+			return err
+		case info.Mode()&fs.ModeSymlink != 0:
+			// Symbolic links are stored with their target as contents
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			fw, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, link)
+			return err
+		case info.Mode().IsRegular():
+			hdr.Method = zip.Deflate
+			fw, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			return copyFile(fw, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// volumeWriter writes to a single file, or with a volume size to the
+// volumes <path>.001, <path>.002, ... like 7z does
+type volumeWriter struct {
+	path       string
+	volumeSize int64
+	volume     int
+	written    int64
+	f          *os.File
+}
+
+func newVolumeWriter(path string, volumeSize int64) *volumeWriter {
+	return &volumeWriter{path: path, volumeSize: volumeSize}
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if v.f == nil || (v.volumeSize > 0 && v.written == v.volumeSize) {
+			if err := v.next(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if v.volumeSize > 0 && int64(len(chunk)) > v.volumeSize-v.written {
+			chunk = chunk[:v.volumeSize-v.written]
+		}
+		written, err := v.f.Write(chunk)
+		n += written
+		v.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+	return n, nil
+}
+
+func (v *volumeWriter) next() error {
+	if err := v.closeVolume(); err != nil {
+		return err
+	}
+	name := v.path
+	if v.volumeSize > 0 {
+		v.volume++
+		name = fmt.Sprintf("%s.%03d", v.path, v.volume)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	v.f = f
+	v.written = 0
+	return nil
+}
+
+func (v *volumeWriter) closeVolume() error {
+	if v.f == nil {
+		return nil
+	}
+	err := v.f.Close()
+	v.f = nil
+	return err
+}
+
+// Close closes the last volume, creating an empty archive when nothing
+// was written
+func (v *volumeWriter) Close() error {
+	if v.f == nil && v.volume == 0 {
+		if err := v.next(); err != nil {
+			return err
+		}
+	}
+	return v.closeVolume()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+)
+
+func setupArchiveTests(t *testing.T, format string) string {
+	repoDir := filepath.Join(t.TempDir(), "r1")
+	os.MkdirAll(filepath.Join(repoDir, ".git", "refs"), 0755)
+	os.WriteFile(filepath.Join(repoDir, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+	os.WriteFile(filepath.Join(repoDir, "README"), bytes.Repeat([]byte("gitbackup "), 1000), 0644)
+	os.Symlink("README", filepath.Join(repoDir, "README.md"))
+
+	saved := appCfg
+	appCfg.archiveDir = t.TempDir()
+	appCfg.archiveFormat = format
+	appCfg.archiveLevel = -1
+	appCfg.archiveVolumeSize = 0
+	appCfg.archiveThreads = 0
+	t.Cleanup(func() { appCfg = saved })
+	return repoDir
+}
+
+func TestArchiveTarZstVolumes(t *testing.T) {
+	repoDir := setupArchiveTests(t, archiveFormatTarZst)
+	appCfg.archiveVolumeSize = 100
+
+	archives, out, err := archiveRepository(&Repository{Namespace: "ns", Name: "r1"}, "r1", repoDir)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(archives) < 2 || !strings.HasSuffix(archives[0].Path, ".tar.zst.001") {
+		t.Fatalf("Expected several volumes, got %+v", archives)
+	}
+
+	var data []byte
+	for _, a := range archives {
+		if a.Size > 100 {
+			t.Errorf("Expected volumes of at most 100 bytes, got %d", a.Size)
+		}
+		volume, _ := os.ReadFile(a.Path)
+		data = append(data, volume...)
+	}
+	zr, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "r1/README.md" && hdr.Linkname != "README" {
+			t.Errorf("Expected the symbolic link to be kept, got %+v", hdr)
+		}
+	}
+	expected := []string{"r1/", "r1/.git/", "r1/.git/HEAD", "r1/.git/refs/", "r1/README", "r1/README.md"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v in the archive, got %v", expected, names)
+	}
+}
+
+func TestArchiveZip(t *testing.T) {
+	repoDir := setupArchiveTests(t, archiveFormatZip)
+	appCfg.archiveLevel = 9
+
+	archives, out, err := archiveRepository(&Repository{Namespace: "ns", Name: "r1"}, "r1", repoDir)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(archives) != 1 || !strings.HasSuffix(archives[0].Path, ".zip") {
+		t.Fatalf("Expected a single zip archive, got %+v", archives)
+	}
+	zr, err := zip.OpenReader(archives[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name != "r1/README" {
+			continue
+		}
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if len(data) != 10000 || f.CompressedSize64 >= f.UncompressedSize64 {
+			t.Errorf("Expected the README to be compressed, got %d of %d bytes", f.CompressedSize64, len(data))
+		}
+		return
+	}
+	t.Errorf("Expected r1/README in the archive")
+}
+
+func fake7zCommand(command string, args ...string) (cmd *exec.Cmd) {
+	cs := []string{"-test.run=TestHelper7zProcess", "--", command}
+	cs = append(cs, args...)
+	cmd = exec.Command(os.Args[0], cs...)
+	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	return cmd
+}
+
+func TestArchive7z(t *testing.T) {
+	repoDir := setupArchiveTests(t, archiveFormat7z)
+	appCfg.archiveEncryptionPassword = "secret"
+	appCfg.archiveVolumeSize = 1500 * 1024 * 1024
+	appCfg.archiveThreads = 2
+	execCommand = fake7zCommand
+	defer func() { execCommand = exec.Command }()
+
+	if _, out, err := archiveRepository(&Repository{Namespace: "ns", Name: "r1"}, "r1", repoDir); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+func TestHelper7zProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args[3:]
+	if args[0] != archiveCommand || args[1] != "a" {
+		fmt.Fprintf(os.Stdout, "Expected 7z a to be executed. Got %v", args)
+		os.Exit(1)
+	}
+	for _, arg := range []string{"-psecret", "-mhe=on", "-v1572864000b", "-mmt=2", "-t7z", "-mx=9", "-mfb=64", "-md=32m"} {
+		if !contains(args, arg) {
+			fmt.Fprintf(os.Stdout, "Expected %s. Got %v", arg, args)
+			os.Exit(1)
+		}
+	}
+	if !strings.HasSuffix(args[len(args)-2], ".enc.7z") {
+		fmt.Fprintf(os.Stdout, "Expected an .enc.7z archive. Got %v", args)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestBackupArchiveSkipUnchanged(t *testing.T) {
+	var wg sync.WaitGroup
+	remote := newTestRemote(t)
+	backupDir := t.TempDir()
+	setupArchiveTests(t, archiveFormatTarZst)
+	appFS = afero.NewOsFs()
+	appCfg.archiveSkipUnchanged = true
+	appCfg.archiveForceAfterDays = 7
+	currentState = newTestStateStore(t)
+	currentReport = newRunReport(&appConfig{service: "github", backupDir: backupDir})
+	defer func() {
+		currentState = nil
+		currentReport = nil
+	}()
+
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: remote}
+	backUpAndCountArchives := func() int {
+		t.Helper()
+		wg.Add(1)
+		if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		return len(currentReport.Repositories[len(currentReport.Repositories)-1].Archives)
+	}
+	ageLastArchive := func() {
+		currentState.updateRepo(repo, func(rs *repoState) {
+			archivedAt := rs.ArchivedAt.AddDate(0, 0, -7)
+			rs.ArchivedAt = &archivedAt
+		})
+	}
+
+	if backUpAndCountArchives() == 0 {
+		t.Fatalf("Expected the first backup to be archived")
+	}
+	if backUpAndCountArchives() != 0 {
+		t.Errorf("Expected an unchanged repository not to be archived again")
+	}
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "second")
+	if backUpAndCountArchives() == 0 {
+		t.Errorf("Expected a changed repository to be archived")
+	}
+	ageLastArchive()
+	if backUpAndCountArchives() == 0 {
+		t.Errorf("Expected an archive after -archive.force-after-days")
+	}
+
+	// Also when -check-refs skips the update
+	appCfg.checkRefs = true
+	if backUpAndCountArchives() != 0 {
+		t.Errorf("Expected an unchanged repository not to be archived again")
+	}
+	ageLastArchive()
+	if backUpAndCountArchives() == 0 {
+		t.Errorf("Expected an archive after -archive.force-after-days")
+	}
+	if action := currentReport.Repositories[len(currentReport.Repositories)-1].Action; action != repoActionUnchanged {
+		t.Errorf("Expected the repository to be unchanged, got %s", action)
+	}
+}
+
+func TestArchiveFormatDefaults(t *testing.T) {
+	saved := appCfg
+	appFS = afero.NewOsFs()
+	t.Cleanup(func() { appCfg = saved })
+	recipient, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args       []string
+		format     string
+		volumeSize int64
+	}{
+		{nil, archiveFormat7z, 1500 * 1024 * 1024},
+		{[]string{"-archive.volume-size", "0"}, archiveFormat7z, 0},
+		{[]string{"-archive.format", archiveFormatTarZst}, archiveFormatTarZst, 0},
+		{[]string{"-archive.age-recipient", recipient.Recipient().String()}, archiveFormatTarZst, 0},
+	} {
+		appCfg = appConfig{}
+		c, err := initConfig(append([]string{"-service", "github", "-backupdir", t.TempDir(), "-archive-dir", t.TempDir()}, tc.args...))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if c.archiveFormat != tc.format || c.archiveVolumeSize != tc.volumeSize {
+			t.Errorf("%v: expected %s archives in volumes of %d bytes, got %s and %d", tc.args, tc.format, tc.volumeSize, c.archiveFormat, c.archiveVolumeSize)
+		}
+		if err := validateConfig(c); err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+		}
+	}
+}
@@ -11,8 +11,8 @@ import (
 	"github.com/spf13/afero"
 )
 
-func fakePullCommand(command string, args ...string) (cmd *exec.Cmd) {
-	cs := []string{"-test.run=TestHelperPullProcess", "--", command}
+func fakeFetchCommand(command string, args ...string) (cmd *exec.Cmd) {
+	cs := []string{"-test.run=TestHelperFetchProcess", "--", command}
 	cs = append(cs, args...)
 	cmd = exec.Command(os.Args[0], cs...)
 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
@@ -81,10 +81,10 @@ func TestBackup(t *testing.T) {
 		t.Errorf("%s", stdoutStderr)
 	}
 
-	// Test pull
+	// Test fetch
 	repoDir := path.Join(backupDir, repo.Name)
 	appFS.MkdirAll(repoDir, 0771)
-	execCommand = fakePullCommand
+	execCommand = fakeFetchCommand
 	wg.Add(1)
 	stdoutStderr, err = backUp(backupDir, &repo, false, &wg)
 	if err != nil {
@@ -185,18 +185,44 @@ func TestShallowBackup(t *testing.T) {
 	}
 }
 
-func TestHelperPullProcess(t *testing.T) {
+func TestHelperFetchProcess(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
 	}
-	// Check that git command was executed
-	if os.Args[3] != "git" || os.Args[6] != "pull" {
-		fmt.Fprintf(os.Stdout, "Expected git pull to be executed. Got %v", os.Args[3:])
+	args := os.Args[3:]
+	if args[0] != "git" || contains(args, "pull") {
+		fmt.Fprintf(os.Stdout, "Expected git fetch to be executed. Got %v", args)
 		os.Exit(1)
 	}
+	if contains(args, "fetch") && (!contains(args, "--all") || !contains(args, "--prune") || !contains(args, "--tags")) {
+		fmt.Fprintf(os.Stdout, "Expected all branches and tags to be fetched. Got %v", args)
+		os.Exit(1)
+	}
+	helperSyncWorkingTree(args)
 	os.Exit(0)
 }
 
+// helperSyncWorkingTree stands in for the git commands resetting the
+// working tree of a non-bare clone to the default branch
+func helperSyncWorkingTree(args []string) {
+	switch {
+	case contains(args, "ls-remote"):
+		fmt.Fprint(os.Stdout, "ref: refs/heads/main\tHEAD\n")
+	case contains(args, "for-each-ref"):
+		fmt.Fprint(os.Stdout, "1111 refs/remotes/origin/main\n2222 refs/remotes/origin/feature\n")
+	case contains(args, "checkout"):
+		if !contains(args, "--force") || !contains(args, "-B") || !contains(args, "main") {
+			fmt.Fprintf(os.Stdout, "Expected the default branch to be reset. Got %v", args)
+			os.Exit(1)
+		}
+	case contains(args, "branch"):
+		if !contains(args, "--track") || !contains(args, "feature") {
+			fmt.Fprintf(os.Stdout, "Expected the remote branch to be tracked. Got %v", args)
+			os.Exit(1)
+		}
+	}
+}
+
 func TestHelperCloneProcess(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
@@ -267,11 +293,12 @@ func TestHelperShallowRemoteUpdateProcess(t *testing.T) {
 		os.Exit(1)
 	}
 	if !(contains(args, "remote") || contains(args, "fetch")) {
-		fmt.Fprintf(os.Stdout, "Expected remote update/fetch. Got %v", args)
-		os.Exit(1)
+		helperSyncWorkingTree(args)
+		os.Exit(0)
 	}
-	if !contains(args, "--depth=1") || !contains(args, "--no-tags") {
-		fmt.Fprintf(os.Stdout, "Expected shallow update options. Got %v", args)
+	// git remote update doesn't take --depth
+	if !contains(args, "fetch") || !contains(args, "--depth=1") || !contains(args, "--no-tags") {
+		fmt.Fprintf(os.Stdout, "Expected shallow fetch options. Got %v", args)
 		os.Exit(1)
 	}
 	os.Exit(0)
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"strings"
 
 	bitbucket "github.com/ktrysmt/go-bitbucket"
@@ -15,7 +15,7 @@ func getBitbucketRepositories(
 ) ([]*Repository, error) {
 
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return nil, fmt.Errorf("Couldn't acquire a client to talk to %s", service)
 	}
 
 	var repositories []*Repository
@@ -37,26 +37,8 @@ func getBitbucketRepositories(
 		for _, repo := range resp.Items {
 			namespace := strings.Split(repo.Full_name, "/")[0]
 
-			linkmaps, ok := repo.Links["clone"].([]interface{})
-
-			var httpsURL string
-			var sshURL string
-
-			if ok {
-				for _, linkmaps := range linkmaps {
-					linkmap, ok := linkmaps.(map[string]interface{})
-
-					if ok {
-						if linkmap["name"] == "https" {
-							httpsURL = linkmap["href"].(string)
-						}
-
-						if linkmap["name"] == "ssh" {
-							sshURL = linkmap["href"].(string)
-						}
-					}
-				}
-			}
+			httpsURL := bitbucketCloneLink(repo.Links, "https")
+			sshURL := bitbucketCloneLink(repo.Links, "ssh")
 
 			if useHTTPSClone != nil && *useHTTPSClone {
 				cloneURL = httpsURL
@@ -65,14 +47,44 @@ func getBitbucketRepositories(
 			}
 
 			repositories = append(repositories, &Repository{
-				//PushedAt:  repo.PushedAt,
-				//UpdatedAt: repo.UpdatedAt,
-				CloneURL:  cloneURL,
-				Name:      repo.Slug,
-				Namespace: namespace,
-				Private:   repo.Is_private,
+				// Bitbucket does not report the last push, the last update
+				// includes it
+				PushedAt:   repo.UpdatedOnTime,
+				UpdatedAt:  repo.UpdatedOnTime,
+				ID:         repo.Uuid,
+				CloneURL:   cloneURL,
+				Name:       repo.Slug,
+				Namespace:  namespace,
+				Private:    repo.Is_private,
+				Fork:       repo.Parent != nil,
+				Visibility: bitbucketVisibility(repo.Is_private),
+				Language:   repo.Language,
 			})
 		}
 	}
 	return repositories, nil
 }
+
+func bitbucketVisibility(private bool) string {
+	if private {
+		return "private"
+	}
+	return "public"
+}
+
+// bitbucketCloneLink returns the clone URL of a repository for a protocol,
+// https or ssh, from its links
+func bitbucketCloneLink(links map[string]interface{}, name string) string {
+	linkmaps, ok := links["clone"].([]interface{})
+	if !ok {
+		return ""
+	}
+	for _, linkmaps := range linkmaps {
+		linkmap, ok := linkmaps.(map[string]interface{})
+		if ok && linkmap["name"] == name {
+			href, _ := linkmap["href"].(string)
+			return href
+		}
+	}
+	return ""
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The suffixes of the full and incremental bundles, and of the manifests
+// of their chains
+const (
+	bundleSuffix            = ".bundle"
+	incrementalBundleSuffix = ".incremental.bundle"
+	bundleManifestSuffix    = ".bundle.json"
+)
+
+// errEmptyBundle is returned by writeBundle when there is no new object
+// to bundle
+var errEmptyBundle = errors.New("no new objects to bundle")
+
+// bundleManifest describes a chain of bundles of a repository: a full
+// bundle followed by incremental bundles, each holding the objects which
+// are not in the previous ones. It is written next to the bundles as
+// <full bundle>.json and kept in the state to extend the chain.
+type bundleManifest struct {
+	Namespace string                `json:"namespace"`
+	Name      string                `json:"name"`
+	Bundles   []bundleManifestEntry `json:"bundles"`
+}
+
+// bundleManifestEntry describes a bundle of a chain
+type bundleManifestEntry struct {
+	// File is the name of the bundle, empty when only refs to objects of
+	// the previous bundles changed
+	File        string    `json:"file,omitempty"`
+	Incremental bool      `json:"incremental"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Prerequisites are the objects an incremental bundle was written
+	// against, the tips of the previous bundle
+	Prerequisites []string `json:"prerequisites,omitempty"`
+	// Refs and Head are those of the repository when the bundle was
+	// written, restoring the chain up to the bundle restores them
+	Refs map[string]string `json:"refs"`
+	Head string            `json:"head,omitempty"`
+	// Size and SHA256 are those of the bundle before its encryption
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// bundleManifestName returns the name of the manifest of the chain
+// starting with a full bundle
+func bundleManifestName(fullBundle string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(fullBundle, archiveSuffixAge), archiveSuffixPGP)
+	return strings.TrimSuffix(name, bundleSuffix) + bundleManifestSuffix
+}
+
+// usable returns true when the chain can be extended with an incremental
+// bundle: its full bundle is less than -archive.full-bundle-days old and,
+// unless they were uploaded and deleted, its bundles are still there
+func (m *bundleManifest) usable(now time.Time) bool {
+	if m == nil || len(m.Bundles) == 0 || appCfg.archiveFullBundleDays == 0 {
+		return false
+	}
+	if now.Sub(m.Bundles[0].CreatedAt) >= time.Duration(appCfg.archiveFullBundleDays)*24*time.Hour {
+		return false
+	}
+	if appCfg.archiveStorage != nil && appCfg.storageDeleteLocal {
+		return true
+	}
+	for _, entry := range m.Bundles {
+		if entry.File == "" {
+			continue
+		}
+		if _, _, err := getArchiveVolumes(filepath.Join(archiveHostDir(&appCfg), entry.File)); err != nil {
+			debugLogf("Starting a new chain of bundles of %s/%s: %v", m.Namespace, m.Name, err)
+			return false
+		}
+	}
+	return true
+}
+
+// archiveBundle archives a repository as a git bundle: a full bundle
+// starting a new chain, or an incremental bundle of the objects which are
+// not in the previous bundle of the chain. The manifest of the chain is
+// written again along with each bundle. Nothing is written when the refs
+// did not change since the previous bundle.
+func archiveBundle(repo *Repository, dirName, repoDir string, now time.Time) ([]archiveReport, []byte, error) {
+	if err := os.MkdirAll(archiveHostDir(&appCfg), 0751); err != nil {
+		return nil, nil, err
+	}
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the refs of %s -> %v", repoDir, err)
+	}
+	if len(refs) == 0 {
+		log.Printf("Not archiving %s/%s, it has no refs\n", repo.Namespace, repo.Name)
+		return nil, nil, nil
+	}
+	head, _ := execCommand(gitCommand, "-C", repoDir, "symbolic-ref", "-q", "HEAD").Output()
+	entry := bundleManifestEntry{CreatedAt: now, Refs: refs, Head: strings.TrimSpace(string(head))}
+
+	rs, err := currentState.getRepo(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain *bundleManifest
+	if rs != nil && rs.BundleChain.usable(now) {
+		chain = rs.BundleChain
+		previous := chain.Bundles[len(chain.Bundles)-1]
+		if reflect.DeepEqual(previous.Refs, entry.Refs) && previous.Head == entry.Head {
+			log.Printf("Not archiving %s/%s, its refs are those of its bundle of %s\n", repo.Namespace, repo.Name, previous.CreatedAt.Format(time.RFC3339))
+			return nil, nil, nil
+		}
+	}
+
+	base := path.Join(
+		archiveHostDir(&appCfg),
+		archiveNamePrefix(repo.Namespace, dirName)+"-"+now.Format(archiveTimeLayout),
+	)
+	var archives []archiveReport
+	if chain != nil {
+		entry.Incremental = true
+		entry.Prerequisites = bundlePrerequisites(chain.Bundles[len(chain.Bundles)-1].Refs)
+		bundlePath := base + incrementalBundleSuffix + appCfg.archiveEncryption.suffix()
+		out, err := writeBundle(&entry, bundlePath, repoDir)
+		switch {
+		case errors.Is(err, errEmptyBundle):
+			debugLogf("Only refs of %s/%s to bundled objects changed, recording them in the manifest", repo.Namespace, repo.Name)
+		case err != nil:
+			log.Printf("Could not write an incremental bundle of %s/%s, starting a new chain: %v: %s\n", repo.Namespace, repo.Name, err, out)
+			chain = nil
+		default:
+			entry.File = path.Base(bundlePath)
+			archives = getArchiveFiles(bundlePath)
+		}
+	}
+	if chain == nil {
+		entry.Incremental = false
+		entry.Prerequisites = nil
+		bundlePath := base + bundleSuffix + appCfg.archiveEncryption.suffix()
+		if out, err := writeBundle(&entry, bundlePath, repoDir); err != nil {
+			return nil, out, fmt.Errorf("failed to bundle %s -> %v", repoDir, err)
+		}
+		entry.File = path.Base(bundlePath)
+		archives = getArchiveFiles(bundlePath)
+		chain = &bundleManifest{Namespace: repo.Namespace, Name: repo.Name}
+	}
+	chain.Bundles = append(chain.Bundles, entry)
+
+	data, err := json.MarshalIndent(chain, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	manifestPath := path.Join(archiveHostDir(&appCfg), bundleManifestName(chain.Bundles[0].File))
+	if err := writeFileAtomic(manifestPath, data, 0640); err != nil {
+		return nil, nil, err
+	}
+	archives = append(archives, archiveReport{Path: manifestPath, Size: int64(len(data))})
+	if err := hashArchives(archives); err != nil {
+		return nil, nil, err
+	}
+	if err := uploadArchives(archives); err != nil {
+		return nil, nil, err
+	}
+	if err := currentState.updateRepo(repo, func(rs *repoState) { rs.BundleChain = chain }); err != nil {
+		return nil, nil, err
+	}
+	return archives, nil, nil
+}
+
+// bundlePrerequisites returns the objects the refs point to, sorted
+func bundlePrerequisites(refs map[string]string) []string {
+	seen := map[string]bool{}
+	var objects []string
+	for _, object := range refs {
+		if !seen[object] {
+			seen[object] = true
+			objects = append(objects, object)
+		}
+	}
+	sort.Strings(objects)
+	return objects
+}
+
+// writeBundle streams a bundle of all the refs of the repository, without
+// the objects reachable from its prerequisites, encrypted for the
+// -archive.age-recipient or -archive.pgp-key if any, into the volumes of
+// the bundle path. It records the size and the SHA-256 of the bundle.
+func writeBundle(entry *bundleManifestEntry, bundlePath, repoDir string) (out []byte, err error) {
+	cmd := execCommand(gitCommand, "-C", repoDir, "bundle", "create", "-", "--all", "--stdin")
+	var stdin strings.Builder
+	for _, object := range entry.Prerequisites {
+		stdin.WriteString("^" + object + "\n")
+	}
+	cmd.Stdin = strings.NewReader(stdin.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := newVolumeWriter(bundlePath, appCfg.archiveVolumeSize)
+	defer func() {
+		if closeErr := volumes.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			for _, a := range getArchiveFiles(bundlePath) {
+				os.Remove(a.Path)
+			}
+		}
+	}()
+	w, err := appCfg.archiveEncryption.encrypt(volumes)
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hash), stdout)
+	if err != nil {
+		// git, and the git pack-objects it runs, would otherwise block
+		// writing the rest of the bundle
+		stdout.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		if strings.Contains(stderr.String(), "empty bundle") {
+			return nil, errEmptyBundle
+		}
+		return stderr.Bytes(), err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	entry.Size = size
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil, nil
+}
+
+// restoreBundles replays a chain of bundles, from its manifest, into a
+// new repository in the target directory, whose refs and HEAD are then
+// set to those of the last bundle and whose files are checked out
+func restoreBundles(manifestPath, targetDir string, decryption *archiveDecryption) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid manifest %s -> %v", manifestPath, err)
+	}
+	if len(manifest.Bundles) == 0 {
+		return fmt.Errorf("no bundles in %s", manifestPath)
+	}
+	if entries, err := os.ReadDir(targetDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", targetDir)
+	}
+	if out, err := execCommand(gitCommand, "init", "-q", targetDir).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+
+	for _, entry := range manifest.Bundles {
+		if entry.File == "" {
+			continue
+		}
+		debugLogf("Unbundling %s into %s", entry.File, targetDir)
+		if err := unbundle(entry, filepath.Join(filepath.Dir(manifestPath), entry.File), targetDir, decryption); err != nil {
+			return fmt.Errorf("failed to restore %s -> %v", entry.File, err)
+		}
+	}
+
+	last := manifest.Bundles[len(manifest.Bundles)-1]
+	var updates strings.Builder
+	for ref, object := range last.Refs {
+		fmt.Fprintf(&updates, "update %s %s\n", ref, object)
+	}
+	cmd := execCommand(gitCommand, "-C", targetDir, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(updates.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore the refs -> %v: %s", err, out)
+	}
+	if _, ok := last.Refs[last.Head]; ok {
+		if out, err := execCommand(gitCommand, "-C", targetDir, "symbolic-ref", "HEAD", last.Head).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		if out, err := execCommand(gitCommand, "-C", targetDir, "reset", "-q", "--hard").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to check out %s -> %v: %s", last.Head, err, out)
+		}
+	}
+	return nil
+}
+
+// unbundle decrypts a bundle of a chain to a temporary file, checking its
+// size and SHA-256, and adds its objects to the repository
+func unbundle(entry bundleManifestEntry, bundlePath, repoDir string, decryption *archiveDecryption) error {
+	name, volumes, err := getArchiveVolumes(bundlePath)
+	if err != nil {
+		return err
+	}
+	var readers []io.Reader
+	for _, volume := range volumes {
+		f, err := os.Open(volume)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	_, r, err := decryption.decrypt(name, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "gitbackup-restore-*.bundle")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); size != entry.Size || sum != entry.SHA256 {
+		return fmt.Errorf("the bundle has %d bytes of SHA-256 %s, expected %d bytes of SHA-256 %s", size, sum, entry.Size, entry.SHA256)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if out, err := execCommand(gitCommand, "-C", repoDir, "bundle", "unbundle", tmp.Name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
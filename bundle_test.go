@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupBundleTests mirrors a new remote and returns them, archiving
+// bundles with a state store
+func setupBundleTests(t *testing.T) (string, string) {
+	remote := newTestRemote(t)
+	setupArchiveTests(t, archiveFormatBundle)
+	appCfg.archiveFullBundleDays = 7
+	repoDir := filepath.Join(t.TempDir(), "r1.git")
+	runTestGit(t, "clone", "-q", "--mirror", remote, repoDir)
+	currentState = newTestStateStore(t)
+	t.Cleanup(func() { currentState = nil })
+	return remote, repoDir
+}
+
+func readBundleManifest(t *testing.T, manifestPath string) *bundleManifest {
+	t.Helper()
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &bundleManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestArchiveBundleChain(t *testing.T) {
+	remote, repoDir := setupBundleTests(t)
+	repo := &Repository{Namespace: "ns", Name: "r1"}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	archiveAt := func(at time.Time) []archiveReport {
+		t.Helper()
+		runTestGit(t, "-C", repoDir, "fetch", "-q", "--prune", "origin", "+refs/*:refs/*")
+		archives, out, err := archiveBundle(repo, "r1.git", repoDir, at)
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		return archives
+	}
+
+	archives := archiveAt(now)
+	if len(archives) != 2 || !strings.HasSuffix(archives[0].Path, "ns-r1-2024-01-01-00-00-00+0000.bundle") || !strings.HasSuffix(archives[1].Path, "ns-r1-2024-01-01-00-00-00+0000.bundle.json") {
+		t.Fatalf("Expected a full bundle and its manifest, got %+v", archives)
+	}
+	manifestPath := archives[1].Path
+
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "second")
+	if archives := archiveAt(now.Add(time.Hour)); len(archives) != 2 || !strings.HasSuffix(archives[0].Path, incrementalBundleSuffix) {
+		t.Fatalf("Expected an incremental bundle, got %+v", archives)
+	}
+	// A new ref to a bundled commit
+	runTestGit(t, "-C", remote, "tag", "light", "HEAD~1")
+	if archives := archiveAt(now.Add(2 * time.Hour)); len(archives) != 1 {
+		t.Fatalf("Expected only the manifest, got %+v", archives)
+	}
+	if archives := archiveAt(now.Add(3 * time.Hour)); len(archives) != 0 {
+		t.Fatalf("Expected nothing to be archived without changes, got %+v", archives)
+	}
+	runTestGit(t, "-C", remote, "checkout", "-q", "-b", "dev", "light")
+	runTestGit(t, "-C", remote, "branch", "-q", "-D", "main")
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "third")
+	runTestGit(t, "-C", repoDir, "symbolic-ref", "HEAD", "refs/heads/dev")
+	archiveAt(now.Add(4 * time.Hour))
+
+	manifest := readBundleManifest(t, manifestPath)
+	var kinds []string
+	for _, entry := range manifest.Bundles {
+		switch {
+		case entry.File == "":
+			kinds = append(kinds, "refs")
+		case entry.Incremental:
+			kinds = append(kinds, "incremental")
+		default:
+			kinds = append(kinds, "full")
+		}
+	}
+	if want := []string{"full", "incremental", "refs", "incremental"}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("Expected the bundles %v, got %v", want, kinds)
+	}
+
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	if err := restoreBundles(manifestPath, targetDir, &archiveDecryption{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := getLocalRefs(targetDir)
+	if want, _ := getLocalRefs(repoDir); !reflect.DeepEqual(restored, want) {
+		t.Errorf("Expected the refs %v, got %v", want, restored)
+	}
+	if head := gitOutput(t, "-C", targetDir, "symbolic-ref", "HEAD"); head != "refs/heads/dev" {
+		t.Errorf("Expected HEAD to be refs/heads/dev, got %s", head)
+	}
+
+	// A new chain once the full bundle is too old
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "fourth")
+	if archives := archiveAt(now.AddDate(0, 0, 7)); len(archives) != 2 || !strings.HasSuffix(archives[0].Path, "ns-r1-2024-01-08-00-00-00+0000.bundle") {
+		t.Fatalf("Expected a new full bundle, got %+v", archives)
+	}
+}
+
+func TestRestoreBundlesAltered(t *testing.T) {
+	remote, repoDir := setupBundleTests(t)
+	repo := &Repository{Namespace: "ns", Name: "r1"}
+	now := time.Now()
+	archives, out, err := archiveBundle(repo, "r1.git", repoDir, now)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "second")
+	runTestGit(t, "-C", repoDir, "fetch", "-q", "origin", "+refs/*:refs/*")
+	if archives, out, err = archiveBundle(repo, "r1.git", repoDir, now.Add(time.Hour)); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	data, _ := os.ReadFile(archives[0].Path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(archives[0].Path, data, 0640)
+	err = restoreBundles(archives[1].Path, filepath.Join(t.TempDir(), "restored"), &archiveDecryption{})
+	if err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("Expected an altered bundle to be detected, got %v", err)
+	}
+}
+
+func TestGroupArchivesBundleChains(t *testing.T) {
+	repos := groupArchives([]string{
+		"ns-r1-2024-01-01-00-00-00+0000.bundle",
+		"ns-r1-2024-01-01-00-00-00+0000.bundle.json",
+		"ns-r1-2024-01-02-00-00-00+0000.incremental.bundle",
+		"ns-r1-2024-01-03-00-00-00+0000.incremental.bundle",
+		"ns-r1-2024-01-08-00-00-00+0000.bundle.age.001",
+		"ns-r1-2024-01-08-00-00-00+0000.bundle.age.002",
+		"ns-r1-2024-01-08-00-00-00+0000.bundle.json",
+		"ns-r1-2024-01-09-00-00-00+0000.incremental.bundle.age",
+	})
+	archives := repos["ns-r1"]
+	if len(archives) != 2 {
+		t.Fatalf("Expected 2 chains, got %+v", archives)
+	}
+	if len(archives[0].files) != 4 || !archives[0].time.Equal(time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the last chain with 4 files as of its last bundle, got %+v", archives[0])
+	}
+	if len(archives[1].files) != 4 || !archives[1].time.Equal(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the first chain with 4 files as of its last bundle, got %+v", archives[1])
+	}
+}
+
+func TestArchiveShallowBundleAsTar(t *testing.T) {
+	remote := newTestRemote(t)
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "second")
+	setupArchiveTests(t, archiveFormatBundle)
+	repoDir := filepath.Join(t.TempDir(), "r1.git")
+	runTestGit(t, "clone", "-q", "--mirror", "--depth=1", "file://"+remote, repoDir)
+
+	// Whether from its strategy, or from the clone itself
+	for _, repo := range []*Repository{{Namespace: "ns", Name: "r1", Strategy: cloneStrategy{Depth: 1}}, {Namespace: "ns", Name: "r1"}} {
+		archives, out, err := archiveRepository(repo, "r1.git", repoDir)
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if len(archives) != 1 || !strings.HasSuffix(archives[0].Path, "."+archiveFormatTarZst) {
+			t.Errorf("Expected a shallow clone to be archived as %s, got %+v", archiveFormatTarZst, archives)
+		}
+		os.Remove(archives[0].Path)
+	}
+}
+
+func TestWriteBundleFailure(t *testing.T) {
+	remote := newTestRemote(t)
+	// More than the pipe of git bundle holds
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(remote, "data"), data, 0644)
+	runTestGit(t, "-C", remote, "add", "data")
+	runTestGit(t, "-C", remote, "commit", "-q", "-m", "data")
+	setupArchiveTests(t, archiveFormatBundle)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := writeBundle(&bundleManifestEntry{}, filepath.Join(t.TempDir(), "missing", "r1.bundle"), remote)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected the bundle not to be written")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Expected git to be stopped when the bundle can't be written")
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,14 +21,14 @@ import (
 var keyringServiceName = "gitbackup-cli"
 var gitbackupClientID = "7b56a77c7dfba0800524"
 
-func startOAuthFlow() string {
+func startOAuthFlow() (string, error) {
 	clientID := gitbackupClientID
 	scopes := []string{"repo", "user", "admin:org"}
 	httpClient := http.DefaultClient
 
 	code, err := device.RequestCode(httpClient, "https://github.com/login/device/code", clientID, scopes)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	fmt.Printf("Copy code: %s\n", code.UserCode)
@@ -36,10 +36,10 @@ func startOAuthFlow() string {
 
 	accessToken, err := device.PollToken(httpClient, "https://github.com/login/oauth/access_token", clientID, code)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	return accessToken.Token
+	return accessToken.Token, nil
 }
 
 func saveToken(service string, token string) error {
@@ -71,7 +71,9 @@ func getToken(service string) (string, error) {
 	return string(i.Data), nil
 }
 
-func newClient(service string, gitHostURL string) interface{} {
+// newClient returns the API client of the service, or an error when its
+// credentials are missing
+func newClient(service string, gitHostURL string) (interface{}, error) {
 	var gitHostURLParsed *url.URL
 	var err error
 
@@ -80,7 +82,7 @@ func newClient(service string, gitHostURL string) interface{} {
 	if len(gitHostURL) != 0 {
 		gitHostURLParsed, err = url.Parse(gitHostURL)
 		if err != nil {
-			log.Fatalf("Invalid gitlab URL: %s", gitHostURL)
+			return nil, fmt.Errorf("Invalid gitlab URL: %s", gitHostURL)
 		}
 		api, _ := url.Parse("api/v4/")
 		gitHostURLParsed = gitHostURLParsed.ResolveReference(api)
@@ -91,33 +93,35 @@ func newClient(service string, gitHostURL string) interface{} {
 		if githubToken == "" {
 			githubToken, err = getToken("GITHUB")
 			if err != nil {
-				githubToken = startOAuthFlow()
-			}
-			if githubToken == "" {
-				log.Fatal("GitHub token not available")
-			} else {
-				err := saveToken("GITHUB", githubToken)
+				githubToken, err = startOAuthFlow()
 				if err != nil {
-					log.Fatal("Error saving token")
+					return nil, fmt.Errorf("GitHub authorization failed: %v", err)
 				}
 			}
+			if githubToken == "" {
+				return nil, errors.New("GitHub token not available")
+			}
+			if err := saveToken("GITHUB", githubToken); err != nil {
+				return nil, fmt.Errorf("Error saving token: %v", err)
+			}
 		}
 		gitHostToken = githubToken
 		ts := oauth2.StaticTokenSource(
 			&oauth2.Token{AccessToken: githubToken},
 		)
 		tc := oauth2.NewClient(context.Background(), ts)
+		tc.Transport = &apiCallCounter{transport: tc.Transport}
 		client := github.NewClient(tc)
 		if gitHostURLParsed != nil {
 			client.BaseURL = gitHostURLParsed
 		}
-		return client
+		return client, nil
 	}
 
 	if service == "gitlab" {
 		gitlabToken := os.Getenv("GITLAB_TOKEN")
 		if gitlabToken == "" {
-			log.Fatal("GITLAB_TOKEN environment variable not set")
+			return nil, errors.New("GITLAB_TOKEN environment variable not set")
 		}
 		gitHostToken = gitlabToken
 
@@ -125,32 +129,34 @@ func newClient(service string, gitHostURL string) interface{} {
 		if gitHostURLParsed != nil {
 			baseUrlOption = gitlab.WithBaseURL(gitHostURLParsed.String())
 		}
-		client, err := gitlab.NewClient(gitlabToken, baseUrlOption)
+		httpClientOption := gitlab.WithHTTPClient(&http.Client{Transport: &apiCallCounter{}})
+		client, err := gitlab.NewClient(gitlabToken, baseUrlOption, httpClientOption)
 		if err != nil {
-			log.Fatalf("Error creating gitlab client: %v", err)
+			return nil, fmt.Errorf("Error creating gitlab client: %v", err)
 		}
-		return client
+		return client, nil
 	}
 
 	if service == "bitbucket" {
 		bitbucketUsername := os.Getenv("BITBUCKET_USERNAME")
 		if bitbucketUsername == "" {
-			log.Fatal("BITBUCKET_USERNAME environment variable not set")
+			return nil, errors.New("BITBUCKET_USERNAME environment variable not set")
 		}
 
 		bitbucketPassword := os.Getenv("BITBUCKET_PASSWORD")
 		if bitbucketPassword == "" {
-			log.Fatal("BITBUCKET_PASSWORD environment variable not set")
+			return nil, errors.New("BITBUCKET_PASSWORD environment variable not set")
 		}
 
 		gitHostToken = bitbucketPassword
 
 		client := bitbucket.NewBasicAuth(bitbucketUsername, bitbucketPassword)
+		client.HttpClient.Transport = &apiCallCounter{transport: client.HttpClient.Transport}
 		if gitHostURLParsed != nil {
-			client.SetApiBaseURL(gitHostURLParsed.String())
+			client.SetApiBaseURL(*gitHostURLParsed)
 		}
-		return client
+		return client, nil
 	}
 
-	return nil
+	return nil, fmt.Errorf("unsupported service %s", service)
 }
@@ -19,35 +19,45 @@ func TestNewClient(t *testing.T) {
 	expectedGitHostBaseURL := customGitHost.ResolveReference(api)
 
 	// Client for github.com
-	client := newClient("github", "")
+	client, _ := newClient("github", "")
 	client = client.(*github.Client)
 
 	// Client for Enterprise Github
-	client = newClient("github", customGitHost.String())
+	client, _ = newClient("github", customGitHost.String())
 	gotBaseURL := client.(*github.Client).BaseURL
 	if gotBaseURL.String() != expectedGitHostBaseURL.String() {
 		t.Errorf("Expected BaseURL to be: %v, Got: %v\n", expectedGitHostBaseURL, gotBaseURL)
 	}
 
 	// Client for gitlab.com
-	client = newClient("gitlab", "")
+	client, _ = newClient("gitlab", "")
 	client = client.(*gitlab.Client)
 
 	// Client for custom gitlab installation
-	client = newClient("gitlab", customGitHost.String())
+	client, _ = newClient("gitlab", customGitHost.String())
 	gotBaseURL = client.(*gitlab.Client).BaseURL()
 	if gotBaseURL.String() != expectedGitHostBaseURL.String() {
 		t.Errorf("Expected BaseURL to be: %v, Got: %v\n", expectedGitHostBaseURL, gotBaseURL)
 	}
 
 	// Client for bitbucket.com
-	client = newClient("bitbucket", "")
+	client, _ = newClient("bitbucket", "")
 	client = client.(*bitbucket.Client)
 
 	// Not yet supported
-	client = newClient("notyetsupported", "")
-	if client != nil {
-		t.Errorf("Expected nil")
+	client, err := newClient("notyetsupported", "")
+	if client != nil || err == nil {
+		t.Errorf("Expected nil and an error")
 	}
 
 }
+
+func TestNewClientMissingToken(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "")
+	if _, err := newClient("gitlab", ""); err == nil {
+		t.Errorf("Expected a missing token to be an error")
+	}
+	if _, err := getUsername(nil, "gitlab"); err == nil {
+		t.Errorf("Expected a missing client to be an error")
+	}
+}
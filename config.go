@@ -1,19 +1,76 @@
 package main
 
+import (
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
 type appConfig struct {
 	service                   string
 	gitHostURL                string
 	backupDir                 string
 	archiveDir                string
 	cacheDir                  string
+	stateDBPath               string
 	archiveEncryptionPassword string
+	archiveFormat             string
+	archiveLevel              int
+	archiveVolumeSize         int64
+	archiveThreads            int
+	archiveSkipUnchanged      bool
+	archiveForceAfterDays     int
+	archiveFullBundleDays     int
+	archiveEncryption         *archiveEncryption
+	archiveStorage            archiveStorage
+	manifestSignKey           *openpgp.Entity
+	storageBackend            string
+	storageDeleteLocal        bool
+	storageS3                 s3Config
+	storageSFTP               sftpConfig
+	storageWebDAV             webdavConfig
+	retention                 retentionPolicy
 	ignorePrivate             bool
 	ignoreFork                bool
 	debug                     bool
 	useHTTPSClone             bool
 	bare                      bool
+	mirrorWorktree            bool
+	submodules                bool
 	shallowCloneRepos         []string
+	cloneStrategyRules        []cloneStrategyRule
+	filter                    repositoryFilter
 	maxConcurrentClones       int
+	changedSince              string
+	skipUnchanged             bool
+	checkRefs                 bool
+	preserveRefs              bool
+	preserveRefsKeepDays      int
+	healthCheck               string
+	healthQuarantine          bool
+	orphansMove               bool
+	orphansPolicy             string
+	orphansAfterDays          int
+	reportPath                string
+	metricsTextfile           string
+	metricsListenAddr         string
+
+	// Webhook receiver
+	webhookListenAddr string
+	webhookDebounce   time.Duration
+
+	// Notifications
+	notifyWebhookURLs      []string
+	notifyWebhookOnFailure bool
+	notifySMTPHost         string
+	notifySMTPPort         int
+	notifySMTPFrom         string
+	notifySMTPTo           []string
+	notifySMTPUsername     string
+	notifySMTPOnFailure    bool
+	notifyPingURL          string
+	notifyPingOnFailure    bool
+	notifyTemplate         string
 
 	// GitHub
 	githubRepoType                    string
@@ -23,9 +80,6 @@ type appConfig struct {
 	githubCreateUserMigrationRetryMax int
 	githubListUserMigrations          bool
 	githubWaitForMigrationComplete    bool
-	//
-	githubStartFromLastPushAt               string
-	githubSaveLastBackupDateAndContinueFrom bool
 
 	// Git Lab
 	gitlabProjectVisibility     string
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Layouts a backup tree can be converted to with `gitbackup convert`
+const (
+	layoutBare    = "bare"
+	layoutNonBare = "non-bare"
+)
+
+// repoActionConverted is recorded in the report of `gitbackup convert`
+const repoActionConverted = "converted"
+
+func handleConvert(args []string) error {
+	fs := flag.NewFlagSet("gitbackup convert", flag.ExitOnError)
+	dir := fs.String("dir", "", "Backup directory of a git host to convert, e.g. ~/.gitbackup/github.com")
+	to := fs.String("to", "", "Layout to convert the backups to (bare, non-bare)")
+	dryRun := fs.Bool("dry-run", false, "Only list the backups which would be converted")
+	reportPath := fs.String("report", "", "Write a JSON report of the conversion to this path")
+	fs.BoolVar(&appCfg.debug, "debug", false, "Enable verbose debug logging")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("Please specify the backup directory with -dir")
+	}
+	if *to != layoutBare && *to != layoutNonBare {
+		return errors.New("Please specify the layout to convert to with -to: bare, non-bare")
+	}
+
+	r := newRunReport(&appConfig{service: "convert", backupDir: *dir})
+	err := convertBackups(*dir, *to, *dryRun, r)
+	r.finish(err)
+	if *reportPath != "" {
+		if reportErr := r.write(*reportPath); reportErr != nil {
+			log.Printf("failed to write report -> %v", reportErr)
+		}
+	}
+	return err
+}
+
+// convertBackups converts all the backups under the backup directory of a
+// git host to a layout, recording the outcome for each in the report
+func convertBackups(dir string, to string, dryRun bool, r *runReport) error {
+	namespaces, err := afero.ReadDir(appFS, dir)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, ns := range namespaces {
+		// Skip _orphaned and the like
+		if !ns.IsDir() || strings.HasPrefix(ns.Name(), "_") {
+			continue
+		}
+		entries, err := afero.ReadDir(appFS, path.Join(dir, ns.Name()))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			repoDir := path.Join(dir, ns.Name(), entry.Name())
+			isBare := strings.HasSuffix(entry.Name(), ".git")
+			if isBare == (to == layoutBare) {
+				continue
+			}
+			repo := &Repository{Namespace: ns.Name(), Name: strings.TrimSuffix(entry.Name(), ".git")}
+			rr := r.startRepo(repo)
+			if dryRun {
+				log.Printf("Would convert %s to %s\n", repoDir, to)
+				rr.finish(repoActionSkipped, nil, nil)
+				continue
+			}
+			var out []byte
+			if to == layoutBare {
+				out, err = convertToBare(repoDir, repoDir+".git")
+			} else {
+				out, err = convertToNonBare(repoDir, strings.TrimSuffix(repoDir, ".git"))
+			}
+			switch {
+			case errors.Is(err, errConvertSkipped):
+				log.Printf("Skipping %s: %v\n", repoDir, err)
+				rr.finish(repoActionSkipped, nil, nil)
+			case err != nil:
+				log.Printf("Could not convert %s: %v\n", repoDir, err)
+				rr.finish(repoActionFailed, err, out)
+				failed++
+			default:
+				log.Printf("Converted %s to %s\n", repoDir, to)
+				rr.finish(repoActionConverted, nil, nil)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d backups could not be converted", failed)
+	}
+	return nil
+}
+
+var errConvertSkipped = errors.New("skipped")
+
+// convertToBare converts a non-bare clone to a mirror. The mirror is
+// cloned locally, hardlinking the objects, and the clone is only removed
+// once the mirror has all its refs.
+func convertToBare(cloneDir, mirrorDir string) ([]byte, error) {
+	if fi, err := appFS.Stat(path.Join(cloneDir, ".git")); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%w: not a non-bare clone", errConvertSkipped)
+	}
+	if _, err := appFS.Stat(mirrorDir); err == nil {
+		return nil, fmt.Errorf("%w: %s already exists", errConvertSkipped, mirrorDir)
+	}
+	url, err := getRemoteURL(cloneDir)
+	if err != nil {
+		return nil, err
+	}
+	cloneRefs, err := getLocalRefs(cloneDir)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := execCommand(gitCommand, "clone", "--mirror", "--quiet", cloneDir, mirrorDir).CombinedOutput()
+	if err == nil {
+		// The remote-tracking branches become the branches of the mirror
+		expected := map[string]string{}
+		var updates strings.Builder
+		for _, ref := range sortedRefs(cloneRefs) {
+			b := strings.TrimPrefix(ref, "refs/remotes/origin/")
+			switch {
+			case b == "HEAD":
+				fmt.Fprintf(&updates, "delete %s\n", ref)
+			case b != ref:
+				fmt.Fprintf(&updates, "update refs/heads/%s %s\ndelete %s\n", b, cloneRefs[ref], ref)
+				expected["refs/heads/"+b] = cloneRefs[ref]
+			case strings.HasPrefix(ref, "refs/remotes/"):
+				fmt.Fprintf(&updates, "delete %s\n", ref)
+			default:
+				// Local branches come first, the remote ones take over
+				expected[ref] = cloneRefs[ref]
+			}
+		}
+		cmd := execCommand(gitCommand, "-C", mirrorDir, "update-ref", "--no-deref", "--stdin")
+		cmd.Stdin = strings.NewReader(updates.String())
+		out, err = cmd.CombinedOutput()
+		if err == nil {
+			out, err = runGitCommands(mirrorDir, []string{"config", "remote.origin.url", url})
+		}
+		if err == nil {
+			out, err = verifyConversion(mirrorDir, expected)
+		}
+	}
+	if err != nil {
+		appFS.RemoveAll(mirrorDir)
+		return out, err
+	}
+	return nil, appFS.RemoveAll(cloneDir)
+}
+
+// convertToNonBare converts a mirror to a non-bare clone, checking out
+// the default branch. Refs other than the branches, the tags and the
+// preserved refs are not kept.
+func convertToNonBare(mirrorDir, cloneDir string) ([]byte, error) {
+	if _, err := appFS.Stat(path.Join(mirrorDir, "HEAD")); err != nil {
+		return nil, fmt.Errorf("%w: not a mirror", errConvertSkipped)
+	}
+	if _, err := appFS.Stat(cloneDir); err == nil {
+		return nil, fmt.Errorf("%w: %s already exists", errConvertSkipped, cloneDir)
+	}
+	url, err := getRemoteURL(mirrorDir)
+	if err != nil {
+		return nil, err
+	}
+	mirrorRefs, err := getLocalRefs(mirrorDir)
+	if err != nil {
+		return nil, err
+	}
+	expected := map[string]string{}
+	for ref, sha := range mirrorRefs {
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			expected["refs/remotes/origin/"+strings.TrimPrefix(ref, "refs/heads/")] = sha
+		case strings.HasPrefix(ref, "refs/tags/"), strings.HasPrefix(ref, "refs/gitbackup/"):
+			expected[ref] = sha
+		}
+	}
+
+	out, err := execCommand(gitCommand, "clone", "--quiet", mirrorDir, cloneDir).CombinedOutput()
+	if err == nil {
+		out, err = runGitCommands(cloneDir, []string{"fetch", "--quiet", mirrorDir, "+refs/gitbackup/*:refs/gitbackup/*"})
+	}
+	if err == nil {
+		// While origin is still the local mirror
+		out, err = syncWorkingTree(cloneDir)
+	}
+	if err == nil {
+		out, err = runGitCommands(cloneDir, []string{"config", "remote.origin.url", url})
+	}
+	if err == nil {
+		out, err = verifyConversion(cloneDir, expected)
+	}
+	if err != nil {
+		appFS.RemoveAll(cloneDir)
+		return out, err
+	}
+	return nil, appFS.RemoveAll(mirrorDir)
+}
+
+// verifyConversion checks a converted repository has the expected refs and
+// all the objects they need
+func verifyConversion(repoDir string, expected map[string]string) ([]byte, error) {
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	for ref, sha := range expected {
+		if refs[ref] != sha {
+			return nil, fmt.Errorf("%s is %q after the conversion, expected %s", ref, refs[ref], sha)
+		}
+	}
+	return runGitCommands(repoDir, []string{"fsck", "--connectivity-only", "--no-dangling"})
+}
+
+func getRemoteURL(repoDir string) (string, error) {
+	out, err := execCommand(gitCommand, "-C", repoDir, "config", "--get", "remote.origin.url").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not find the remote of %s: %v", repoDir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func sortedRefs(refs map[string]string) []string {
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestConvertBackups(t *testing.T) {
+	remote := newTestRemote(t)
+	runTestGit(t, "-C", remote, "branch", "feature")
+	os.WriteFile(filepath.Join(remote, "README"), []byte("hello"), 0644)
+	runTestGit(t, "-C", remote, "add", "README")
+	runTestGit(t, "-C", remote, "commit", "-q", "-m", "readme")
+	remoteRefs, err := getLocalRefs(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cloneDir := filepath.Join(dir, "ns", "r1")
+	mirrorDir := cloneDir + ".git"
+	runTestGit(t, "clone", "-q", remote, cloneDir)
+	// A backup converted already is left alone
+	runTestGit(t, "clone", "-q", "--mirror", remote, filepath.Join(dir, "ns", "r2.git"))
+	appFS = afero.NewOsFs()
+
+	r := newRunReport(&appConfig{service: "convert", backupDir: dir})
+	if err := convertBackups(dir, layoutBare, false, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Repositories) != 1 || r.Repositories[0].Action != repoActionConverted {
+		t.Fatalf("Expected one converted backup, got %+v", r.Repositories)
+	}
+	if _, err := os.Stat(cloneDir); err == nil {
+		t.Errorf("Expected the clone to be removed")
+	}
+	refs, err := getLocalRefs(mirrorDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"refs/heads/main", "refs/heads/feature", "refs/tags/v1"} {
+		if refs[ref] != remoteRefs[ref] {
+			t.Errorf("Expected %s to be %s in the mirror, got %q", ref, remoteRefs[ref], refs[ref])
+		}
+	}
+	if url, _ := getRemoteURL(mirrorDir); url != remote {
+		t.Errorf("Expected the mirror to fetch from %s, got %s", remote, url)
+	}
+
+	// And back
+	r = newRunReport(&appConfig{service: "convert", backupDir: dir})
+	if err := convertBackups(dir, layoutNonBare, false, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Repositories) != 2 {
+		t.Fatalf("Expected two converted backups, got %+v", r.Repositories)
+	}
+	refs, err = getLocalRefs(cloneDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["refs/remotes/origin/feature"] != remoteRefs["refs/heads/feature"] || refs["refs/heads/feature"] == "" {
+		t.Errorf("Expected the branches to be tracked, got %v", refs)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cloneDir, "README")); string(data) != "hello" {
+		t.Errorf("Expected the default branch to be checked out, got %q", data)
+	}
+	if url, _ := getRemoteURL(cloneDir); url != remote {
+		t.Errorf("Expected the clone to fetch from %s, got %s", remote, url)
+	}
+	if _, err := os.Stat(mirrorDir); err == nil {
+		t.Errorf("Expected the mirror to be removed")
+	}
+}
+
+func TestConvertSkipsExistingTarget(t *testing.T) {
+	remote := newTestRemote(t)
+	dir := t.TempDir()
+	runTestGit(t, "clone", "-q", remote, filepath.Join(dir, "ns", "r1"))
+	runTestGit(t, "clone", "-q", "--mirror", remote, filepath.Join(dir, "ns", "r1.git"))
+	appFS = afero.NewOsFs()
+
+	r := newRunReport(&appConfig{service: "convert", backupDir: dir})
+	if err := convertBackups(dir, layoutBare, false, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Repositories) != 1 || r.Repositories[0].Action != repoActionSkipped {
+		t.Errorf("Expected the backup to be skipped, got %+v", r.Repositories)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ns", "r1")); err != nil {
+		t.Errorf("Expected the clone to be kept")
+	}
+}
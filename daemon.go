@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Overlap policies, for when a target is due while its previous run is
+// still going
+const (
+	overlapSkip  = "skip"
+	overlapQueue = "queue"
+)
+
+// Number of recent runs kept in the daemon state
+const maxDaemonRecentRuns = 50
+
+// We have these here so that we can override them in the tests
+var daemonExecutable = os.Executable
+var daemonNow = time.Now
+
+// daemonConfig is the targets file passed to `gitbackup daemon -config`
+type daemonConfig struct {
+	Targets []*daemonTarget `json:"targets"`
+}
+
+// daemonTarget is a backup run with its own schedule. Args are the
+// gitbackup command line options of the run, e.g. ["-service", "github"].
+type daemonTarget struct {
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"`
+	Jitter   string            `json:"jitter"`
+	Overlap  string            `json:"overlap"`
+	Args     []string          `json:"args"`
+	Env      map[string]string `json:"env"`
+
+	schedule cron.Schedule
+	jitter   time.Duration
+	running  bool
+	queued   bool
+}
+
+// daemonState is persisted between daemon restarts
+type daemonState struct {
+	NextRuns   map[string]time.Time `json:"next_runs"`
+	RecentRuns []*daemonRun         `json:"recent_runs"`
+}
+
+// daemonRun is the outcome of a single scheduled run
+type daemonRun struct {
+	Target     string         `json:"target"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	ReportPath string         `json:"report_path,omitempty"`
+	Counts     map[string]int `json:"repositories,omitempty"`
+}
+
+type daemon struct {
+	mu        sync.Mutex
+	targets   []*daemonTarget
+	state     daemonState
+	statePath string
+	reportDir string
+	wg        sync.WaitGroup
+}
+
+func handleDaemon(args []string) error {
+	fs := flag.NewFlagSet("gitbackup daemon", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the JSON file listing the backup targets and their schedules")
+	stateDir := fs.String("state-dir", "", "Directory for the daemon state and run reports (default ~/.gitbackup/daemon)")
+	listenAddr := fs.String("listen", "", "Serve the run status on /status and metrics on /metrics at this address (e.g. :8080)")
+	fs.BoolVar(&appCfg.debug, "debug", false, "Enable verbose debug logging")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *configPath == "" {
+		return errors.New("Please specify the targets file with -config")
+	}
+	if *stateDir == "" {
+		homeDir, err := gethomeDir()
+		if err != nil {
+			return fmt.Errorf("could not determine home directory and state directory not specified: %v", err)
+		}
+		*stateDir = filepath.Join(homeDir, ".gitbackup", "daemon")
+	}
+
+	d, err := newDaemon(*configPath, *stateDir)
+	if err != nil {
+		return err
+	}
+	if *listenAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", appMetrics)
+		mux.HandleFunc("/status", d.handleStatus)
+		go func() {
+			log.Printf("Serving status and metrics on %s", *listenAddr)
+			if err := http.ListenAndServe(*listenAddr, mux); err != nil {
+				log.Printf("status server stopped -> %v", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d.run(ctx)
+	return nil
+}
+
+func loadDaemonConfig(configPath string) (*daemonConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var c daemonConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid targets file %s: %v", configPath, err)
+	}
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("no targets specified in %s", configPath)
+	}
+
+	names := map[string]bool{}
+	for _, t := range c.Targets {
+		if t.Name == "" {
+			return nil, errors.New("every target needs a name")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target name: %s", t.Name)
+		}
+		names[t.Name] = true
+
+		t.schedule, err = cron.ParseStandard(t.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule for target %s: %v", t.Name, err)
+		}
+		if t.Jitter != "" {
+			t.jitter, err = time.ParseDuration(t.Jitter)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jitter for target %s: %v", t.Name, err)
+			}
+		}
+		switch t.Overlap {
+		case "":
+			t.Overlap = overlapSkip
+		case overlapSkip, overlapQueue:
+		default:
+			return nil, fmt.Errorf("invalid overlap policy for target %s: %s (skip, queue)", t.Name, t.Overlap)
+		}
+	}
+	return &c, nil
+}
+
+func newDaemon(configPath, stateDir string) (*daemon, error) {
+	c, err := loadDaemonConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	d := &daemon{
+		targets:   c.Targets,
+		statePath: filepath.Join(stateDir, "daemon-state.json"),
+		reportDir: filepath.Join(stateDir, "reports"),
+		state:     daemonState{NextRuns: map[string]time.Time{}},
+	}
+	if err := os.MkdirAll(d.reportDir, 0751); err != nil {
+		return nil, err
+	}
+	exists, err := fileExists(d.statePath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		data, err := os.ReadFile(d.statePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &d.state); err != nil {
+			return nil, fmt.Errorf("invalid daemon state %s: %v", d.statePath, err)
+		}
+		if d.state.NextRuns == nil {
+			d.state.NextRuns = map[string]time.Time{}
+		}
+	}
+	if err := d.removeOrphanedReports(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// run schedules the targets until the context is cancelled, and then waits
+// for the runs in progress to finish
+func (d *daemon) run(ctx context.Context) {
+	var schedulers sync.WaitGroup
+	for _, t := range d.targets {
+		schedulers.Add(1)
+		go func(t *daemonTarget) {
+			defer schedulers.Done()
+			d.schedule(ctx, t)
+		}(t)
+	}
+	schedulers.Wait()
+	log.Println("Stopping daemon, waiting for the running backups to finish")
+	d.wg.Wait()
+}
+
+func (d *daemon) schedule(ctx context.Context, t *daemonTarget) {
+	for {
+		next := d.nextRun(t)
+		log.Printf("Next run of %s at %s", t.Name, next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		d.trigger(t)
+	}
+}
+
+// nextRun returns the persisted next run of the target, or schedules a
+// new one. A run missed while the daemon was down is made right away.
+func (d *daemon) nextRun(t *daemonTarget) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if next, ok := d.state.NextRuns[t.Name]; ok {
+		return next
+	}
+	next := t.schedule.Next(daemonNow())
+	if t.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(t.jitter))))
+	}
+	d.state.NextRuns[t.Name] = next
+	d.saveState()
+	return next
+}
+
+// trigger starts a run of the target, unless it is still running, in which
+// case the run is skipped or queued according to its overlap policy
+func (d *daemon) trigger(t *daemonTarget) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.state.NextRuns, t.Name)
+
+	if t.running {
+		if t.Overlap == overlapQueue {
+			log.Printf("%s is still running, queueing the next run", t.Name)
+			t.queued = true
+		} else {
+			log.Printf("%s is still running, skipping this run", t.Name)
+			now := daemonNow()
+			d.addRun(&daemonRun{Target: t.Name, StartedAt: now, FinishedAt: now, Status: repoActionSkipped})
+		}
+		d.saveState()
+		return
+	}
+	t.running = true
+	d.wg.Add(1)
+	go d.execute(t)
+}
+
+func (d *daemon) execute(t *daemonTarget) {
+	defer d.wg.Done()
+	for {
+		r := d.runTarget(t)
+
+		d.mu.Lock()
+		d.addRun(r)
+		d.saveState()
+		queued := t.queued
+		t.queued = false
+		if !queued {
+			t.running = false
+		}
+		d.mu.Unlock()
+
+		if !queued {
+			return
+		}
+		log.Printf("Starting the queued run of %s", t.Name)
+	}
+}
+
+// runTarget runs gitbackup for the target as a child process, and
+// collects the outcome from its run report
+func (d *daemon) runTarget(t *daemonTarget) *daemonRun {
+	r := &daemonRun{Target: t.Name, StartedAt: daemonNow()}
+	r.ReportPath = filepath.Join(d.reportDir, fmt.Sprintf("%s-%s.json", t.Name, r.StartedAt.Format("2006-01-02-15-04-05")))
+
+	executable, err := daemonExecutable()
+	if err != nil {
+		r.FinishedAt = daemonNow()
+		r.Status = repoActionFailed
+		r.Error = err.Error()
+		return r
+	}
+
+	log.Printf("Starting run of %s", t.Name)
+	cmd := exec.Command(executable, append(append([]string{}, t.Args...), "-report", r.ReportPath)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for k, v := range t.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	runErr := cmd.Run()
+	r.FinishedAt = daemonNow()
+
+	r.Status = "success"
+	if runErr != nil {
+		r.Status = repoActionFailed
+		r.Error = runErr.Error()
+	}
+
+	report, err := loadRunReport(r.ReportPath)
+	if err != nil {
+		debugLogf("No report for the run of %s: %v", t.Name, err)
+		r.ReportPath = ""
+	} else {
+		appMetrics.observeRun(report)
+		r.Counts = map[string]int{}
+		for _, rr := range report.Repositories {
+			r.Counts[rr.Action]++
+		}
+		if !report.Success {
+			r.Status = repoActionFailed
+			if r.Error == "" {
+				r.Error = report.Error
+			}
+		}
+	}
+	log.Printf("Run of %s finished: %s", t.Name, r.Status)
+	return r
+}
+
+// addRun records a run, along with the last maxDaemonRecentRuns ones, and
+// removes the reports of the runs dropped
+func (d *daemon) addRun(r *daemonRun) {
+	d.state.RecentRuns = append(d.state.RecentRuns, r)
+	if len(d.state.RecentRuns) > maxDaemonRecentRuns {
+		dropped := d.state.RecentRuns[:len(d.state.RecentRuns)-maxDaemonRecentRuns]
+		d.state.RecentRuns = d.state.RecentRuns[len(d.state.RecentRuns)-maxDaemonRecentRuns:]
+		for _, run := range dropped {
+			d.removeReport(run.ReportPath)
+		}
+	}
+}
+
+// removeOrphanedReports removes the reports of the runs which are not
+// recent runs anymore, left by the versions which kept them all. It must
+// be called before any run starts, as the report of a run in progress is
+// not recorded yet.
+func (d *daemon) removeOrphanedReports() error {
+	entries, err := os.ReadDir(d.reportDir)
+	if err != nil {
+		return err
+	}
+	recent := map[string]bool{}
+	for _, run := range d.state.RecentRuns {
+		recent[run.ReportPath] = true
+	}
+	for _, entry := range entries {
+		reportPath := filepath.Join(d.reportDir, entry.Name())
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") && !recent[reportPath] {
+			d.removeReport(reportPath)
+		}
+	}
+	return nil
+}
+
+func (d *daemon) removeReport(reportPath string) {
+	if reportPath == "" {
+		return
+	}
+	if err := os.Remove(reportPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove the run report %s -> %v", reportPath, err)
+	}
+}
+
+// saveState persists the daemon state, must be called with d.mu held
+func (d *daemon) saveState() {
+	data, err := json.MarshalIndent(d.state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(d.statePath, data, 0644)
+	}
+	if err != nil {
+		log.Printf("failed to save daemon state -> %v", err)
+	}
+}
+
+type daemonTargetStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	Running  bool       `json:"running"`
+	Queued   bool       `json:"queued"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	status := struct {
+		Targets    []daemonTargetStatus `json:"targets"`
+		RecentRuns []*daemonRun         `json:"recent_runs"`
+	}{RecentRuns: d.state.RecentRuns}
+	for _, t := range d.targets {
+		ts := daemonTargetStatus{Name: t.Name, Schedule: t.Schedule, Running: t.running, Queued: t.queued}
+		if next, ok := d.state.NextRuns[t.Name]; ok {
+			ts.NextRun = &next
+		}
+		status.Targets = append(status.Targets, ts)
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	d.mu.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func loadRunReport(reportPath string) (*runReport, error) {
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	var r runReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
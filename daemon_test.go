@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeDaemonConfig(t *testing.T, config string) string {
+	configPath := filepath.Join(t.TempDir(), "targets.json")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestLoadDaemonConfig(t *testing.T) {
+	var testConfigs = []struct {
+		config  string
+		wantErr string
+	}{
+		{`{"targets": [{"name": "github", "schedule": "0 3 * * *", "jitter": "10m"}]}`, ""},
+		{`{"targets": [{"name": "github", "schedule": "@daily", "overlap": "queue"}]}`, ""},
+		{`{"targets": []}`, "no targets"},
+		{`{"targets": [{"schedule": "@daily"}]}`, "needs a name"},
+		{`{"targets": [{"name": "a", "schedule": "61 * * * *"}]}`, "invalid schedule"},
+		{`{"targets": [{"name": "a", "schedule": "@daily", "jitter": "soon"}]}`, "invalid jitter"},
+		{`{"targets": [{"name": "a", "schedule": "@daily", "overlap": "kill"}]}`, "invalid overlap"},
+		{`{"targets": [{"name": "a", "schedule": "@daily"}, {"name": "a", "schedule": "@hourly"}]}`, "duplicate"},
+	}
+	for _, tc := range testConfigs {
+		c, err := loadDaemonConfig(writeDaemonConfig(t, tc.config))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("Expected %s to be valid, got %v", tc.config, err)
+			} else if c.Targets[0].Overlap == "" {
+				t.Errorf("Expected a default overlap policy for %s", tc.config)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Expected error containing %q for %s, got %v", tc.wantErr, tc.config, err)
+		}
+	}
+}
+
+func TestDaemonNextRunIsPersisted(t *testing.T) {
+	now := time.Date(2024, 1, 1, 2, 30, 0, 0, time.UTC)
+	daemonNow = func() time.Time { return now }
+	defer func() { daemonNow = time.Now }()
+
+	configPath := writeDaemonConfig(t, `{"targets": [{"name": "github", "schedule": "0 3 * * *", "jitter": "10m"}]}`)
+	stateDir := t.TempDir()
+	d, err := newDaemon(configPath, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := d.nextRun(d.targets[0])
+	earliest := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	if next.Before(earliest) || !next.Before(earliest.Add(10*time.Minute)) {
+		t.Errorf("Expected the next run within the jitter after %s, got %s", earliest, next)
+	}
+
+	// A restarted daemon keeps the scheduled run
+	d, err = newDaemon(configPath, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.nextRun(d.targets[0]); !got.Equal(next) {
+		t.Errorf("Expected the persisted next run %s, got %s", next, got)
+	}
+}
+
+func TestDaemonRemovesOldReports(t *testing.T) {
+	configPath := writeDaemonConfig(t, `{"targets": [{"name": "github", "schedule": "0 3 * * *"}]}`)
+	stateDir := t.TempDir()
+	reportDir := filepath.Join(stateDir, "reports")
+	os.MkdirAll(reportDir, 0751)
+	orphaned := filepath.Join(reportDir, "github-2023-01-01-03-00-00.json")
+	os.WriteFile(orphaned, []byte("{}"), 0644)
+	d, err := newDaemon(configPath, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphaned); !os.IsNotExist(err) {
+		t.Errorf("Expected the report of a run which is not recent to be removed")
+	}
+
+	var reports []string
+	for i := 0; i < maxDaemonRecentRuns+2; i++ {
+		reportPath := filepath.Join(reportDir, fmt.Sprintf("github-%d.json", i))
+		os.WriteFile(reportPath, []byte("{}"), 0644)
+		reports = append(reports, reportPath)
+		d.addRun(&daemonRun{Target: "github", ReportPath: reportPath})
+	}
+	if len(d.state.RecentRuns) != maxDaemonRecentRuns {
+		t.Errorf("Expected the last %d runs, got %d", maxDaemonRecentRuns, len(d.state.RecentRuns))
+	}
+	for i, reportPath := range reports {
+		_, err := os.Stat(reportPath)
+		if i < 2 && !os.IsNotExist(err) {
+			t.Errorf("Expected the report of a dropped run %s to be removed", reportPath)
+		}
+		if i >= 2 && err != nil {
+			t.Errorf("Expected the report of a recent run %s to be kept, got %v", reportPath, err)
+		}
+	}
+}
+
+func TestDaemonOverlap(t *testing.T) {
+	configPath := writeDaemonConfig(t, `{"targets": [
+		{"name": "skipper", "schedule": "@hourly", "overlap": "skip"},
+		{"name": "queuer", "schedule": "@hourly", "overlap": "queue"}
+	]}`)
+	d, err := newDaemon(configPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipper, queuer := d.targets[0], d.targets[1]
+	skipper.running = true
+	queuer.running = true
+
+	d.trigger(skipper)
+	d.trigger(queuer)
+
+	if len(d.state.RecentRuns) != 1 || d.state.RecentRuns[0].Target != "skipper" || d.state.RecentRuns[0].Status != repoActionSkipped {
+		t.Errorf("Expected a skipped run to be recorded, got %+v", d.state.RecentRuns)
+	}
+	if !queuer.queued {
+		t.Errorf("Expected the run to be queued")
+	}
+}
+
+func TestDaemonRunTarget(t *testing.T) {
+	daemonExecutable = func() (string, error) { return os.Args[0], nil }
+	defer func() { daemonExecutable = os.Executable }()
+
+	configPath := writeDaemonConfig(t, `{"targets": [{
+		"name": "github",
+		"schedule": "@daily",
+		"args": ["-test.run=TestHelperDaemonProcess", "--"],
+		"env": {"GO_WANT_HELPER_PROCESS": "1"}
+	}]}`)
+	d, err := newDaemon(configPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.targets[0].running = true
+	d.wg.Add(1)
+	d.execute(d.targets[0])
+
+	if d.targets[0].running {
+		t.Errorf("Expected the target to be no longer running")
+	}
+	if len(d.state.RecentRuns) != 1 {
+		t.Fatalf("Expected one run, got %d", len(d.state.RecentRuns))
+	}
+	r := d.state.RecentRuns[0]
+	if r.Status != repoActionFailed || r.Error != "rate limited" || r.Counts[repoActionCloned] != 1 {
+		t.Errorf("Expected the outcome from the run report, got %+v", r)
+	}
+
+	rec := httptest.NewRecorder()
+	d.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status struct {
+		Targets    []daemonTargetStatus
+		RecentRuns []*daemonRun `json:"recent_runs"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Targets) != 1 || len(status.RecentRuns) != 1 {
+		t.Errorf("Expected the target and its run in the status, got %s", rec.Body.String())
+	}
+}
+
+// TestHelperDaemonProcess stands in for a gitbackup run, writing a report
+func TestHelperDaemonProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "-report" && i+1 < len(args) {
+			r := newRunReport(&appConfig{service: "github", backupDir: "/backups/github.com"})
+			r.startRepo(&Repository{Namespace: "ns", Name: "r1"}).finish(repoActionCloned, nil, nil)
+			r.finish(nil)
+			r.Success = false
+			r.Error = "rate limited"
+			if err := r.write(args[i+1]); err != nil {
+				os.Exit(2)
+			}
+		}
+	}
+	os.Exit(0)
+}
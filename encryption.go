@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// The suffixes of the archives encrypted for age recipients and OpenPGP keys
+const (
+	archiveSuffixAge = ".age"
+	archiveSuffixPGP = ".gpg"
+)
+
+// pgpPassphraseEnv is the environment variable with the passphrase of the
+// OpenPGP private key used to decrypt the archives
+const pgpPassphraseEnv = "GITBACKUP_PGP_PASSPHRASE"
+
+// archiveEncryption holds the public keys the archives are encrypted for,
+// either age recipients or OpenPGP keys
+type archiveEncryption struct {
+	ageRecipients []age.Recipient
+	pgpKeys       openpgp.EntityList
+}
+
+// newArchiveEncryption reads the age recipients, given as is or in a file
+// with one per line, and the OpenPGP public keys
+func newArchiveEncryption(ageRecipients []string, ageRecipientsFile string, pgpKeyFiles []string) (*archiveEncryption, error) {
+	e := &archiveEncryption{}
+	for _, r := range ageRecipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %v", r, err)
+		}
+		e.ageRecipients = append(e.ageRecipients, recipient)
+	}
+	if ageRecipientsFile != "" {
+		f, err := os.Open(ageRecipientsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		recipients, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipients in %s: %v", ageRecipientsFile, err)
+		}
+		e.ageRecipients = append(e.ageRecipients, recipients...)
+	}
+	for _, keyFile := range pgpKeyFiles {
+		keys, err := readPGPKeyRing(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		e.pgpKeys = append(e.pgpKeys, keys...)
+	}
+	if len(e.ageRecipients) > 0 && len(e.pgpKeys) > 0 {
+		return nil, errors.New("the archives are encrypted either for age recipients or OpenPGP keys, not both")
+	}
+	return e, nil
+}
+
+// enabled returns true when the archives are encrypted
+func (e *archiveEncryption) enabled() bool {
+	return e != nil && (len(e.ageRecipients) > 0 || len(e.pgpKeys) > 0)
+}
+
+// suffix returns the suffix of the encrypted archives
+func (e *archiveEncryption) suffix() string {
+	switch {
+	case !e.enabled():
+		return ""
+	case len(e.ageRecipients) > 0:
+		return archiveSuffixAge
+	}
+	return archiveSuffixPGP
+}
+
+// encrypt returns a writer encrypting to w, which must be closed to
+// flush the encryption
+func (e *archiveEncryption) encrypt(w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case !e.enabled():
+		return nopWriteCloser{w}, nil
+	case len(e.ageRecipients) > 0:
+		return age.Encrypt(w, e.ageRecipients...)
+	}
+	return openpgp.Encrypt(w, e.pgpKeys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// readPGPKeyRing reads OpenPGP keys, armored or not, decrypting their
+// private keys with the passphrase in GITBACKUP_PGP_PASSPHRASE
+func readPGPKeyRing(keyFile string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys openpgp.EntityList
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "-----BEGIN PGP") {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP key in %s: %v", keyFile, err)
+	}
+	passphrase := []byte(os.Getenv(pgpPassphraseEnv))
+	for _, key := range keys {
+		if key.PrivateKey != nil && key.PrivateKey.Encrypted {
+			if err := key.DecryptPrivateKeys(passphrase); err != nil {
+				return nil, fmt.Errorf("failed to decrypt the OpenPGP key in %s, check %s: %v", keyFile, pgpPassphraseEnv, err)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// archiveDecryption holds the private keys decrypting the archives
+type archiveDecryption struct {
+	ageIdentities []age.Identity
+	pgpKeys       openpgp.EntityList
+	// password of the encrypted 7z archives, extracted by 7z itself
+	password string
+}
+
+// newArchiveDecryption reads the age identity files and the OpenPGP
+// private keys
+func newArchiveDecryption(ageIdentityFiles []string, pgpKeyFiles []string) (*archiveDecryption, error) {
+	d := &archiveDecryption{}
+	for _, identityFile := range ageIdentityFiles {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		identities, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid age identities in %s: %v", identityFile, err)
+		}
+		d.ageIdentities = append(d.ageIdentities, identities...)
+	}
+	for _, keyFile := range pgpKeyFiles {
+		keys, err := readPGPKeyRing(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		d.pgpKeys = append(d.pgpKeys, keys...)
+	}
+	return d, nil
+}
+
+// decrypt returns the name of the archive without its encryption suffix,
+// and a reader decrypting r if the name has one. The integrity of the
+// archive is only verified once the reader is read to the end.
+func (d *archiveDecryption) decrypt(name string, r io.Reader) (string, io.Reader, error) {
+	switch {
+	case strings.HasSuffix(name, archiveSuffixAge):
+		if len(d.ageIdentities) == 0 {
+			return "", nil, errors.New("the archive is encrypted with age, an identity is needed")
+		}
+		dr, err := age.Decrypt(r, d.ageIdentities...)
+		return strings.TrimSuffix(name, archiveSuffixAge), dr, err
+	case strings.HasSuffix(name, archiveSuffixPGP):
+		if len(d.pgpKeys) == 0 {
+			return "", nil, errors.New("the archive is encrypted with OpenPGP, a private key is needed")
+		}
+		md, err := openpgp.ReadMessage(r, d.pgpKeys, nil, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		return strings.TrimSuffix(name, archiveSuffixPGP), md.UnverifiedBody, nil
+	}
+	return name, r, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func TestArchiveAgeRoundTrip(t *testing.T) {
+	repoDir := setupArchiveTests(t, archiveFormatTarZst)
+	appCfg.archiveVolumeSize = 100
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appCfg.archiveEncryption, err = newArchiveEncryption([]string{identity.Recipient().String()}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archives, out, err := archiveRepository(&Repository{Namespace: "ns", Name: "r1"}, "r1", repoDir)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !strings.HasSuffix(archives[0].Path, ".tar.zst.age.001") {
+		t.Fatalf("Expected encrypted volumes, got %+v", archives)
+	}
+
+	identityFile := filepath.Join(t.TempDir(), "key.txt")
+	os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	decryption, err := newArchiveDecryption([]string{identityFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetDir := t.TempDir()
+	if err := restoreArchive(archives[1].Path, targetDir, decryption); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(targetDir, "r1", ".git", "HEAD")); string(data) != "ref: refs/heads/main\n" {
+		t.Errorf("Expected the repository to be restored, got %q", data)
+	}
+	if link, _ := os.Readlink(filepath.Join(targetDir, "r1", "README.md")); link != "README" {
+		t.Errorf("Expected the symbolic link to be restored, got %q", link)
+	}
+
+	// Not without the identity, nor over the restored files
+	if err := restoreArchive(archives[0].Path, t.TempDir(), &archiveDecryption{}); err == nil {
+		t.Errorf("Expected the restore to fail without an identity")
+	}
+	if err := restoreArchive(archives[0].Path, targetDir, decryption); err == nil {
+		t.Errorf("Expected the restore not to overwrite files")
+	}
+}
+
+func TestArchivePGPRoundTrip(t *testing.T) {
+	repoDir := setupArchiveTests(t, archiveFormatZip)
+	entity, err := openpgp.NewEntity("gitbackup", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDir := t.TempDir()
+	publicKey := filepath.Join(keyDir, "public.asc")
+	var public bytes.Buffer
+	w, _ := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+	os.WriteFile(publicKey, public.Bytes(), 0644)
+	privateKey := filepath.Join(keyDir, "private.gpg")
+	var private bytes.Buffer
+	entity.SerializePrivate(&private, nil)
+	os.WriteFile(privateKey, private.Bytes(), 0600)
+
+	appCfg.archiveEncryption, err = newArchiveEncryption(nil, "", []string{publicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives, out, err := archiveRepository(&Repository{Namespace: "ns", Name: "r1"}, "r1", repoDir)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(archives) != 1 || !strings.HasSuffix(archives[0].Path, ".zip.gpg") {
+		t.Fatalf("Expected an encrypted zip archive, got %+v", archives)
+	}
+
+	decryption, err := newArchiveDecryption(nil, []string{privateKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetDir := t.TempDir()
+	if err := restoreArchive(archives[0].Path, targetDir, decryption); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(targetDir, "r1", "README")); len(data) != 10000 {
+		t.Errorf("Expected the README to be restored, got %d bytes", len(data))
+	}
+}
+
+func TestExtractTarOutOfTarget(t *testing.T) {
+	outside := t.TempDir()
+	for name, entries := range map[string][]*tar.Header{
+		"dot dot": {{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}},
+		"symlink": {
+			{Name: "r1/link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "r1/link/new/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range entries {
+			tw.WriteHeader(hdr)
+		}
+		tw.Close()
+		if err := extractTar(&buf, t.TempDir()); err == nil {
+			t.Errorf("%s: expected the archive to be rejected", name)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Expected nothing extracted out of the target directory, got %v", entries)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The values of -filter.archived and -filter.disabled
+const (
+	filterStatusInclude = "include"
+	filterStatusExclude = "exclude"
+	filterStatusOnly    = "only"
+)
+
+// repositoryFilter is the provider neutral filter of the listed
+// repositories, see the -filter.* options
+type repositoryFilter struct {
+	include       []*repoPattern
+	exclude       []*repoPattern
+	archived      string
+	disabled      string
+	visibility    []string
+	topics        []string
+	excludeTopics []string
+	languages     []string
+	// noTopics is set for the services which don't report the topics of
+	// the repositories, which -filter.topics then doesn't exclude
+	noTopics bool
+	// minSize and maxSize are in bytes, 0 for no limit
+	minSize int64
+	maxSize int64
+}
+
+// servicesWithoutTopics are the services whose repositories have no topics
+var servicesWithoutTopics = map[string]bool{"bitbucket": true}
+
+var sizeRegexp = regexp.MustCompile(`^([0-9]+)([kmgt]?)$`)
+
+// parseSize parses a size in bytes, optionally suffixed with k, m, g or t
+func parseSize(s string) (int64, error) {
+	m := sizeRegexp.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	for _, unit := range "kmgt" {
+		if m[2] == "" {
+			break
+		}
+		size *= 1024
+		if m[2] == string(unit) {
+			break
+		}
+	}
+	return size, nil
+}
+
+func validFilterStatus(s string) bool {
+	return s == filterStatusInclude || s == filterStatusExclude || s == filterStatusOnly
+}
+
+// nameExclusionReason returns why the namespace/name of a repository is
+// excluded by -filter.include and -filter.exclude, if it is
+func (f *repositoryFilter) nameExclusionReason(repo *Repository) string {
+	if len(f.include) > 0 {
+		included := false
+		for _, p := range f.include {
+			if p.match(repo) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "matches no -filter.include pattern"
+		}
+	}
+	for _, p := range f.exclude {
+		if p.match(repo) {
+			return fmt.Sprintf("matches the -filter.exclude pattern %s", p)
+		}
+	}
+	return ""
+}
+
+// exclusionReason returns why a repository is excluded, if it is.
+// Attributes the service does not report, like the size and the topics of
+// Bitbucket repositories, never exclude a repository.
+func (f *repositoryFilter) exclusionReason(repo *Repository) string {
+	if reason := f.nameExclusionReason(repo); reason != "" {
+		return reason
+	}
+	if reason := statusExclusionReason(f.archived, repo.Archived, "archived"); reason != "" {
+		return reason
+	}
+	if reason := statusExclusionReason(f.disabled, repo.Disabled, "disabled"); reason != "" {
+		return reason
+	}
+	if len(f.visibility) > 0 && repo.Visibility != "" && !containsFold(f.visibility, repo.Visibility) {
+		return fmt.Sprintf("visibility is %s", repo.Visibility)
+	}
+	if len(f.topics) > 0 && !f.noTopics {
+		found := false
+		for _, topic := range repo.Topics {
+			if containsFold(f.topics, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("has none of the topics %s", strings.Join(f.topics, ", "))
+		}
+	}
+	for _, topic := range repo.Topics {
+		if containsFold(f.excludeTopics, topic) {
+			return fmt.Sprintf("has the excluded topic %s", topic)
+		}
+	}
+	if len(f.languages) > 0 && repo.Language != "" && !containsFold(f.languages, repo.Language) {
+		return fmt.Sprintf("language is %s", repo.Language)
+	}
+	if repo.Size > 0 {
+		if f.minSize > 0 && repo.Size < f.minSize {
+			return fmt.Sprintf("size of %d bytes is below -filter.min-size", repo.Size)
+		}
+		if f.maxSize > 0 && repo.Size > f.maxSize {
+			return fmt.Sprintf("size of %d bytes is above -filter.max-size", repo.Size)
+		}
+	}
+	return ""
+}
+
+func statusExclusionReason(filter string, status bool, name string) string {
+	if filter == filterStatusExclude && status {
+		return name
+	}
+	if filter == filterStatusOnly && !status {
+		return "not " + name
+	}
+	return ""
+}
+
+// filterRepositories drops the repositories excluded by the -filter.*
+// options, explaining why in the debug output
+func filterRepositories(c *appConfig, repositories []*Repository) []*Repository {
+	var kept []*Repository
+	for _, repo := range repositories {
+		if reason := c.filter.exclusionReason(repo); reason != "" {
+			debugLogf("Excluding %s/%s: %s", repo.Namespace, repo.Name, reason)
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	if excluded := len(repositories) - len(kept); excluded > 0 {
+		log.Printf("%d of %d repositories excluded by the filters", excluded, len(repositories))
+	}
+	return kept
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
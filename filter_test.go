@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	var testCases = []struct {
+		size     string
+		expected int64
+	}{
+		{"100", 100},
+		{"500k", 500 * 1024},
+		{"10M", 10 * 1024 * 1024},
+		{"2g", 2 * 1024 * 1024 * 1024},
+	}
+	for _, tc := range testCases {
+		size, err := parseSize(tc.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != tc.expected {
+			t.Errorf("Expected %s to be %d bytes, got %d", tc.size, tc.expected, size)
+		}
+	}
+	for _, invalid := range []string{"", "10mb", "-1", "k"} {
+		if _, err := parseSize(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestFilterExclusionReason(t *testing.T) {
+	include, _ := parseRepoPatterns([]string{"org/**", "re:^user/"})
+	exclude, _ := parseRepoPatterns([]string{"*/*-archive"})
+	f := &repositoryFilter{
+		include:       include,
+		exclude:       exclude,
+		archived:      filterStatusExclude,
+		disabled:      filterStatusInclude,
+		visibility:    []string{"public", "internal"},
+		topics:        []string{"backend", "frontend"},
+		excludeTopics: []string{"deprecated"},
+		languages:     []string{"go", "rust"},
+		maxSize:       1024 * 1024,
+	}
+	base := Repository{Namespace: "org", Name: "app", Visibility: "public", Topics: []string{"Backend"}, Language: "Go", Size: 1024}
+
+	var testCases = []struct {
+		name     string
+		change   func(r *Repository)
+		expected string
+	}{
+		{"kept", func(r *Repository) {}, ""},
+		{"not included", func(r *Repository) { r.Namespace = "other" }, "matches no -filter.include pattern"},
+		{"excluded", func(r *Repository) { r.Name = "app-archive" }, "matches the -filter.exclude pattern */*-archive"},
+		{"archived", func(r *Repository) { r.Archived = true }, "archived"},
+		{"disabled", func(r *Repository) { r.Disabled = true }, ""},
+		{"private", func(r *Repository) { r.Visibility = "private" }, "visibility is private"},
+		{"no topic", func(r *Repository) { r.Topics = nil }, "has none of the topics backend, frontend"},
+		{"excluded topic", func(r *Repository) { r.Topics = []string{"backend", "deprecated"} }, "has the excluded topic deprecated"},
+		{"language", func(r *Repository) { r.Language = "Python" }, "language is Python"},
+		{"unknown language", func(r *Repository) { r.Language = "" }, ""},
+		{"too large", func(r *Repository) { r.Size = 2 * 1024 * 1024 }, "size of 2097152 bytes is above -filter.max-size"},
+		{"unknown size", func(r *Repository) { r.Size = 0 }, ""},
+	}
+	for _, tc := range testCases {
+		repo := base
+		tc.change(&repo)
+		if got := f.exclusionReason(&repo); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+
+	// Bitbucket reports no topics
+	f.noTopics = true
+	bitbucket := base
+	bitbucket.Topics = nil
+	if got := f.exclusionReason(&bitbucket); got != "" {
+		t.Errorf("Expected a Bitbucket repository not to be excluded by -filter.topics, got %q", got)
+	}
+
+	f.archived = filterStatusOnly
+	if got := f.exclusionReason(&base); got != "not archived" {
+		t.Errorf("Expected only the archived repositories to be kept, got %q", got)
+	}
+}
+
+func TestFilterRepositories(t *testing.T) {
+	exclude, _ := parseRepoPatterns([]string{"org/skip"})
+	c := &appConfig{filter: repositoryFilter{exclude: exclude}}
+	repositories := []*Repository{{Namespace: "org", Name: "keep"}, {Namespace: "org", Name: "skip"}}
+
+	kept := filterRepositories(c, repositories)
+	if len(kept) != 1 || kept[0].Name != "keep" {
+		t.Errorf("Expected only org/keep to be kept, got %+v", kept)
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"sync"
 	"time"
@@ -11,17 +11,17 @@ import (
 
 const cacheSaveLastBackupDateAndContinueFromCache = "2006-01-02 15:04:05"
 
-func getGithubSaveLastBackupDateAndContinueFromPath(c *appConfig) string {
+// getLegacyLastBackupPath returns the file the time of the last backup
+// was saved to before the state database
+func getLegacyLastBackupPath(c *appConfig) string {
 	return filepath.Join(c.cacheDir, "github_save_last_backup_date_and_continue_from")
 }
 
-func handleGitRepositoryClone(client interface{}, c *appConfig) error {
+func handleGitRepositoryClone(c *appConfig) (err error) {
 
-	// Used for waiting for all the goroutines to finish before exiting
 	startTime := time.Now()
-	githubSaveLastBackupDateAndContinueFromCacheFilePath := getGithubSaveLastBackupDateAndContinueFromPath(c)
 	debugLogf(
-		"Starting backup run: service=%s backupDir=%s archiveDir=%s cacheDir=%s bare=%t maxConcurrentClones=%d useHTTPS=%t ignorePrivate=%t ignoreFork=%t shallowRepos=%d startFrom=%s saveLast=%t",
+		"Starting backup run: service=%s backupDir=%s archiveDir=%s cacheDir=%s bare=%t maxConcurrentClones=%d useHTTPS=%t ignorePrivate=%t ignoreFork=%t shallowRepos=%d changedSince=%s skipUnchanged=%t",
 		c.service,
 		c.backupDir,
 		c.archiveDir,
@@ -32,38 +32,65 @@ func handleGitRepositoryClone(client interface{}, c *appConfig) error {
 		c.ignorePrivate,
 		c.ignoreFork,
 		len(c.shallowCloneRepos),
-		c.githubStartFromLastPushAt,
-		c.githubSaveLastBackupDateAndContinueFrom,
+		c.changedSince,
+		c.skipUnchanged,
 	)
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	if c.metricsTextfile != "" {
+		if metricsErr := appMetrics.loadTextfile(c.metricsTextfile); metricsErr != nil {
+			log.Printf("failed to load previous metrics -> %v", metricsErr)
+		}
+	}
+	currentReport = newRunReport(c)
+	defer func() {
+		currentReport.finish(err)
+		if c.archiveDir != "" {
+			if manifestPath, manifestErr := writeRunManifest(c, currentReport); manifestErr != nil {
+				log.Printf("failed to write the manifest -> %v", manifestErr)
+			} else if manifestPath != "" {
+				log.Printf("Manifest of the archives written to %s", manifestPath)
+			}
+		}
+		appMetrics.observeRun(currentReport)
+		if c.reportPath != "" {
+			if reportErr := currentReport.write(c.reportPath); reportErr != nil {
+				log.Printf("failed to write report -> %v", reportErr)
+			} else {
+				debugLogf("Report written to %s", c.reportPath)
+			}
+		}
+		if c.metricsTextfile != "" {
+			if metricsErr := appMetrics.writeTextfile(c.metricsTextfile); metricsErr != nil {
+				log.Printf("failed to write metrics textfile -> %v", metricsErr)
+			} else {
+				debugLogf("Metrics written to %s", c.metricsTextfile)
+			}
+		}
+		sendNotifications(c, newNotificationFromReport("backup", currentReport))
+	}()
 
-	tokens := make(chan bool, c.maxConcurrentClones)
-	gitHostUsername = getUsername(client, c.service)
+	// After the report is set up, so that a failure to reach the git host
+	// is reported and notified like any other
+	client, err := newClient(c.service, c.gitHostURL)
+	if err != nil {
+		return err
+	}
+	gitHostUsername, err = getUsername(client, c.service)
+	if err != nil {
+		return err
+	}
 
 	if len(gitHostUsername) == 0 && !*ignorePrivate && *useHTTPSClone {
-		log.Fatal("Your Git host's username is needed for backing up private repositories via HTTPS")
+		return errors.New("Your Git host's username is needed for backing up private repositories via HTTPS")
 	}
 
-	if c.githubSaveLastBackupDateAndContinueFrom {
-		exists, err := fileExists(githubSaveLastBackupDateAndContinueFromCacheFilePath)
-		if err != nil {
-			return err
-		}
-		if exists {
-			// load
-			var tmpContent string
-			tmpContent, err = getFileContents(githubSaveLastBackupDateAndContinueFromCacheFilePath)
-			if tmpContent != "" {
-				tmpTime, timeErr := time.Parse(cacheSaveLastBackupDateAndContinueFromCache, tmpContent)
-				if timeErr != nil {
-					// reset?! or report error...
-					return timeErr
-				}
-				c.githubStartFromLastPushAt = tmpTime.Format(cacheSaveLastBackupDateAndContinueFromCache)
-			}
-		}
+	currentState, err = openStateStore(getStateDBPath(c), filepath.Base(c.backupDir))
+	if err != nil {
+		return err
+	}
+	defer func() { currentState = nil }()
+	if err := currentState.importLegacyLastBackup(getLegacyLastBackupPath(c)); err != nil {
+		log.Printf("failed to import the time of the last backup -> %v", err)
 	}
 
 	repositories, err := getRepositories(
@@ -83,54 +110,115 @@ func handleGitRepositoryClone(client interface{}, c *appConfig) error {
 	debugLogf("Retrieved %d repositories", len(repositories))
 
 	for _, repo := range repositories {
-		repo.Shallow = shallowCloneRequested(c.shallowCloneRepos, repo.Namespace, repo.Name)
-		if repo.Shallow {
-			debugLogf("Marked for shallow clone: %s/%s", repo.Namespace, repo.Name)
-		}
+		setCloneStrategy(c, repo)
 	}
 
 	if len(repositories) == 0 {
 		return fmt.Errorf("no repositories retrieved")
 	}
 
+	if err := reconcileRepositories(c, repositories); err != nil {
+		return err
+	}
+
+	listed := repositories
+	// The excluded repositories are still listed upstream, so they are
+	// neither orphaned nor backed up as submodules
+	repositories = filterRepositories(c, repositories)
+	repositories, err = filterUnchangedRepositories(c, repositories)
+	if err != nil {
+		return err
+	}
+
+	// Used for waiting for all the goroutines to finish before exiting
+	var wg sync.WaitGroup
+	var errorsMu sync.Mutex
 	isAnyErrorOccurred := false
+	tokens := make(chan bool, c.maxConcurrentClones)
 
-	if c.githubSaveLastBackupDateAndContinueFrom {
-		defer func() {
-			// try saving the date...
-			if isAnyErrorOccurred {
-				log.Println("failed to cache the time of this current clone")
-			} else {
-				// Save the time
-				cacheDirErr := os.MkdirAll(c.cacheDir, 0751)
-				if cacheDirErr != nil {
-					log.Println(fmt.Sprintf("failed to create cache dir -> %v", c.cacheDir))
-					return
-				}
-				err = writeFileContents(githubSaveLastBackupDateAndContinueFromCacheFilePath, startTime.Format(cacheSaveLastBackupDateAndContinueFromCache))
-				if err != nil {
-					log.Println(fmt.Sprintf("failed to save cache file -> %s", githubSaveLastBackupDateAndContinueFromCacheFilePath))
-				} else {
-					log.Println(fmt.Sprintf("cache file saved successfully -> %s", githubSaveLastBackupDateAndContinueFromCacheFilePath))
-				}
-			}
-		}()
+	// Submodules are queued once, unless already listed upstream
+	var queuedMu sync.Mutex
+	queued := map[string]bool{}
+	for _, repo := range listed {
+		queued[repositoryURLKey(repo.CloneURL)] = true
 	}
+	gitHost := filepath.Base(c.backupDir)
 
-	log.Printf("Backing up %v repositories now..\n", len(repositories))
-	for _, repo := range repositories {
-		tokens <- true
+	var queue func(repo *Repository)
+	queue = func(repo *Repository) {
+		// Before the repository is done, so that the wait covers its submodules
 		wg.Add(1)
-		go func(repo *Repository) {
-			debugLogf("Queueing repo: %s/%s (shallow=%t bare=%t)", repo.Namespace, repo.Name, repo.Shallow, c.bare)
+		go func() {
+			defer wg.Done()
+			tokens <- true
+			debugLogf("Queueing repo: %s/%s (strategy=%s bare=%t)", repo.Namespace, repo.Name, repo.strategy(), c.bare)
 			// Backup
-			stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &wg)
+			var backupWg sync.WaitGroup
+			backupWg.Add(1)
+			stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &backupWg)
+			<-tokens
 			if err != nil {
+				errorsMu.Lock()
 				isAnyErrorOccurred = true
+				errorsMu.Unlock()
 				log.Printf("Error backing up %s: %s\n", repo.Name, stdoutStderr)
+				return
 			}
-			<-tokens
-		}(repo)
+			if !c.submodules {
+				return
+			}
+			repoDir, _ := getRepoDir(c.backupDir, repo, c.bare)
+			for _, submodule := range discoverSubmodules(repo, repoDir, c.bare, gitHost) {
+				key := repositoryURLKey(submodule.CloneURL)
+				queuedMu.Lock()
+				isQueued := queued[key]
+				queued[key] = true
+				queuedMu.Unlock()
+				if !isQueued {
+					log.Printf("Found submodule %s of %s/%s\n", submodule.CloneURL, repo.Namespace, repo.Name)
+					setCloneStrategy(c, submodule)
+					queue(submodule)
+				}
+			}
+		}()
+	}
+
+	var submodules []*Repository
+	if c.submodules {
+		submodules, err = knownSubmodules(listed)
+		if err != nil {
+			return err
+		}
+		for _, submodule := range submodules {
+			queued[repositoryURLKey(submodule.CloneURL)] = true
+			setCloneStrategy(c, submodule)
+		}
+	}
+
+	log.Printf("Backing up %v repositories now..\n", len(repositories))
+	for _, repo := range repositories {
+		queue(repo)
+	}
+	if len(submodules) > 0 {
+		log.Printf("Backing up %v known submodules\n", len(submodules))
+		for _, submodule := range submodules {
+			queue(submodule)
+		}
+	}
+	wg.Wait()
+
+	if pruneErr := pruneArchives(c); pruneErr != nil {
+		log.Printf("failed to apply the retention policy -> %v", pruneErr)
+	}
+
+	if isAnyErrorOccurred {
+		log.Println("not all repositories were backed up successfully")
+	} else {
+		if stateErr := currentState.setLastFullBackupAt(startTime); stateErr != nil {
+			log.Printf("failed to save the time of this backup -> %v", stateErr)
+		} else {
+			currentReport.setLastBackupAt(startTime)
+		}
 	}
 	return nil
 }
@@ -2,9 +2,8 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,7 +22,7 @@ func getGithubRepositories(
 ) ([]*Repository, error) {
 
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return nil, fmt.Errorf("Couldn't acquire a client to talk to %s", service)
 	}
 
 	var repositories []*Repository
@@ -31,18 +30,6 @@ func getGithubRepositories(
 
 	ctx := context.Background()
 
-	var err error
-	var startFromLastPushAt time.Time
-	var startFromLastPush bool
-
-	if c.githubStartFromLastPushAt != "" {
-		startFromLastPush = true
-		startFromLastPushAt, err = time.Parse(cacheSaveLastBackupDateAndContinueFromCache, c.githubStartFromLastPushAt)
-		if err != nil {
-			return nil, errors.New(fmt.Sprintf("failed to parse githubStartFromLastPushAt -> %v", err.Error()))
-		}
-	}
-
 	if githubRepoType == "starred" {
 		options := github.ActivityListStarredOptions{}
 		for {
@@ -59,22 +46,22 @@ func getGithubRepositories(
 						cloneURL = *star.Repository.SSHURL
 					}
 
-					if startFromLastPush {
-						if star.Repository.PushedAt != nil {
-							if !star.Repository.PushedAt.Time.After(startFromLastPushAt) {
-								continue
-							}
-						}
-					}
-
 					repositories = append(repositories, &Repository{
-						PushedAt:  star.Repository.PushedAt,
-						UpdatedAt: star.Repository.UpdatedAt,
-						//
-						CloneURL:  cloneURL,
-						Name:      *star.Repository.Name,
-						Namespace: namespace,
-						Private:   *star.Repository.Private,
+						PushedAt:   githubTime(star.Repository.PushedAt),
+						UpdatedAt:  githubTime(star.Repository.UpdatedAt),
+						ID:         strconv.FormatInt(star.Repository.GetID(), 10),
+						CloneURL:   cloneURL,
+						Name:       *star.Repository.Name,
+						Namespace:  namespace,
+						Private:    *star.Repository.Private,
+						Fork:       *star.Repository.Fork,
+						Visibility: githubVisibility(star.Repository),
+						Archived:   star.Repository.GetArchived(),
+						Disabled:   star.Repository.GetDisabled(),
+						Topics:     star.Repository.Topics,
+						Language:   star.Repository.GetLanguage(),
+						// GitHub reports the size in kilobytes
+						Size: int64(star.Repository.GetSize()) * 1024,
 					})
 				}
 			} else {
@@ -111,21 +98,22 @@ func getGithubRepositories(
 					cloneURL = *repo.SSHURL
 				}
 
-				if startFromLastPush {
-					if repo.PushedAt != nil {
-						if !repo.PushedAt.Time.After(startFromLastPushAt) {
-							continue
-						}
-					}
-				}
-
 				repositories = append(repositories, &Repository{
-					PushedAt:  repo.PushedAt,
-					UpdatedAt: repo.UpdatedAt,
-					CloneURL:  cloneURL,
-					Name:      *repo.Name,
-					Namespace: namespace,
-					Private:   *repo.Private,
+					PushedAt:   githubTime(repo.PushedAt),
+					UpdatedAt:  githubTime(repo.UpdatedAt),
+					ID:         strconv.FormatInt(repo.GetID(), 10),
+					CloneURL:   cloneURL,
+					Name:       *repo.Name,
+					Namespace:  namespace,
+					Private:    *repo.Private,
+					Fork:       *repo.Fork,
+					Visibility: githubVisibility(repo),
+					Archived:   repo.GetArchived(),
+					Disabled:   repo.GetDisabled(),
+					Topics:     repo.Topics,
+					Language:   repo.GetLanguage(),
+					// GitHub reports the size in kilobytes
+					Size: int64(repo.GetSize()) * 1024,
 				})
 			}
 		} else {
@@ -138,3 +126,24 @@ func getGithubRepositories(
 	}
 	return repositories, nil
 }
+
+// githubTime converts a GitHub timestamp to the time we keep in Repository
+func githubTime(ts *github.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.Time
+	return &t
+}
+
+// githubVisibility returns the visibility of a repository, which is only
+// reported by GitHub Enterprise, where repositories can be internal
+func githubVisibility(repo *github.Repository) string {
+	if v := repo.GetVisibility(); v != "" {
+		return v
+	}
+	if repo.GetPrivate() {
+		return "private"
+	}
+	return "public"
+}
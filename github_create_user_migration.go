@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"time"
 )
 
-func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
+func handleGithubCreateUserMigration(client interface{}, c *appConfig) (err error) {
+	startTime := time.Now()
+	defer func() {
+		sendNotifications(c, newNotification("user migration", c, startTime, err))
+	}()
+
 	repos, err := getRepositories(
 		client,
 		c,
@@ -18,7 +24,7 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 		c.ignoreFork,
 	)
 	if err != nil {
-		log.Fatalf("Error getting list of repositories: %v", err)
+		return fmt.Errorf("Error getting list of repositories: %v", err)
 	}
 
 	log.Printf("Creating a user migration for %d repos", len(repos))
@@ -29,7 +35,7 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 		c.githubCreateUserMigrationRetryMax,
 	)
 	if err != nil {
-		log.Fatalf("Error creating migration: %v", err)
+		return fmt.Errorf("Error creating migration: %v", err)
 	}
 
 	if c.githubWaitForMigrationComplete {
@@ -41,18 +47,18 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 			migrationStatePollingDuration,
 		)
 		if err != nil {
-			log.Fatalf("Error querying/downloading migration: %v", err)
+			return fmt.Errorf("Error querying/downloading migration: %v", err)
 		}
 	}
 
 	orgs, err := getGithubUserOwnedOrgs(context.Background(), client)
 	if err != nil {
-		log.Fatal("Error getting user organizations", err)
+		return fmt.Errorf("Error getting user organizations: %v", err)
 	}
 	for _, o := range orgs {
 		orgRepos, err := getGithubOrgRepositories(context.Background(), client, o)
 		if err != nil {
-			log.Fatal("Error getting org repos", err)
+			return fmt.Errorf("Error getting org repos: %v", err)
 		}
 		if len(orgRepos) == 0 {
 			log.Printf("No repos found in %s", *o.Login)
@@ -61,11 +67,11 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 		log.Printf("Creating a org migration (%s) for %d repos", *o.Login, len(orgRepos))
 		oMigration, err := createGithubOrgMigration(context.Background(), client, *o.Login, orgRepos)
 		if err != nil {
-			log.Fatalf("Error creating migration: %v", err)
+			return fmt.Errorf("Error creating migration: %v", err)
 		}
 		if c.githubWaitForMigrationComplete {
 			migrationStatePollingDuration := 60 * time.Second
-			downloadGithubOrgMigrationData(
+			err = downloadGithubOrgMigrationData(
 				context.Background(),
 				client,
 				*o.Login,
@@ -73,7 +79,10 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 				oMigration.ID,
 				migrationStatePollingDuration,
 			)
+			if err != nil {
+				return fmt.Errorf("Error querying/downloading org migration (%s): %v", *o.Login, err)
+			}
 		}
 	}
-
+	return nil
 }
@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/google/go-github/v34/github"
 )
 
-func handleGithubListUserMigrations(client interface{}, c *appConfig) {
+func handleGithubListUserMigrations(client interface{}, c *appConfig) (err error) {
+	startTime := time.Now()
+	defer func() {
+		sendNotifications(c, newNotification("user migration list", c, startTime, err))
+	}()
 
 	mList, err := getGithubUserMigrations(client)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	for _, m := range mList {
@@ -32,4 +36,5 @@ func handleGithubListUserMigrations(client interface{}, c *appConfig) {
 		}
 		fmt.Printf("%v - %v - %v - %v\n", *mData.ID, *mData.CreatedAt, *mData.State, archiveURL)
 	}
+	return nil
 }
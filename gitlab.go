@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"strconv"
 	"strings"
 
 	gitlab "github.com/xanzy/go-gitlab"
@@ -9,13 +10,14 @@ import (
 
 func getGitlabRepositories(
 	client interface{},
+	c *appConfig,
 	service string, githubRepoType string, githubNamespaceWhitelist []string,
 	gitlabProjectVisibility string, gitlabProjectMembershipType string,
 	ignoreFork bool,
 ) ([]*Repository, error) {
 
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return nil, fmt.Errorf("Couldn't acquire a client to talk to %s", service)
 	}
 
 	var repositories []*Repository
@@ -54,6 +56,11 @@ func getGitlabRepositories(
 		gitlabListOptions.Visibility = &visibility
 	}
 
+	// The statistics are only needed by the size filters
+	if c.filter.minSize > 0 || c.filter.maxSize > 0 {
+		gitlabListOptions.Statistics = &boolTrue
+	}
+
 	for {
 		repos, resp, err := client.(*gitlab.Client).Projects.ListProjects(&gitlabListOptions)
 		if err != nil {
@@ -66,14 +73,25 @@ func getGitlabRepositories(
 			} else {
 				cloneURL = repo.SSHURLToRepo
 			}
-			repositories = append(repositories, &Repository{
-				//PushedAt:  repo.PushedAt,
-				//UpdatedAt: repo.UpdatedAt,
-				CloneURL:  cloneURL,
-				Name:      repo.Name,
-				Namespace: namespace,
-				Private:   repo.Visibility == "private",
-			})
+			r := &Repository{
+				// GitLab does not report the last push, the last activity
+				// includes it
+				PushedAt:   repo.LastActivityAt,
+				UpdatedAt:  repo.LastActivityAt,
+				ID:         strconv.Itoa(repo.ID),
+				CloneURL:   cloneURL,
+				Name:       repo.Name,
+				Namespace:  namespace,
+				Private:    repo.Visibility == "private",
+				Fork:       repo.ForkedFromProject != nil,
+				Visibility: string(repo.Visibility),
+				Archived:   repo.Archived,
+				Topics:     gitlabTopics(repo),
+			}
+			if repo.Statistics != nil {
+				r.Size = repo.Statistics.RepositorySize
+			}
+			repositories = append(repositories, r)
 		}
 		if resp.NextPage == 0 {
 			break
@@ -82,3 +100,12 @@ func getGitlabRepositories(
 	}
 	return repositories, nil
 }
+
+// gitlabTopics returns the topics of a project, which older GitLab
+// versions call tags
+func gitlabTopics(repo *gitlab.Project) []string {
+	if len(repo.Topics) > 0 {
+		return repo.Topics
+	}
+	return repo.TagList
+}
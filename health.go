@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	healthCheckNone         = "none"
+	healthCheckConnectivity = "connectivity"
+	healthCheckFull         = "full"
+)
+
+// quarantineDirName is where the backups failing the health check are
+// moved to, under the backup directory
+const quarantineDirName = "_quarantine"
+
+func validHealthCheck(check string) bool {
+	switch check {
+	case healthCheckNone, healthCheckConnectivity, healthCheckFull:
+		return true
+	}
+	return false
+}
+
+func healthCheckEnabled(check string) bool {
+	return check == healthCheckConnectivity || check == healthCheckFull
+}
+
+// healthReport is the outcome of the health check of a backup
+type healthReport struct {
+	Check    string   `json:"check"`
+	Healthy  bool     `json:"healthy"`
+	Problems []string `json:"problems,omitempty"`
+	// Quarantined is where the backup was moved to before cloning the
+	// repository again
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+// checkBackupHealth runs git fsck on a backup after it was cloned or
+// updated, or failed to be updated. With -health.quarantine, a backup
+// failing the check is moved to the _quarantine directory and the
+// repository is cloned again, otherwise the backup fails. It returns true
+// when the repository was cloned again.
+func checkBackupHealth(backupDir string, repo *Repository, repoDir string, bare bool, rr *repoReport, now time.Time) (bool, []byte, error) {
+	health := &healthReport{Check: appCfg.healthCheck}
+	defer rr.setHealth(health)
+
+	health.Problems = fsckRepository(repoDir, appCfg.healthCheck)
+	if len(health.Problems) == 0 {
+		health.Healthy = true
+		return false, nil, nil
+	}
+	log.Printf("%s/%s failed the health check: %s\n", repo.Namespace, repo.Name, strings.Join(health.Problems, "; "))
+	if !appCfg.healthQuarantine {
+		return false, nil, fmt.Errorf("git fsck found %d problem(s) in %s", len(health.Problems), repoDir)
+	}
+
+	quarantineDir := path.Join(backupDir, quarantineDirName, repo.Namespace, path.Base(repoDir)+"-"+now.UTC().Format(preservedRefsTimeFormat))
+	if _, err := moveRepoDir(repoDir, quarantineDir); err != nil {
+		return false, nil, fmt.Errorf("failed to quarantine %s -> %v", repoDir, err)
+	}
+	removeMirrorWorktree(&appCfg, repoDir)
+	health.Quarantined = quarantineDir
+	log.Printf("Moved %s to %s, cloning %s/%s again\n", repoDir, quarantineDir, repo.Namespace, repo.Name)
+
+	out, err := cloneRepository(backupDir, repo, repoDir, bare)
+	if err != nil {
+		return true, out, err
+	}
+	if problems := fsckRepository(repoDir, appCfg.healthCheck); len(problems) > 0 {
+		return true, out, fmt.Errorf("the new clone of %s/%s failed the health check too: %s", repo.Namespace, repo.Name, strings.Join(problems, "; "))
+	}
+	health.Healthy = true
+	return true, out, nil
+}
+
+// fsckRepository runs git fsck on a repository, only checking that the
+// reachable objects are there unless the check is full, and returns the
+// problems it reported, such as missing objects and broken refs
+func fsckRepository(repoDir, check string) []string {
+	args := []string{"-C", repoDir, "fsck", "--no-progress", "--no-dangling"}
+	if check == healthCheckConnectivity {
+		args = append(args, "--connectivity-only")
+	}
+	debugLogf("Running git %s", strings.Join(args, " "))
+	out, err := execCommand(gitCommand, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var problems []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "notice:") {
+			problems = append(problems, line)
+		}
+	}
+	if len(problems) == 0 {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
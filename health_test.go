@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// setupHealthTests mirrors a new remote into a backup directory, with
+// the given health check
+func setupHealthTests(t *testing.T, check string) (*Repository, string, string) {
+	remote := newTestRemote(t)
+	backupDir := t.TempDir()
+	saved := appCfg
+	appCfg = appConfig{healthCheck: check}
+	appFS = afero.NewOsFs()
+	currentReport = newRunReport(&appConfig{service: "github", backupDir: backupDir})
+	t.Cleanup(func() {
+		appCfg = saved
+		currentReport = nil
+	})
+
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: remote}
+	repoDir, _ := getRepoDir(backupDir, repo, true)
+	runTestGit(t, "clone", "-q", "--mirror", remote, repoDir)
+	return repo, backupDir, repoDir
+}
+
+// corruptTestRepo removes the tag object of v1, leaving its ref broken
+func corruptTestRepo(t *testing.T, repoDir string) {
+	t.Helper()
+	tag := gitOutput(t, "-C", repoDir, "rev-parse", "refs/tags/v1")
+	if err := os.Remove(filepath.Join(repoDir, "objects", tag[:2], tag[2:])); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFsckRepository(t *testing.T) {
+	_, _, repoDir := setupHealthTests(t, healthCheckFull)
+	for _, check := range []string{healthCheckConnectivity, healthCheckFull} {
+		if problems := fsckRepository(repoDir, check); problems != nil {
+			t.Errorf("%s: expected a fresh mirror to be healthy, got %v", check, problems)
+		}
+	}
+	corruptTestRepo(t, repoDir)
+	for _, check := range []string{healthCheckConnectivity, healthCheckFull} {
+		if problems := fsckRepository(repoDir, check); len(problems) == 0 {
+			t.Errorf("%s: expected the missing tag object to be reported", check)
+		}
+	}
+}
+
+func TestBackupHealthCheck(t *testing.T) {
+	var wg sync.WaitGroup
+	repo, backupDir, _ := setupHealthTests(t, healthCheckConnectivity)
+	wg.Add(1)
+	if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	rr := currentReport.Repositories[0]
+	if rr.Health == nil || !rr.Health.Healthy || rr.Health.Check != healthCheckConnectivity {
+		t.Errorf("Expected a healthy backup, got %+v", rr.Health)
+	}
+}
+
+func TestBackupHealthCheckFailedUpdate(t *testing.T) {
+	var wg sync.WaitGroup
+	repo, backupDir, repoDir := setupHealthTests(t, healthCheckConnectivity)
+	corruptTestRepo(t, repoDir)
+	runTestGit(t, "-C", repo.CloneURL, "commit", "-q", "--allow-empty", "-m", "second")
+
+	wg.Add(1)
+	if _, err := backUp(backupDir, repo, true, &wg); err == nil {
+		t.Fatalf("Expected the update of the corrupt backup to fail")
+	}
+	if rr := currentReport.Repositories[0]; rr.Health == nil || rr.Health.Healthy {
+		t.Errorf("Expected the corrupt backup to fail the health check, got %+v", rr.Health)
+	}
+
+	appCfg.healthQuarantine = true
+	wg.Add(1)
+	if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatalf("Expected the backup to be cloned again, got %v: %s", err, out)
+	}
+	if rr := currentReport.Repositories[1]; rr.Health == nil || !rr.Health.Healthy || rr.Health.Quarantined == "" {
+		t.Errorf("Expected the backup to be quarantined and cloned again, got %+v", rr.Health)
+	}
+}
+
+func TestCheckBackupHealthQuarantine(t *testing.T) {
+	repo, backupDir, repoDir := setupHealthTests(t, healthCheckConnectivity)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	corruptTestRepo(t, repoDir)
+
+	rr := currentReport.startRepo(repo)
+	if _, _, err := checkBackupHealth(backupDir, repo, repoDir, true, rr, now); err == nil || !strings.Contains(err.Error(), "git fsck") {
+		t.Fatalf("Expected the corrupt backup to fail, got %v", err)
+	}
+	if rr.Health.Healthy || len(rr.Health.Problems) == 0 || rr.Health.Quarantined != "" {
+		t.Errorf("Expected the problems to be reported, got %+v", rr.Health)
+	}
+
+	appCfg.healthQuarantine = true
+	if cloned, out, err := checkBackupHealth(backupDir, repo, repoDir, true, rr, now); err != nil || !cloned {
+		t.Fatalf("Expected the backup to be cloned again, got %t, %v: %s", cloned, err, out)
+	}
+	quarantineDir := filepath.Join(backupDir, quarantineDirName, "ns", "r1.git-20240101T000000Z")
+	if !rr.Health.Healthy || rr.Health.Quarantined != quarantineDir {
+		t.Errorf("Expected the backup to be quarantined and cloned again, got %+v", rr.Health)
+	}
+	if _, err := os.Stat(filepath.Join(quarantineDir, "HEAD")); err != nil {
+		t.Errorf("Expected the corrupt backup in %s: %v", quarantineDir, err)
+	}
+	if problems := fsckRepository(repoDir, healthCheckFull); problems != nil {
+		t.Errorf("Expected the new clone to be healthy, got %v", problems)
+	}
+}
@@ -5,44 +5,45 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/google/go-github/v34/github"
 	"github.com/ktrysmt/go-bitbucket"
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
-func getUsername(client interface{}, service string) string {
+func getUsername(client interface{}, service string) (string, error) {
 
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return "", fmt.Errorf("Couldn't acquire a client to talk to %s", service)
 	}
 
 	if service == "github" {
 		ctx := context.Background()
 		user, _, err := client.(*github.Client).Users.Get(ctx, "")
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("Error retrieving username: %v", err)
 		}
-		return *user.Login
+		return *user.Login, nil
 	}
 
 	if service == "gitlab" {
 		user, _, err := client.(*gitlab.Client).Users.CurrentUser()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("Error retrieving username: %v", err)
 		}
-		return user.Username
+		return user.Username, nil
 	}
 
 	if service == "bitbucket" {
 		user, err := client.(*bitbucket.Client).User.Profile()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("Error retrieving username: %v", err)
 		}
-		return user.Username
+		return user.Username, nil
 	}
 
-	return ""
+	return "", nil
 }
 
 func validGitlabProjectMembership(membership string) bool {
@@ -104,3 +105,33 @@ func writeFileContents(filePath string, content string) error {
 	}
 	return nil
 }
+
+// writeFileAtomic writes data to a temporary file next to filePath and
+// renames it into place, so readers never see a partially written file
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0751); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
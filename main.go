@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime/debug"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 // MaxConcurrentClones is the upper limit of the maximum number of
 // concurrent git clones
 //const MaxConcurrentClones = 20
@@ -24,7 +28,36 @@ var knownServices = map[string]string{
 	"bitbucket": "bitbucket.org",
 }
 
+// Commands which are run instead of a backup, e.g. `gitbackup daemon`
+var commands = map[string]func(args []string) error{
+	"daemon":  handleDaemon,
+	"convert": handleConvert,
+	"restore": handleRestore,
+	"verify":  handleVerify,
+}
+
+// getVersion returns the version of gitbackup, or of its module when it
+// was built without one, e.g. with go install
+func getVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	c, err := initConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
@@ -34,17 +67,29 @@ func main() {
 		log.Fatal(err)
 	}
 
-	client := newClient(c.service, c.gitHostURL)
+	if c.metricsListenAddr != "" {
+		serveMetrics(c.metricsListenAddr, appMetrics)
+	}
+
 	var executionErr error
 
 	// TODO implement validation of options so that we don't
 	// allow multiple operations at one go
-	if c.githubListUserMigrations {
-		handleGithubListUserMigrations(client, c)
-	} else if c.githubCreateUserMigration {
-		handleGithubCreateUserMigration(client, c)
+	if c.githubListUserMigrations || c.webhookListenAddr != "" || c.githubCreateUserMigration {
+		client, err := newClient(c.service, c.gitHostURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.githubListUserMigrations {
+			executionErr = handleGithubListUserMigrations(client, c)
+		} else if c.webhookListenAddr != "" {
+			executionErr = handleWebhookReceiver(client, c)
+		} else {
+			executionErr = handleGithubCreateUserMigration(client, c)
+		}
 	} else {
-		executionErr = handleGitRepositoryClone(client, c)
+		// The backup run creates its client itself, to report the failures
+		executionErr = handleGitRepositoryClone(c)
 	}
 	if executionErr != nil {
 		log.Fatalln(fmt.Sprintf("execution error -> %v", executionErr.Error()))
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	manifestPrefix          = "MANIFEST-"
+	manifestSignatureSuffix = ".asc"
+)
+
+// runManifest is written along with the archives of each backup run,
+// listing the files of every archive with their SHA-256, so that
+// `gitbackup verify` can tell whether they are still intact
+type runManifest struct {
+	Tool         string               `json:"tool"`
+	Version      string               `json:"version"`
+	Service      string               `json:"service"`
+	GitHost      string               `json:"git_host"`
+	Hostname     string               `json:"hostname"`
+	StartedAt    time.Time            `json:"started_at"`
+	FinishedAt   time.Time            `json:"finished_at"`
+	Repositories []manifestRepository `json:"repositories"`
+}
+
+// manifestRepository lists the archive files written for a repository
+type manifestRepository struct {
+	Namespace       string          `json:"namespace"`
+	Name            string          `json:"name"`
+	RefsFingerprint string          `json:"refs_fingerprint,omitempty"`
+	Archives        []archiveReport `json:"archives"`
+}
+
+// hashArchives records the SHA-256 of the archive files, before they are
+// uploaded and possibly deleted
+func hashArchives(archives []archiveReport) error {
+	for i := range archives {
+		sum, err := hashFile(archives[i].Path)
+		if err != nil {
+			return err
+		}
+		archives[i].SHA256 = sum
+	}
+	return nil
+}
+
+// hashFile returns the hex encoded SHA-256 of a file
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// hashReader returns the hex encoded SHA-256 of what is read from r
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readManifestSignKey returns the OpenPGP private key of -manifest.sign-key
+func readManifestSignKey(keyFile string) (*openpgp.Entity, error) {
+	keys, err := readPGPKeyRing(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.PrivateKey != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no OpenPGP private key in %s", keyFile)
+}
+
+// writeRunManifest writes the manifest of the archives of a run,
+// MANIFEST-<git host>-<time>.json, into the archive directory of the git
+// host, signed with -manifest.sign-key if any, and uploads it along with
+// its signature. It returns the path of the manifest, or an empty string
+// when nothing was archived.
+func writeRunManifest(c *appConfig, r *runReport) (string, error) {
+	r.mu.Lock()
+	manifest := runManifest{
+		Tool:       "gitbackup",
+		Version:    getVersion(),
+		Service:    r.Service,
+		GitHost:    r.GitHost,
+		Hostname:   r.Hostname,
+		StartedAt:  r.StartedAt,
+		FinishedAt: r.FinishedAt,
+	}
+	for _, rr := range r.Repositories {
+		if len(rr.Archives) > 0 {
+			manifest.Repositories = append(manifest.Repositories, manifestRepository{
+				Namespace:       rr.Namespace,
+				Name:            rr.Name,
+				RefsFingerprint: rr.RefsFingerprint,
+				Archives:        rr.Archives,
+			})
+		}
+	}
+	r.mu.Unlock()
+	if len(manifest.Repositories) == 0 {
+		return "", nil
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	manifestPath := filepath.Join(archiveHostDir(c), manifestPrefix+r.GitHost+"-"+r.StartedAt.Format(archiveTimeLayout)+".json")
+	if err := writeFileAtomic(manifestPath, data, 0640); err != nil {
+		return "", err
+	}
+	files := []archiveReport{{Path: manifestPath, Size: int64(len(data))}}
+	if c.manifestSignKey != nil {
+		var signature bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&signature, c.manifestSignKey, bytes.NewReader(data), nil); err != nil {
+			return "", fmt.Errorf("failed to sign %s -> %v", manifestPath, err)
+		}
+		if err := writeFileAtomic(manifestPath+manifestSignatureSuffix, signature.Bytes(), 0640); err != nil {
+			return "", err
+		}
+		files = append(files, archiveReport{Path: manifestPath + manifestSignatureSuffix, Size: int64(signature.Len())})
+	}
+	if err := uploadArchives(files); err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.Manifest = manifestPath
+	r.mu.Unlock()
+	return manifestPath, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// apiCalls counts the HTTP requests made to the git hosting service API
+var apiCalls int64
+
+// appMetrics are the metrics of the backup runs made by this process
+var appMetrics = newMetricsRegistry()
+
+// apiCallCounter is a http.RoundTripper counting the requests it sends
+type apiCallCounter struct {
+	transport http.RoundTripper
+}
+
+func (c *apiCallCounter) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&apiCalls, 1)
+	transport := c.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(r)
+}
+
+// Buckets (in seconds) of the repository backup duration histogram
+var backupDurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// Metrics which are carried over from a previous textfile, so that a failed
+// run does not reset the time of the last successful one
+var persistentMetrics = []string{
+	"gitbackup_last_success_timestamp",
+	"gitbackup_repo_last_success_timestamp",
+}
+
+// metricsRegistry holds the Prometheus metrics derived from the run reports
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	order    []string
+}
+
+type metricFamily struct {
+	help       string
+	metricType string
+	samples    map[string]float64
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{families: map[string]*metricFamily{}}
+	m.register("gitbackup_last_run_timestamp", "gauge", "Unix time at which the last backup run finished")
+	m.register("gitbackup_last_run_success", "gauge", "Whether the last backup run completed without failures (1) or not (0)")
+	m.register("gitbackup_last_run_duration_seconds", "gauge", "Duration of the last backup run")
+	m.register("gitbackup_last_success_timestamp", "gauge", "Unix time at which the last backup run without failures finished")
+	m.register("gitbackup_repos_total", "gauge", "Number of repositories in the last backup run by status")
+	m.register("gitbackup_repo_last_success_timestamp", "gauge", "Unix time of the last successful backup of a repository")
+	m.register("gitbackup_repo_backup_duration_seconds", "histogram", "Duration of cloning or updating a repository, including archiving")
+	m.register("gitbackup_archive_bytes", "gauge", "Size of the archives written in the last backup run")
+	m.register("gitbackup_api_calls", "gauge", "Number of git hosting service API calls made in the last backup run")
+	return m
+}
+
+func (m *metricsRegistry) register(name, metricType, help string) {
+	m.families[name] = &metricFamily{
+		help:       help,
+		metricType: metricType,
+		samples:    map[string]float64{},
+		histograms: map[string]*histogram{},
+	}
+	m.order = append(m.order, name)
+}
+
+// observeRun updates the metrics from a finished run report
+func (m *metricsRegistry) observeRun(r *runReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	target := formatLabels("service", r.Service, "host", r.GitHost)
+	m.families["gitbackup_last_run_timestamp"].samples[target] = unixSeconds(r.FinishedAt.UnixNano())
+	m.families["gitbackup_last_run_duration_seconds"].samples[target] = r.DurationSeconds
+	m.families["gitbackup_api_calls"].samples[target] = float64(r.APICalls)
+	if r.Success {
+		m.families["gitbackup_last_run_success"].samples[target] = 1
+		m.families["gitbackup_last_success_timestamp"].samples[target] = unixSeconds(r.FinishedAt.UnixNano())
+	} else {
+		m.families["gitbackup_last_run_success"].samples[target] = 0
+	}
+
+	statuses := map[string]float64{
+		repoActionCloned:    0,
+		repoActionUpdated:   0,
+		repoActionSkipped:   0,
+		repoActionFailed:    0,
+		repoActionUnchanged: 0,
+		repoActionOrphaned:  0,
+	}
+	var archiveBytes int64
+	durations := m.families["gitbackup_repo_backup_duration_seconds"].histograms
+	if durations[target] == nil {
+		durations[target] = &histogram{counts: make([]uint64, len(backupDurationBuckets))}
+	}
+	for _, rr := range r.Repositories {
+		statuses[rr.Action]++
+		for _, a := range rr.Archives {
+			archiveBytes += a.Size
+		}
+		if rr.Action == repoActionSkipped || rr.Action == repoActionOrphaned {
+			continue
+		}
+		durations[target].observe(rr.DurationSeconds)
+		if rr.Action != repoActionFailed {
+			repo := formatLabels("service", r.Service, "host", r.GitHost, "namespace", rr.Namespace, "name", rr.Name)
+			m.families["gitbackup_repo_last_success_timestamp"].samples[repo] = unixSeconds(rr.StartedAt.UnixNano())
+		}
+	}
+	for status, count := range statuses {
+		labels := formatLabels("service", r.Service, "host", r.GitHost, "status", status)
+		m.families["gitbackup_repos_total"].samples[labels] = count
+	}
+	m.families["gitbackup_archive_bytes"].samples[target] = float64(archiveBytes)
+}
+
+func (h *histogram) observe(v float64) {
+	for i, upper := range backupDurationBuckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// render writes the metrics in the Prometheus text exposition format
+func (m *metricsRegistry) render(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, name := range m.order {
+		f := m.families[name]
+		if len(f.samples) == 0 && len(f.histograms) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.metricType)
+		for _, labels := range sortedKeys(f.samples) {
+			fmt.Fprintf(bw, "%s{%s} %s\n", name, labels, formatValue(f.samples[labels]))
+		}
+		labelSets := make([]string, 0, len(f.histograms))
+		for labels := range f.histograms {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			h := f.histograms[labels]
+			for i, upper := range backupDurationBuckets {
+				fmt.Fprintf(bw, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatValue(upper), h.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+			fmt.Fprintf(bw, "%s_sum{%s} %s\n", name, labels, formatValue(h.sum))
+			fmt.Fprintf(bw, "%s_count{%s} %d\n", name, labels, h.count)
+		}
+	}
+	return bw.Flush()
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := m.render(w); err != nil {
+		log.Printf("failed to render metrics -> %v", err)
+	}
+}
+
+// loadTextfile carries over the persistent metrics from a textfile
+// written by a previous run
+func (m *metricsRegistry) loadTextfile(textfilePath string) error {
+	data, err := os.ReadFile(textfilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, name := range persistentMetrics {
+			if !strings.HasPrefix(line, name+"{") {
+				continue
+			}
+			end := strings.LastIndex(line, "} ")
+			if end == -1 {
+				continue
+			}
+			value, err := strconv.ParseFloat(line[end+2:], 64)
+			if err != nil {
+				continue
+			}
+			m.families[name].samples[line[len(name)+1:end]] = value
+		}
+	}
+	return scanner.Err()
+}
+
+// writeTextfile writes the metrics for the node_exporter textfile collector
+func (m *metricsRegistry) writeTextfile(textfilePath string) error {
+	var buf bytes.Buffer
+	if err := m.render(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(textfilePath, buf.Bytes(), 0644)
+}
+
+// serveMetrics starts serving the metrics on /metrics in the background
+func serveMetrics(addr string, m *metricsRegistry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server stopped -> %v", err)
+		}
+	}()
+}
+
+// labelValueEscaper escapes label values as the Prometheus text format
+// does, which has no other escape sequences
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label name/value pairs as name="value",...
+func formatLabels(nameValues ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, nameValues[i], labelValueEscaper.Replace(nameValues[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func unixSeconds(nanos int64) float64 {
+	return float64(nanos) / 1e9
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRunReport(failed bool) *runReport {
+	r := newRunReport(&appConfig{service: "github", backupDir: "/backups/github.com"})
+	r.startRepo(&Repository{Namespace: "ns", Name: "r1"}).finish(repoActionCloned, nil, nil)
+	rr := r.startRepo(&Repository{Namespace: "ns", Name: "r2"})
+	rr.Archives = append(rr.Archives, archiveReport{Path: "/archives/ns-r2.7z.001", Size: 1024})
+	if failed {
+		rr.finish(repoActionUpdated, errors.New("exit status 1"), nil)
+	} else {
+		rr.finish(repoActionUpdated, nil, nil)
+	}
+	r.finish(nil)
+	return r
+}
+
+func TestMetricsObserveRun(t *testing.T) {
+	m := newMetricsRegistry()
+	m.observeRun(newTestRunReport(false))
+
+	var buf bytes.Buffer
+	if err := m.render(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	expectedLines := []string{
+		"# TYPE gitbackup_last_success_timestamp gauge",
+		`gitbackup_last_run_success{service="github",host="github.com"} 1`,
+		`gitbackup_repos_total{service="github",host="github.com",status="cloned"} 1`,
+		`gitbackup_repos_total{service="github",host="github.com",status="updated"} 1`,
+		`gitbackup_repos_total{service="github",host="github.com",status="failed"} 0`,
+		`gitbackup_archive_bytes{service="github",host="github.com"} 1024`,
+		`gitbackup_repo_backup_duration_seconds_count{service="github",host="github.com"} 2`,
+		`gitbackup_repo_last_success_timestamp{service="github",host="github.com",namespace="ns",name="r2"}`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(got, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, got)
+		}
+	}
+}
+
+func TestMetricsTextfileKeepsLastSuccess(t *testing.T) {
+	textfilePath := filepath.Join(t.TempDir(), "gitbackup.prom")
+
+	m := newMetricsRegistry()
+	m.observeRun(newTestRunReport(false))
+	if err := m.writeTextfile(textfilePath); err != nil {
+		t.Fatal(err)
+	}
+	previous, _ := os.ReadFile(textfilePath)
+
+	// A new process with a failing run
+	time.Sleep(10 * time.Millisecond)
+	m = newMetricsRegistry()
+	if err := m.loadTextfile(textfilePath); err != nil {
+		t.Fatal(err)
+	}
+	m.observeRun(newTestRunReport(true))
+	if err := m.writeTextfile(textfilePath); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := os.ReadFile(textfilePath)
+
+	for _, prefix := range []string{
+		"gitbackup_last_success_timestamp{",
+		`gitbackup_repo_last_success_timestamp{service="github",host="github.com",namespace="ns",name="r2"}`,
+	} {
+		before := findMetricLine(string(previous), prefix)
+		after := findMetricLine(string(current), prefix)
+		if before == "" || before != after {
+			t.Errorf("Expected %s to be carried over, before: %q after: %q", prefix, before, after)
+		}
+	}
+	if !strings.Contains(string(current), `gitbackup_last_run_success{service="github",host="github.com"} 0`) {
+		t.Errorf("Expected the last run to be reported as failed, got:\n%s", current)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := newMetricsRegistry()
+	m.observeRun(newTestRunReport(false))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "gitbackup_last_run_timestamp") {
+		t.Errorf("Expected metrics to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func findMetricLine(metrics, prefix string) string {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels("namespace", "ns", "name", "caf\u00e9 \"x\"\\y\nz\t")
+	expected := `namespace="ns",name="caf` + "\u00e9" + ` \"x\"\\y\nz` + "\t" + `"`
+	if got != expected {
+		t.Errorf("Expected only backslashes, double quotes and newlines to be escaped, %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultNotificationTemplate = `gitbackup {{.Operation}} for {{.Service}} ({{.GitHost}}) on {{.Hostname}} {{if .Success}}succeeded{{else}}FAILED{{end}}
+Started: {{.StartedAt.Format "2006-01-02 15:04:05 MST"}}, took {{.Duration}}
+{{- if .Error}}
+Error: {{.Error}}
+{{- end}}
+{{- if .Counts}}
+Repositories:{{$sep := " "}}{{range $action, $count := .Counts}}{{$sep}}{{$count}} {{$action}}{{$sep = ", "}}{{end}}
+{{- end}}
+{{- range .Failed}}
+- {{.Namespace}}/{{.Name}}: {{.Error}}
+{{- end}}
+`
+
+var notificationHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// notification is the summary of an operation sent to the notification
+// channels. It is also the data available to the notification template.
+type notification struct {
+	Operation  string
+	Service    string
+	GitHost    string
+	Hostname   string
+	Success    bool
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Duration   time.Duration
+	Counts     map[string]int
+	Failed     []*repoReport
+}
+
+// notifier is a channel notifications can be sent to
+type notifier interface {
+	name() string
+	onFailureOnly() bool
+	send(n *notification, summary string) error
+}
+
+func newNotificationFromReport(operation string, r *runReport) *notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := &notification{
+		Operation:  operation,
+		Service:    r.Service,
+		GitHost:    r.GitHost,
+		Hostname:   r.Hostname,
+		Success:    r.Success,
+		Error:      r.Error,
+		StartedAt:  r.StartedAt,
+		FinishedAt: r.FinishedAt,
+		Duration:   r.FinishedAt.Sub(r.StartedAt).Round(time.Second),
+		Counts:     map[string]int{},
+	}
+	for _, rr := range r.Repositories {
+		n.Counts[rr.Action]++
+		if rr.Action == repoActionFailed {
+			n.Failed = append(n.Failed, rr)
+		}
+	}
+	return n
+}
+
+func newNotification(operation string, c *appConfig, startTime time.Time, err error) *notification {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	n := &notification{
+		Operation:  operation,
+		Service:    c.service,
+		GitHost:    filepath.Base(c.backupDir),
+		Hostname:   hostname,
+		Success:    err == nil,
+		StartedAt:  startTime,
+		FinishedAt: now,
+		Duration:   now.Sub(startTime).Round(time.Second),
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+	return n
+}
+
+// getNotifiers returns the notification channels configured
+func getNotifiers(c *appConfig) []notifier {
+	var notifiers []notifier
+	for _, u := range c.notifyWebhookURLs {
+		notifiers = append(notifiers, &webhookNotifier{url: u, failureOnly: c.notifyWebhookOnFailure})
+	}
+	if c.notifySMTPHost != "" {
+		notifiers = append(notifiers, &smtpNotifier{
+			host:        c.notifySMTPHost,
+			port:        c.notifySMTPPort,
+			from:        c.notifySMTPFrom,
+			to:          c.notifySMTPTo,
+			username:    c.notifySMTPUsername,
+			password:    os.Getenv("GITBACKUP_SMTP_PASSWORD"),
+			failureOnly: c.notifySMTPOnFailure,
+		})
+	}
+	if c.notifyPingURL != "" {
+		notifiers = append(notifiers, &pingNotifier{url: c.notifyPingURL, failureOnly: c.notifyPingOnFailure})
+	}
+	return notifiers
+}
+
+// sendNotifications sends the notification to all the configured channels.
+// Failing to notify is logged, but does not fail the operation.
+func sendNotifications(c *appConfig, n *notification) {
+	notifiers := getNotifiers(c)
+	if len(notifiers) == 0 {
+		return
+	}
+	summary, err := renderNotification(c.notifyTemplate, n)
+	if err != nil {
+		log.Printf("failed to render notification -> %v", err)
+		return
+	}
+	for _, nt := range notifiers {
+		if n.Success && nt.onFailureOnly() {
+			debugLogf("Not notifying %s of a successful %s", nt.name(), n.Operation)
+			continue
+		}
+		if err := nt.send(n, summary); err != nil {
+			log.Printf("failed to send %s notification -> %v", nt.name(), err)
+		} else {
+			debugLogf("Sent %s notification", nt.name())
+		}
+	}
+}
+
+func renderNotification(templatePath string, n *notification) (string, error) {
+	text := defaultNotificationTemplate
+	if templatePath != "" {
+		content, err := getFileContents(templatePath)
+		if err != nil {
+			return "", err
+		}
+		text = content
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// webhookNotifier posts the summary as {"text": "..."}, which Slack, Teams
+// and Mattermost incoming webhooks all accept
+type webhookNotifier struct {
+	url         string
+	failureOnly bool
+}
+
+func (w *webhookNotifier) name() string        { return "webhook" }
+func (w *webhookNotifier) onFailureOnly() bool { return w.failureOnly }
+
+func (w *webhookNotifier) send(n *notification, summary string) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"text":    summary,
+		"success": n.Success,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := notificationHTTPClient.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// pingNotifier pings a healthchecks.io style URL, appending /fail on failure
+type pingNotifier struct {
+	url         string
+	failureOnly bool
+}
+
+func (p *pingNotifier) name() string        { return "ping" }
+func (p *pingNotifier) onFailureOnly() bool { return p.failureOnly }
+
+func (p *pingNotifier) send(n *notification, summary string) error {
+	pingURL := p.url
+	if !n.Success {
+		pingURL = strings.TrimSuffix(pingURL, "/") + "/fail"
+	}
+	resp, err := notificationHTTPClient.Post(pingURL, "text/plain", strings.NewReader(summary))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("ping returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails the summary, using its first line as the subject
+type smtpNotifier struct {
+	host        string
+	port        int
+	from        string
+	to          []string
+	username    string
+	password    string
+	failureOnly bool
+}
+
+func (s *smtpNotifier) name() string        { return "smtp" }
+func (s *smtpNotifier) onFailureOnly() bool { return s.failureOnly }
+
+func (s *smtpNotifier) send(n *notification, summary string) error {
+	if len(s.to) == 0 {
+		return fmt.Errorf("no recipients specified")
+	}
+	subject := strings.SplitN(summary, "\n", 2)[0]
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(summary, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
+	return smtp.SendMail(addr, auth, s.from, s.to, msg.Bytes())
+}
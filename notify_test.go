@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTPServer is a minimal SMTP stand-in recording the messages it receives
+type fakeSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	wg       sync.WaitGroup
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: l}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func TestSendNotifications(t *testing.T) {
+	var webhookPayloads []map[string]interface{}
+	var pingPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ping") {
+			pingPaths = append(pingPaths, r.URL.Path)
+			return
+		}
+		payload := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		webhookPayloads = append(webhookPayloads, payload)
+	}))
+	defer server.Close()
+
+	smtpServer := newFakeSMTPServer(t)
+	defer smtpServer.close()
+	smtpHost, smtpPort, _ := net.SplitHostPort(smtpServer.listener.Addr().String())
+	port, _ := strconv.Atoi(smtpPort)
+
+	c := &appConfig{
+		service:                "github",
+		backupDir:              "/backups/github.com",
+		notifyWebhookURLs:      []string{server.URL + "/hook"},
+		notifySMTPHost:         smtpHost,
+		notifySMTPPort:         port,
+		notifySMTPFrom:         "gitbackup@example.com",
+		notifySMTPTo:           []string{"ops@example.com"},
+		notifySMTPOnFailure:    true,
+		notifyPingURL:          server.URL + "/ping/abc",
+		notifyPingOnFailure:    false,
+		notifyWebhookOnFailure: false,
+	}
+
+	// A successful run is not emailed, as SMTP is configured for failures only
+	r := newTestRunReport(false)
+	sendNotifications(c, newNotificationFromReport("backup", r))
+	if len(webhookPayloads) != 1 || len(pingPaths) != 1 || len(smtpServer.messages) != 0 {
+		t.Fatalf("Expected 1 webhook, 1 ping and no email, got %d, %d and %d", len(webhookPayloads), len(pingPaths), len(smtpServer.messages))
+	}
+	if pingPaths[0] != "/ping/abc" {
+		t.Errorf("Expected a success ping, got %s", pingPaths[0])
+	}
+
+	r = newTestRunReport(true)
+	sendNotifications(c, newNotificationFromReport("backup", r))
+	if len(webhookPayloads) != 2 || len(pingPaths) != 2 || len(smtpServer.messages) != 1 {
+		t.Fatalf("Expected 2 webhooks, 2 pings and 1 email, got %d, %d and %d", len(webhookPayloads), len(pingPaths), len(smtpServer.messages))
+	}
+	if pingPaths[1] != "/ping/abc/fail" {
+		t.Errorf("Expected a failure ping, got %s", pingPaths[1])
+	}
+	text, _ := webhookPayloads[1]["text"].(string)
+	if !strings.Contains(text, "FAILED") || !strings.Contains(text, "ns/r2: exit status 1") {
+		t.Errorf("Expected the failure summary to list the failed repository, got %q", text)
+	}
+	if !strings.Contains(smtpServer.messages[0], "Subject: gitbackup backup for github (github.com)") {
+		t.Errorf("Expected the summary as email subject, got %q", smtpServer.messages[0])
+	}
+}
+
+func TestRenderNotificationTemplate(t *testing.T) {
+	n := newNotification("user migration", &appConfig{service: "github", backupDir: "/backups/github.com"}, newTestRunReport(false).StartedAt, errors.New("migration failed"))
+	summary, err := renderNotification("", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(summary, "gitbackup user migration for github (github.com)") || !strings.Contains(summary, "Error: migration failed") {
+		t.Errorf("Unexpected summary: %q", summary)
+	}
+	if strings.Contains(summary, "Repositories:") {
+		t.Errorf("Did not expect repository counts without a run report: %q", summary)
+	}
+
+	// Every action is counted, including those of the other commands
+	n.Counts = map[string]int{repoActionCloned: 1, repoActionUnchanged: 2, repoActionOrphaned: 1, repoActionRestored: 3}
+	if summary, _ = renderNotification("", n); !strings.Contains(summary, "Repositories: 1 cloned, 1 orphaned, 3 restored, 2 unchanged\n") {
+		t.Errorf("Expected the counts of every action, got %q", summary)
+	}
+}
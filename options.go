@@ -3,7 +3,9 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"strings"
+	"time"
 )
 
 var appCfg appConfig
@@ -12,6 +14,18 @@ func initConfig(args []string) (*appConfig, error) {
 
 	var githubNamespaceWhitelistString string
 	var shallowCloneReposString string
+	var notifyWebhookURLsString string
+	var notifySMTPToString string
+	var cloneStrategies stringsFlag
+	var filterInclude, filterExclude stringsFlag
+	var filterVisibilityString, filterTopicsString, filterExcludeTopicsString, filterLanguagesString string
+	var filterMinSizeString, filterMaxSizeString string
+	var archiveVolumeSizeString string
+	var archiveAgeRecipients, archivePGPKeys stringsFlag
+	var archiveAgeRecipientsFile string
+	var storageS3PartSizeString string
+	var retentionKeepWithinString string
+	var manifestSignKeyFile string
 
 	fs := flag.NewFlagSet("gitbackup", flag.ExitOnError)
 
@@ -21,28 +35,103 @@ func initConfig(args []string) (*appConfig, error) {
 	fs.StringVar(&appCfg.backupDir, "backupdir", "", "Backup directory")
 	fs.StringVar(&appCfg.archiveDir, "archive-dir", "", "Backup Archive directory")
 	fs.StringVar(&appCfg.cacheDir, "cache-dir", "", "Cache directory")
+	fs.StringVar(&appCfg.stateDBPath, "state-db", "", "Path of the database keeping the state of every repository (default <cache-dir>/state.db)")
 	fs.StringVar(&appCfg.archiveEncryptionPassword, "archive-encryption-password", "", "Archive Encryption Password")
+	fs.StringVar(&appCfg.archiveFormat, "archive.format", archiveFormat7z, "Format of the archives (7z, tar.zst, tar.gz, zip, bundle), 7z being written by /usr/bin/7z, tar.zst being the default with -archive.age-recipient or -archive.pgp-key")
+	fs.IntVar(&appCfg.archiveLevel, "archive.level", -1, "Compression level of the archives (1-22 for tar.zst, 0-9 for the other formats, -1 for the default of the format, 9 for 7z)")
+	fs.StringVar(&archiveVolumeSizeString, "archive.volume-size", "", "Split the archives into volumes of this size, 0 for none (default 1500m for 7z, none for the other formats)")
+	fs.Var(&archiveAgeRecipients, "archive.age-recipient", "Encrypt the archives for this age recipient (age1...), only its identity decrypts them (repeatable)")
+	fs.StringVar(&archiveAgeRecipientsFile, "archive.age-recipients-file", "", "Encrypt the archives for the age recipients in this file, one per line")
+	fs.Var(&archivePGPKeys, "archive.pgp-key", "Encrypt the archives for the OpenPGP public key(s) in this file, only their private keys decrypt them (repeatable)")
+	fs.IntVar(&appCfg.archiveThreads, "archive.threads", 0, "Number of threads compressing an archive (0 for the default of the format)")
+	fs.BoolVar(&appCfg.archiveSkipUnchanged, "archive.skip-unchanged", false, "Only archive a repository when its refs changed since its last archive")
+	fs.IntVar(&appCfg.archiveFullBundleDays, "archive.full-bundle-days", 7, "Write a full bundle once the last one is this many days old, incremental bundles until then (0 for full bundles only)")
+	fs.StringVar(&manifestSignKeyFile, "manifest.sign-key", "", "Sign the manifest of the archives of each run with the OpenPGP private key in this file, its passphrase in GITBACKUP_PGP_PASSPHRASE")
+	fs.IntVar(&appCfg.archiveForceAfterDays, "archive.force-after-days", 0, "Archive an unchanged repository anyway when its last archive is this many days old (0 never)")
 	fs.BoolVar(&appCfg.ignorePrivate, "ignore-private", false, "Ignore private repositories/projects")
 	fs.BoolVar(&appCfg.ignoreFork, "ignore-fork", false, "Ignore repositories which are forks")
+	fs.StringVar(&appCfg.changedSince, "changed-since", "", "Only back up repositories pushed to after this date and time (2006-01-02 15:04:05)")
+	fs.BoolVar(&appCfg.skipUnchanged, "skip-unchanged", true, "Skip repositories which were not pushed to since their last successful backup, as recorded in the state database")
+	fs.BoolVar(&appCfg.checkRefs, "check-refs", false, "Compare the refs of the remote (git ls-remote) with the local ones before updating a repository, and skip it when nothing changed")
+	fs.BoolVar(&appCfg.preserveRefs, "preserve-refs", false, "Keep the commits of deleted and force pushed refs under refs/gitbackup/deleted/<time>/ when updating a repository")
+	fs.IntVar(&appCfg.preserveRefsKeepDays, "preserve-refs.keep-days", 0, "Delete the preserved refs after this many days (0 keeps them forever)")
+	fs.StringVar(&appCfg.healthCheck, "health.check", healthCheckNone, "Run git fsck on each repository after backing it up (none, connectivity for --connectivity-only, full)")
+	fs.BoolVar(&appCfg.healthQuarantine, "health.quarantine", false, "Move the repositories failing -health.check to the _quarantine directory and clone them again")
+	fs.BoolVar(&appCfg.orphansMove, "orphans.move", false, "Move the backups of the repositories no longer listed upstream to the _orphaned directory")
+	fs.StringVar(&appCfg.orphansPolicy, "orphans.policy", orphanPolicyKeep, "What to do with the orphaned backups after -orphans.after-days (keep, archive, delete)")
+	fs.IntVar(&appCfg.orphansAfterDays, "orphans.after-days", 30, "Number of days after which -orphans.policy is applied to an orphaned backup")
 	fs.BoolVar(&appCfg.debug, "debug", false, "Enable verbose debug logging")
 	fs.BoolVar(&appCfg.useHTTPSClone, "use-https-clone", false, "Use HTTPS for cloning instead of SSH")
 	fs.BoolVar(&appCfg.bare, "bare", false, "Clone bare repositories")
+	fs.BoolVar(&appCfg.mirrorWorktree, "mirror-worktree", false, "Keep a mirror of each repository along with a worktree of its default branch (implies -bare)")
+	fs.BoolVar(&appCfg.submodules, "submodules", false, "Also back up the submodules referenced by any branch or tag of the backed up repositories")
+	fs.StringVar(&appCfg.reportPath, "report", "", "Write a JSON report of the backup run to this path")
+	fs.StringVar(&appCfg.metricsTextfile, "metrics.textfile", "", "Write Prometheus metrics to this path for the node_exporter textfile collector")
+	fs.StringVar(&appCfg.metricsListenAddr, "metrics.listen", "", "Serve Prometheus metrics on /metrics at this address (e.g. :9190)")
 	fs.StringVar(&shallowCloneReposString, "shallow.repos", "", "Comma separated full repo names (namespace/name) to shallow clone (latest commit per branch)")
+	fs.Var(&cloneStrategies, "clone.strategy", "Clone strategy of the repositories matching a pattern, as <pattern>=<strategy> (repeatable, the first match wins). The pattern is a glob on namespace/name or a regular expression prefixed with re:, the strategy full, shallow[:<depth>], since:<YYYY-MM-DD>, blobless or blob:limit=<size>")
+
+	// Filter flags
+	fs.Var(&filterInclude, "filter.include", "Only back up the repositories matching this pattern, a glob on namespace/name or a regular expression prefixed with re: (repeatable)")
+	fs.Var(&filterExclude, "filter.exclude", "Do not back up the repositories matching this pattern, a glob on namespace/name or a regular expression prefixed with re: (repeatable)")
+	fs.StringVar(&appCfg.filter.archived, "filter.archived", filterStatusInclude, "Whether to back up archived repositories (include, exclude, only)")
+	fs.StringVar(&appCfg.filter.disabled, "filter.disabled", filterStatusInclude, "Whether to back up disabled repositories (include, exclude, only)")
+	fs.StringVar(&filterVisibilityString, "filter.visibility", "", "Comma separated visibilities of the repositories to back up (public, private, internal)")
+	fs.StringVar(&filterTopicsString, "filter.topics", "", "Comma separated topics, only back up the repositories with one of them")
+	fs.StringVar(&filterExcludeTopicsString, "filter.exclude-topics", "", "Comma separated topics, do not back up the repositories with one of them")
+	fs.StringVar(&filterLanguagesString, "filter.languages", "", "Comma separated primary languages of the repositories to back up")
+	fs.StringVar(&filterMinSizeString, "filter.min-size", "", "Do not back up the repositories smaller than this size (e.g. 500k, 10m, 2g)")
+	fs.StringVar(&filterMaxSizeString, "filter.max-size", "", "Do not back up the repositories larger than this size (e.g. 500k, 10m, 2g)")
+
+	// Storage flags
+	fs.StringVar(&appCfg.storageBackend, "storage.backend", "", "Upload the archives to this storage (s3, sftp, webdav)")
+	fs.BoolVar(&appCfg.storageDeleteLocal, "storage.delete-local", false, "Delete the local archives once uploaded and verified")
+	fs.StringVar(&appCfg.storageS3.endpoint, "storage.s3.endpoint", "s3.amazonaws.com", "S3 endpoint (host[:port]), credentials via AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&appCfg.storageS3.bucket, "storage.s3.bucket", "", "S3 bucket to upload the archives to")
+	fs.StringVar(&appCfg.storageS3.prefix, "storage.s3.prefix", "", "Prefix of the uploaded archives in the bucket")
+	fs.StringVar(&appCfg.storageS3.region, "storage.s3.region", "", "Region of the bucket (looked up when empty)")
+	fs.BoolVar(&appCfg.storageS3.insecure, "storage.s3.insecure", false, "Connect to the S3 endpoint over plain HTTP")
+	fs.StringVar(&appCfg.storageS3.sse, "storage.s3.sse", "", "Server side encryption of the uploaded archives (AES256, aws:kms)")
+	fs.StringVar(&appCfg.storageS3.sseKMSKeyID, "storage.s3.sse-kms-key-id", "", "KMS key of the aws:kms server side encryption (default key of the bucket when empty)")
+	fs.StringVar(&storageS3PartSizeString, "storage.s3.part-size", "64m", "Upload the archives larger than this in parts of this size (at least 5m)")
+
+	fs.StringVar(&appCfg.storageSFTP.host, "storage.sftp.host", "", "SFTP server (host[:port]) to upload the archives to")
+	fs.StringVar(&appCfg.storageSFTP.user, "storage.sftp.user", "", "SFTP user")
+	fs.StringVar(&appCfg.storageSFTP.dir, "storage.sftp.dir", "", "Directory of the SFTP server to upload the archives to")
+	fs.StringVar(&appCfg.storageSFTP.keyFile, "storage.sftp.key", "", "Private key authenticating the SFTP user (passphrase via GITBACKUP_SFTP_KEY_PASSPHRASE)")
+	fs.StringVar(&appCfg.storageSFTP.knownHosts, "storage.sftp.known-hosts", "", "known_hosts file verifying the key of the SFTP server (default ~/.ssh/known_hosts)")
+	fs.StringVar(&appCfg.storageWebDAV.url, "storage.webdav.url", "", "URL of the WebDAV directory to upload the archives to")
+	fs.StringVar(&appCfg.storageWebDAV.user, "storage.webdav.user", "", "WebDAV user (password via GITBACKUP_WEBDAV_PASSWORD)")
+	fs.IntVar(&appCfg.retention.keepLast, "retention.keep-last", 0, "Keep the last N archives of each repository")
+	fs.IntVar(&appCfg.retention.keepDaily, "retention.keep-daily", 0, "Keep the last archive of each of the last N days with archives")
+	fs.IntVar(&appCfg.retention.keepWeekly, "retention.keep-weekly", 0, "Keep the last archive of each of the last N weeks with archives")
+	fs.IntVar(&appCfg.retention.keepMonthly, "retention.keep-monthly", 0, "Keep the last archive of each of the last N months with archives")
+	fs.StringVar(&retentionKeepWithinString, "retention.keep-within", "", "Keep the archives written within this duration of the newest one (e.g. 30d, 2w, 1y6m)")
+	fs.BoolVar(&appCfg.retention.dryRun, "retention.dry-run", false, "Only log the archives the retention rules would prune")
+
+	// Webhook receiver flags
+	fs.StringVar(&appCfg.webhookListenAddr, "webhook.listen", "", "Listen for push webhooks at this address (e.g. :8081) and back up the pushed repositories (secret via GITBACKUP_WEBHOOK_SECRET)")
+	fs.DurationVar(&appCfg.webhookDebounce, "webhook.debounce", 30*time.Second, "Wait this long after a push for more pushes to the same repository before backing it up")
+
+	// Notification flags
+	fs.StringVar(&notifyWebhookURLsString, "notify.webhook", "", "Comma separated webhook URLs (Slack/Teams/Mattermost compatible) to post the run summary to")
+	fs.BoolVar(&appCfg.notifyWebhookOnFailure, "notify.webhook.on-failure", false, "Only post to the webhooks when the run fails")
+	fs.StringVar(&appCfg.notifySMTPHost, "notify.smtp.host", "", "SMTP server to email the run summary with (password via GITBACKUP_SMTP_PASSWORD)")
+	fs.IntVar(&appCfg.notifySMTPPort, "notify.smtp.port", 587, "SMTP server port")
+	fs.StringVar(&appCfg.notifySMTPFrom, "notify.smtp.from", "", "Sender address of the summary email")
+	fs.StringVar(&notifySMTPToString, "notify.smtp.to", "", "Comma separated recipient addresses of the summary email")
+	fs.StringVar(&appCfg.notifySMTPUsername, "notify.smtp.username", "", "SMTP username")
+	fs.BoolVar(&appCfg.notifySMTPOnFailure, "notify.smtp.on-failure", false, "Only email the summary when the run fails")
+	fs.StringVar(&appCfg.notifyPingURL, "notify.ping", "", "Healthchecks style URL to ping after the run (/fail is appended on failure)")
+	fs.BoolVar(&appCfg.notifyPingOnFailure, "notify.ping.on-failure", false, "Only ping when the run fails")
+	fs.StringVar(&appCfg.notifyTemplate, "notify.template", "", "Path to a Go text/template file for the notification summary")
 
 	// GitHub specific flags
 	fs.StringVar(&appCfg.githubRepoType, "github.repoType", "all", "Repo types to backup (all, owner, member, starred)")
 
-	fs.StringVar(&appCfg.githubStartFromLastPushAt,
-		"github.startFromLastPushAt",
-		"",
-		"Start backing up the repo which has a Push Equal or Higher than specified",
-	)
-
-	fs.BoolVar(&appCfg.githubSaveLastBackupDateAndContinueFrom,
-		"github.saveLastBackupDateAndContinueFrom",
-		true,
-		"Backup only from the last clone datetime when a full successful backup of all repositories was complete, it can be used with github.startFromLastPushAt and it will be ignored after",
-	)
+	// Deprecated aliases of -changed-since and -skip-unchanged
+	fs.StringVar(&appCfg.changedSince, "github.startFromLastPushAt", "", "Deprecated: use -changed-since")
+	fs.BoolVar(&appCfg.skipUnchanged, "github.saveLastBackupDateAndContinueFrom", true, "Deprecated: use -skip-unchanged")
 
 	fs.StringVar(
 		&githubNamespaceWhitelistString, "github.namespaceWhitelist",
@@ -94,6 +183,9 @@ func initConfig(args []string) (*appConfig, error) {
 		return nil, err
 	}
 
+	if appCfg.mirrorWorktree {
+		appCfg.bare = true
+	}
 	useHTTPSClone = &appCfg.useHTTPSClone
 	ignorePrivate = &appCfg.ignorePrivate
 
@@ -101,9 +193,74 @@ func initConfig(args []string) (*appConfig, error) {
 	if len(appCfg.githubNamespaceWhitelist) > 0 {
 		appCfg.githubNamespaceWhitelist = strings.Split(githubNamespaceWhitelistString, ",")
 	}
+	if len(notifyWebhookURLsString) > 0 {
+		appCfg.notifyWebhookURLs = strings.Split(notifyWebhookURLsString, ",")
+	}
+	if len(notifySMTPToString) > 0 {
+		appCfg.notifySMTPTo = strings.Split(notifySMTPToString, ",")
+	}
 	if len(shallowCloneReposString) > 0 {
 		appCfg.shallowCloneRepos = strings.Split(shallowCloneReposString, ",")
 	}
+	appCfg.cloneStrategyRules, err = parseCloneStrategyRules(cloneStrategies)
+	if err != nil {
+		return nil, err
+	}
+	appCfg.filter.include, err = parseRepoPatterns(filterInclude)
+	if err != nil {
+		return nil, err
+	}
+	appCfg.filter.exclude, err = parseRepoPatterns(filterExclude)
+	if err != nil {
+		return nil, err
+	}
+	appCfg.filter.visibility = splitList(filterVisibilityString)
+	appCfg.filter.topics = splitList(filterTopicsString)
+	appCfg.filter.excludeTopics = splitList(filterExcludeTopicsString)
+	appCfg.filter.noTopics = servicesWithoutTopics[appCfg.service]
+	appCfg.filter.languages = splitList(filterLanguagesString)
+	appCfg.archiveEncryption, err = newArchiveEncryption(archiveAgeRecipients, archiveAgeRecipientsFile, archivePGPKeys)
+	if err != nil {
+		return nil, err
+	}
+	// 7z archives can't be encrypted for public keys
+	if appCfg.archiveEncryption.enabled() && !isFlagSet(fs, "archive.format") {
+		appCfg.archiveFormat = archiveFormatTarZst
+	}
+	if manifestSignKeyFile != "" {
+		if appCfg.manifestSignKey, err = readManifestSignKey(manifestSignKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if appCfg.storageS3.partSize, err = parseSize(storageS3PartSizeString); err != nil {
+		return nil, err
+	}
+	appCfg.archiveStorage, err = newArchiveStorage(&appCfg)
+	if err != nil {
+		return nil, err
+	}
+	if archiveVolumeSizeString != "" {
+		if appCfg.archiveVolumeSize, err = parseSize(archiveVolumeSizeString); err != nil {
+			return nil, err
+		}
+	} else if appCfg.archiveFormat == archiveFormat7z {
+		appCfg.archiveVolumeSize = default7zVolumeSize
+	}
+	if retentionKeepWithinString != "" {
+		if appCfg.retention.keepWithin, err = parseRetentionDuration(retentionKeepWithinString); err != nil {
+			return nil, err
+		}
+	}
+	if filterMinSizeString != "" {
+		if appCfg.filter.minSize, err = parseSize(filterMinSizeString); err != nil {
+			return nil, err
+		}
+	}
+	if filterMaxSizeString != "" {
+		if appCfg.filter.maxSize, err = parseSize(filterMaxSizeString); err != nil {
+			return nil, err
+		}
+	}
 	appCfg.backupDir = setupBackupDir(&appCfg.backupDir, &appCfg.service, &appCfg.gitHostURL)
 	return &appCfg, nil
 }
@@ -116,5 +273,91 @@ func validateConfig(c *appConfig) error {
 	if !validGitlabProjectMembership(c.gitlabProjectMembershipType) {
 		return errors.New("Please specify a valid gitlab project membership - all/owner/member")
 	}
+
+	if !validFilterStatus(c.filter.archived) || !validFilterStatus(c.filter.disabled) {
+		return errors.New("Please specify a valid archived/disabled filter - include/exclude/only")
+	}
+
+	if !validArchiveFormat(c.archiveFormat) {
+		return errors.New("Please specify a valid archive format - tar.zst/tar.gz/zip/7z/bundle")
+	}
+
+	if !validArchiveLevel(c.archiveFormat, c.archiveLevel) {
+		return fmt.Errorf("Please specify a valid compression level for %s archives", c.archiveFormat)
+	}
+
+	if c.archiveEncryptionPassword != "" && c.archiveFormat != archiveFormat7z {
+		return errors.New("The archives can only be encrypted with a password in the 7z format")
+	}
+
+	if c.archiveEncryption.enabled() && (c.archiveFormat == archiveFormat7z || c.archiveEncryptionPassword != "") {
+		return errors.New("The archives encrypted for age recipients or OpenPGP keys can't be 7z archives nor have a password")
+	}
+
+	if !validStorageBackend(c.storageBackend) {
+		return errors.New("Please specify a valid storage backend - s3/sftp/webdav")
+	}
+
+	if c.storageBackend == storageBackendS3 && c.storageS3.partSize < 5*1024*1024 {
+		return errors.New("The S3 part size must be at least 5m")
+	}
+
+	if c.archiveFullBundleDays < 0 {
+		return errors.New("Please specify a positive number of days after which a full bundle is written")
+	}
+
+	if c.archiveForceAfterDays < 0 {
+		return errors.New("Please specify a positive number of days after which the archives are forced")
+	}
+
+	if c.retention.keepLast < 0 || c.retention.keepDaily < 0 || c.retention.keepWeekly < 0 || c.retention.keepMonthly < 0 {
+		return errors.New("Please specify a positive number of archives to keep")
+	}
+
+	if c.storageBackend != "" && c.archiveDir == "" {
+		return errors.New("The archives are uploaded from -archive-dir, please specify it")
+	}
+
+	if !validHealthCheck(c.healthCheck) {
+		return errors.New("Please specify a valid health check - none/connectivity/full")
+	}
+
+	if !validOrphanPolicy(c.orphansPolicy) {
+		return errors.New("Please specify a valid orphans policy - keep/archive/delete")
+	}
+	return nil
+}
+
+// isFlagSet returns true when the flag was given on the command line
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitList splits a comma separated list, dropping the empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stringsFlag is a flag which can be given several times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
 	return nil
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What to do with the backup of a repository gone upstream, once it has
+// been orphaned for -orphans.after-days
+const (
+	orphanPolicyKeep    = "keep"
+	orphanPolicyArchive = "archive"
+	orphanPolicyDelete  = "delete"
+)
+
+// orphanedDirName is where the backups of the repositories gone upstream
+// are moved to, under the backup directory
+const orphanedDirName = "_orphaned"
+
+func validOrphanPolicy(policy string) bool {
+	switch policy {
+	case orphanPolicyKeep, orphanPolicyArchive, orphanPolicyDelete:
+		return true
+	}
+	return false
+}
+
+// listingScope identifies the options which decide which repositories are
+// listed upstream. A repository is only orphaned by a run with the options
+// of the last run which listed it, so that changing them, or backing up
+// the same git host with other options, does not orphan the repositories
+// they leave out.
+func listingScope(c *appConfig) string {
+	whitelist := append([]string{}, c.githubNamespaceWhitelist...)
+	sort.Strings(whitelist)
+	return fmt.Sprintf("type=%s namespaces=%s visibility=%s membership=%s ignore-fork=%t",
+		c.githubRepoType, strings.Join(whitelist, ","), c.gitlabProjectVisibility, c.gitlabProjectMembershipType, c.ignoreFork)
+}
+
+// reconcileRepositories matches the repositories listed upstream with the
+// ones backed up before, by provider ID. The backup of a renamed repository
+// is moved to its new location, and with -orphans.move the backups of the
+// repositories gone upstream are moved to _orphaned.
+func reconcileRepositories(c *appConfig, repositories []*Repository) error {
+	if currentState == nil {
+		return nil
+	}
+	scope := listingScope(c)
+	if err := currentState.updateRepos(repositories, func(rs *repoState) { rs.ListedScope = scope }); err != nil {
+		return err
+	}
+	states, err := currentState.listRepos()
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	listedDirs := map[string]*Repository{}
+	for _, repo := range repositories {
+		listed[string(stateKey(repo))] = true
+		rs, err := currentState.getRepo(repo)
+		if err != nil {
+			return err
+		}
+		repoDir, _ := getRepoDir(c.backupDir, repo, c.bare)
+		listedDirs[repoDir] = repo
+		// Leave the backups made with the other layout alone
+		if rs == nil || rs.Path == "" || rs.Path == repoDir || strings.HasSuffix(rs.Path, ".git") != c.bare {
+			continue
+		}
+		moved, err := moveRepoDir(rs.Path, repoDir)
+		if err != nil {
+			log.Printf("Could not move %s to %s: %v\n", rs.Path, repoDir, err)
+			continue
+		}
+		if !moved {
+			continue
+		}
+		removeMirrorWorktree(c, rs.Path)
+		if rs.OrphanedAt != nil {
+			log.Printf("%s/%s is back upstream, restored %s to %s\n", repo.Namespace, repo.Name, rs.Path, repoDir)
+		} else {
+			log.Printf("%s/%s was renamed, moved %s to %s\n", repo.Namespace, repo.Name, rs.Path, repoDir)
+		}
+		err = currentState.updateRepo(repo, func(rs *repoState) {
+			rs.Path = repoDir
+			rs.OrphanedAt = nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, rs := range states {
+		repo := rs.repository()
+		// Submodules are only discovered while backing up
+		if listed[string(stateKey(repo))] || rs.Superproject != "" {
+			continue
+		}
+		// The backup of a listed repository under another key, e.g. backed
+		// up on push before it was listed with its ID
+		if owner, ok := listedDirs[rs.Path]; ok {
+			if err := mergeRepoState(owner, rs); err != nil {
+				return err
+			}
+			continue
+		}
+		if rs.ListedScope != scope {
+			debugLogf("Not orphaning %s/%s, last listed with other options (%s)", rs.Namespace, rs.Name, rs.ListedScope)
+			continue
+		}
+		if rs.OrphanedAt == nil {
+			if !c.orphansMove {
+				continue
+			}
+			if err := orphanRepository(c, rs, now); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rr := currentReport.startRepo(repo)
+		err := expireOrphan(c, rs, rr, now)
+		rr.finish(repoActionOrphaned, err, nil)
+		if err != nil {
+			log.Printf("Could not %s the orphaned %s: %v\n", c.orphansPolicy, rs.Path, err)
+		}
+	}
+	return nil
+}
+
+// mergeRepoState merges the state of a backup recorded under another key
+// into the state of the listed repository it belongs to, keeping the most
+// recent of the two
+func mergeRepoState(repo *Repository, other *repoState) error {
+	debugLogf("Merging the state of %s/%s (%s) into %s/%s", other.Namespace, other.Name, stateKey(other.repository()), repo.Namespace, repo.Name)
+	err := currentState.updateRepo(repo, func(rs *repoState) {
+		if rs.LastAttemptAt.Before(other.LastAttemptAt) {
+			scope := rs.ListedScope
+			*rs = *other
+			rs.ListedScope = scope
+		}
+		rs.OrphanedAt = nil
+	})
+	if err != nil {
+		return err
+	}
+	return currentState.deleteRepo(other.repository())
+}
+
+// orphanRepository moves the backup of a repository gone upstream to the
+// _orphaned directory
+func orphanRepository(c *appConfig, rs *repoState, now time.Time) error {
+	repo := rs.repository()
+	orphanDir := path.Join(c.backupDir, orphanedDirName, rs.Namespace, path.Base(rs.Path))
+	if _, err := appFS.Stat(orphanDir); err == nil {
+		orphanDir += "-" + now.UTC().Format(preservedRefsTimeFormat)
+	}
+	moved, err := moveRepoDir(rs.Path, orphanDir)
+	if err != nil {
+		log.Printf("Could not move %s to %s: %v\n", rs.Path, orphanDir, err)
+		return nil
+	}
+	if !moved {
+		// Nothing left to keep track of
+		debugLogf("Forgetting %s/%s, gone upstream and from %s", rs.Namespace, rs.Name, rs.Path)
+		return currentState.deleteRepo(repo)
+	}
+	removeMirrorWorktree(c, rs.Path)
+	log.Printf("%s/%s is gone upstream, moved %s to %s\n", rs.Namespace, rs.Name, rs.Path, orphanDir)
+	currentReport.startRepo(repo).finish(repoActionOrphaned, nil, nil)
+	return currentState.updateRepo(repo, func(rs *repoState) {
+		rs.Path = orphanDir
+		rs.OrphanedAt = &now
+	})
+}
+
+// expireOrphan applies the orphan policy to a backup orphaned for longer
+// than -orphans.after-days
+func expireOrphan(c *appConfig, rs *repoState, rr *repoReport, now time.Time) error {
+	if c.orphansPolicy == orphanPolicyKeep || now.Sub(*rs.OrphanedAt) < time.Duration(c.orphansAfterDays)*24*time.Hour {
+		return nil
+	}
+	if c.orphansPolicy == orphanPolicyArchive {
+		if c.archiveDir == "" {
+			return fmt.Errorf("no archive directory")
+		}
+		archiveFiles, out, err := archiveRepository(rs.repository(), path.Base(rs.Path), rs.Path)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		rr.addArchives(archiveFiles)
+		if refs, err := getLocalRefs(rs.Path); err == nil && len(archiveFiles) > 0 {
+			rr.setRefsFingerprint(refsFingerprint(refs))
+		}
+	}
+	if err := appFS.RemoveAll(rs.Path); err != nil {
+		return err
+	}
+	log.Printf("Removed %s, orphaned since %s\n", rs.Path, rs.OrphanedAt.Format(time.RFC3339))
+	return currentState.deleteRepo(rs.repository())
+}
+
+// moveRepoDir moves a backup to a new location. It returns false when
+// there was nothing to move.
+func moveRepoDir(from, to string) (bool, error) {
+	if _, err := appFS.Stat(from); err != nil {
+		return false, nil
+	}
+	if _, err := appFS.Stat(to); err == nil {
+		return false, fmt.Errorf("%s already exists", to)
+	}
+	if err := appFS.MkdirAll(path.Dir(to), 0771); err != nil {
+		return false, err
+	}
+	return true, appFS.Rename(from, to)
+}
+
+// removeMirrorWorktree removes the worktree of a mirror which was moved,
+// it is checked out again next to the mirror on its next update
+func removeMirrorWorktree(c *appConfig, mirrorDir string) {
+	if !c.mirrorWorktree {
+		return
+	}
+	worktreeDir := getMirrorWorktreeDir(mirrorDir)
+	if fi, err := appFS.Stat(path.Join(worktreeDir, ".git")); err != nil || fi.IsDir() {
+		return
+	}
+	if err := appFS.RemoveAll(worktreeDir); err != nil {
+		log.Printf("Could not remove the worktree %s: %v\n", worktreeDir, err)
+	}
+}
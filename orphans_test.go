@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func setupOrphanTests(t *testing.T) *appConfig {
+	appFS = afero.NewMemMapFs()
+	currentState = newTestStateStore(t)
+	c := &appConfig{service: "github", backupDir: "/backups/github.com", bare: true, orphansMove: true, orphansPolicy: orphanPolicyKeep, orphansAfterDays: 30}
+	currentReport = newRunReport(c)
+	t.Cleanup(func() {
+		currentState = nil
+		currentReport = nil
+	})
+	return c
+}
+
+func TestReconcileRenamedRepository(t *testing.T) {
+	c := setupOrphanTests(t)
+	appFS.MkdirAll("/backups/github.com/ns/old.git", 0771)
+	currentState.updateRepo(&Repository{ID: "1", Namespace: "ns", Name: "old"}, func(rs *repoState) { rs.Path = "/backups/github.com/ns/old.git" })
+
+	renamed := &Repository{ID: "1", Namespace: "org", Name: "new"}
+	if err := reconcileRepositories(c, []*Repository{renamed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/org/new.git"); err != nil {
+		t.Errorf("Expected the backup to be moved to its new name")
+	}
+	if _, err := appFS.Stat("/backups/github.com/ns/old.git"); err == nil {
+		t.Errorf("Expected the backup to be gone from its old name")
+	}
+	rs, _ := currentState.getRepo(renamed)
+	if rs.Path != "/backups/github.com/org/new.git" || rs.Name != "new" {
+		t.Errorf("Expected the state to follow the rename, got %+v", rs)
+	}
+	if len(currentReport.Repositories) != 0 {
+		t.Errorf("Expected no orphans, got %+v", currentReport.Repositories)
+	}
+}
+
+func TestReconcileOrphanedRepository(t *testing.T) {
+	c := setupOrphanTests(t)
+	appFS.MkdirAll("/backups/github.com/ns/gone.git", 0771)
+	gone := &Repository{ID: "2", Namespace: "ns", Name: "gone"}
+	// Both were listed by a previous run with the same options
+	currentState.updateRepo(gone, func(rs *repoState) {
+		rs.Path = "/backups/github.com/ns/gone.git"
+		rs.ListedScope = listingScope(c)
+	})
+	// Nothing left on disk, it is just forgotten
+	vanished := &Repository{ID: "3", Namespace: "ns", Name: "vanished"}
+	currentState.updateRepo(vanished, func(rs *repoState) {
+		rs.Path = "/backups/github.com/ns/vanished.git"
+		rs.ListedScope = listingScope(c)
+	})
+
+	if err := reconcileRepositories(c, []*Repository{{ID: "1", Namespace: "ns", Name: "r1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/_orphaned/ns/gone.git"); err != nil {
+		t.Errorf("Expected the backup to be moved to _orphaned")
+	}
+	rs, _ := currentState.getRepo(gone)
+	if rs == nil || rs.OrphanedAt == nil || rs.Path != "/backups/github.com/_orphaned/ns/gone.git" {
+		t.Errorf("Expected the repository to be recorded as orphaned, got %+v", rs)
+	}
+	if rs, _ := currentState.getRepo(vanished); rs != nil {
+		t.Errorf("Expected the vanished repository to be forgotten, got %+v", rs)
+	}
+	if len(currentReport.Repositories) != 1 || currentReport.Repositories[0].Action != repoActionOrphaned {
+		t.Errorf("Expected the orphan in the report, got %+v", currentReport.Repositories)
+	}
+
+	// The policy applies after the configured days
+	c.orphansPolicy = orphanPolicyDelete
+	if err := reconcileRepositories(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/_orphaned/ns/gone.git"); err != nil {
+		t.Errorf("Expected a recent orphan to be kept")
+	}
+	orphanedAt := time.Now().Add(-31 * 24 * time.Hour)
+	currentState.updateRepo(gone, func(rs *repoState) { rs.OrphanedAt = &orphanedAt })
+	if err := reconcileRepositories(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/_orphaned/ns/gone.git"); err == nil {
+		t.Errorf("Expected an old orphan to be deleted")
+	}
+	if rs, _ := currentState.getRepo(gone); rs != nil {
+		t.Errorf("Expected the deleted orphan to be forgotten, got %+v", rs)
+	}
+}
+
+func TestReconcileRestoresOrphan(t *testing.T) {
+	c := setupOrphanTests(t)
+	appFS.MkdirAll("/backups/github.com/_orphaned/ns/r1.git", 0771)
+	orphanedAt := time.Now()
+	repo := &Repository{ID: "1", Namespace: "ns", Name: "r1"}
+	currentState.updateRepo(repo, func(rs *repoState) {
+		rs.Path = "/backups/github.com/_orphaned/ns/r1.git"
+		rs.OrphanedAt = &orphanedAt
+	})
+
+	if err := reconcileRepositories(c, []*Repository{repo}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/ns/r1.git"); err != nil {
+		t.Errorf("Expected the backup to be restored")
+	}
+	if rs, _ := currentState.getRepo(repo); rs.OrphanedAt != nil {
+		t.Errorf("Expected the repository to be no longer orphaned")
+	}
+}
+
+func TestReconcileOtherListingOptions(t *testing.T) {
+	c := setupOrphanTests(t)
+	c.githubNamespaceWhitelist = []string{"ns", "other"}
+	appFS.MkdirAll("/backups/github.com/other/r2.git", 0771)
+	excluded := &Repository{ID: "2", Namespace: "other", Name: "r2"}
+	if err := reconcileRepositories(c, []*Repository{{ID: "1", Namespace: "ns", Name: "r1"}, excluded}); err != nil {
+		t.Fatal(err)
+	}
+	currentState.updateRepo(excluded, func(rs *repoState) { rs.Path = "/backups/github.com/other/r2.git" })
+
+	// The namespace is no longer whitelisted, or another target backs up
+	// the same git host
+	c.githubNamespaceWhitelist = []string{"ns"}
+	if err := reconcileRepositories(c, []*Repository{{ID: "1", Namespace: "ns", Name: "r1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/other/r2.git"); err != nil {
+		t.Errorf("Expected a repository left out by the options to be kept in place")
+	}
+	if rs, _ := currentState.getRepo(excluded); rs == nil || rs.OrphanedAt != nil {
+		t.Errorf("Expected a repository left out by the options not to be orphaned, got %+v", rs)
+	}
+
+	// Gone upstream with the options it was listed with
+	c.githubNamespaceWhitelist = []string{"other", "ns"}
+	if err := reconcileRepositories(c, []*Repository{{ID: "1", Namespace: "ns", Name: "r1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/_orphaned/other/r2.git"); err != nil {
+		t.Errorf("Expected the repository gone upstream to be orphaned")
+	}
+}
+
+func TestReconcileMergesStateOfPush(t *testing.T) {
+	c := setupOrphanTests(t)
+	appFS.MkdirAll("/backups/github.com/ns/r1.git", 0771)
+	// Backed up on push, before it was listed with its ID
+	pushed := &Repository{Namespace: "ns", Name: "r1"}
+	backedUpAt := time.Now()
+	currentState.updateRepo(pushed, func(rs *repoState) {
+		rs.Path = "/backups/github.com/ns/r1.git"
+		rs.LastAttemptAt = backedUpAt
+		rs.LastBackupAt = backedUpAt
+		rs.ListedScope = listingScope(c)
+	})
+
+	listed := &Repository{ID: "1", Namespace: "ns", Name: "r1"}
+	if err := reconcileRepositories(c, []*Repository{listed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appFS.Stat("/backups/github.com/ns/r1.git"); err != nil {
+		t.Errorf("Expected the backup to stay in place")
+	}
+	if rs, _ := currentState.getRepo(pushed); rs != nil {
+		t.Errorf("Expected the state of the push to be merged, got %+v", rs)
+	}
+	rs, _ := currentState.getRepo(listed)
+	if rs == nil || !rs.LastBackupAt.Equal(backedUpAt) || rs.Path != "/backups/github.com/ns/r1.git" || rs.OrphanedAt != nil {
+		t.Errorf("Expected the state of the push under the ID, got %+v", rs)
+	}
+	if len(currentReport.Repositories) != 0 {
+		t.Errorf("Expected no orphans, got %+v", currentReport.Repositories)
+	}
+}
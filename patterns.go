@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// repoPattern matches the namespace/name of repositories, either with a
+// glob where * and ? do not match a / but ** matches anything, or with a
+// regular expression prefixed with re:
+type repoPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newRepoPattern(pattern string) (*repoPattern, error) {
+	expr := strings.TrimPrefix(pattern, "re:")
+	if expr == pattern {
+		expr = globToRegexp(pattern)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return &repoPattern{pattern: pattern, re: re}, nil
+}
+
+func parseRepoPatterns(patterns []string) ([]*repoPattern, error) {
+	var parsed []*repoPattern
+	for _, pattern := range patterns {
+		p, err := newRepoPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+func (p *repoPattern) match(repo *Repository) bool {
+	return p.re.MatchString(repo.Namespace + "/" + repo.Name)
+}
+
+func (p *repoPattern) String() string {
+	return p.pattern
+}
+
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestRepoPattern(t *testing.T) {
+	var testCases = []struct {
+		pattern  string
+		repo     string
+		expected bool
+	}{
+		{"org/*", "org/app", true},
+		{"org/*", "org/sub/app", false},
+		{"org/**", "org/sub/app", true},
+		{"*/app-?", "org/app-1", true},
+		{"*/app-?", "org/app-10", false},
+		{"org/app.js", "org/appxjs", false},
+		{"re:^org/(app|lib)$", "org/lib", true},
+		{"re:^org/(app|lib)$", "org/libs", false},
+	}
+	for _, tc := range testCases {
+		p, err := newRepoPattern(tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns, name := splitFullName(tc.repo)
+		if got := p.match(&Repository{Namespace: ns, Name: name}); got != tc.expected {
+			t.Errorf("Expected %s matching %s to be %t, got %t", tc.pattern, tc.repo, tc.expected, got)
+		}
+	}
+
+	if _, err := newRepoPattern("re:org/("); err == nil {
+		t.Errorf("Expected an invalid regular expression to be rejected")
+	}
+}
+
+func splitFullName(fullName string) (string, string) {
+	for i := len(fullName) - 1; i >= 0; i-- {
+		if fullName[i] == '/' {
+			return fullName[:i], fullName[i+1:]
+		}
+	}
+	return "", fullName
+}
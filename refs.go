@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// getLocalRefs returns the refs of a local repository, by name
+func getLocalRefs(repoDir string) (map[string]string, error) {
+	cmd := execCommand(gitCommand, "-C", repoDir, "for-each-ref", "--format=%(objectname) %(refname)")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			refs[parts[1]] = parts[0]
+		}
+	}
+	return refs, nil
+}
+
+// getRemoteRefs returns the refs of the origin remote of a local
+// repository, by name, as listed by git ls-remote
+func getRemoteRefs(repoDir string) (map[string]string, error) {
+	cmd := execCommand(gitCommand, "-C", repoDir, "ls-remote", "origin")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 || parts[1] == "HEAD" || strings.HasSuffix(parts[1], "^{}") {
+			continue
+		}
+		refs[parts[1]] = parts[0]
+	}
+	return refs, nil
+}
+
+// localRefName maps a remote ref to the local ref an update fetches it
+// into. It returns false for the refs an update does not fetch.
+func localRefName(ref string, shallow, bare bool) (string, bool) {
+	switch {
+	case bare:
+		// Mirrors fetch all the refs
+		return ref, true
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return "refs/remotes/origin/" + strings.TrimPrefix(ref, "refs/heads/"), true
+	case strings.HasPrefix(ref, "refs/tags/"):
+		// Shallow clones are updated with --no-tags
+		return ref, !shallow
+	}
+	return "", false
+}
+
+// isPrunedRef returns true for the local refs an update removes when they
+// are gone from the remote
+func isPrunedRef(ref string, shallow, bare bool) bool {
+	switch {
+	case bare:
+		return !strings.HasPrefix(ref, "refs/gitbackup/")
+	case strings.HasPrefix(ref, "refs/remotes/origin/"):
+		return ref != "refs/remotes/origin/HEAD"
+	case strings.HasPrefix(ref, "refs/tags/"):
+		// Shallow clones are updated with --no-tags
+		return !shallow
+	}
+	return false
+}
+
+// remoteRefsUnchanged returns true when updating the repository would not
+// change anything: every ref of the remote already points to the same
+// object locally, and no local ref would be pruned
+func remoteRefsUnchanged(repoDir string, shallow, bare bool) (bool, error) {
+	remoteRefs, err := getRemoteRefs(repoDir)
+	if err != nil {
+		return false, err
+	}
+	localRefs, err := getLocalRefs(repoDir)
+	if err != nil {
+		return false, err
+	}
+
+	expected := map[string]string{}
+	for ref, sha := range remoteRefs {
+		name, ok := localRefName(ref, shallow, bare)
+		if !ok {
+			continue
+		}
+		if localRefs[name] != sha {
+			return false, nil
+		}
+		expected[name] = sha
+	}
+	for ref := range localRefs {
+		if _, ok := expected[ref]; !ok && isPrunedRef(ref, shallow, bare) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Preserved refs are kept under this namespace, by the time they were lost
+const (
+	preservedRefsPrefix     = "refs/gitbackup/deleted/"
+	preservedRefsTimeFormat = "20060102T150405Z"
+)
+
+// isPreservableRef returns true for the local refs an update can delete
+// or rewrite
+func isPreservableRef(ref string, bare bool) bool {
+	if strings.HasPrefix(ref, "refs/gitbackup/") {
+		return false
+	}
+	if bare {
+		return true
+	}
+	return (strings.HasPrefix(ref, "refs/remotes/origin/") && ref != "refs/remotes/origin/HEAD") ||
+		strings.HasPrefix(ref, "refs/tags/")
+}
+
+// protectPreservedRefs makes sure pruning a mirror leaves the preserved
+// refs alone, they are not on the remote
+func protectPreservedRefs(repoDir string) error {
+	out, _ := execCommand(gitCommand, "-C", repoDir, "config", "--get-all", "remote.origin.fetch").Output()
+	for _, refspec := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if refspec == "^refs/gitbackup/*" {
+			return nil
+		}
+	}
+	out, err := execCommand(gitCommand, "-C", repoDir, "config", "--add", "remote.origin.fetch", "^refs/gitbackup/*").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// preserveLostRefs compares the refs from before an update with the current
+// ones, and keeps the commits of every ref which was deleted or force pushed
+// under refs/gitbackup/deleted/<time>/. The update must have run with
+// gc.auto=0 so that the lost commits are still in the repository.
+func preserveLostRefs(repoDir string, before map[string]string, bare bool, lostAt time.Time) ([]string, error) {
+	after, err := getLocalRefs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	var preserved []string
+	for ref, sha := range before {
+		if !isPreservableRef(ref, bare) || after[ref] == sha {
+			continue
+		}
+		if newSha, ok := after[ref]; ok {
+			// A fast-forward keeps the previous commits
+			err := execCommand(gitCommand, "-C", repoDir, "merge-base", "--is-ancestor", sha, newSha).Run()
+			if err == nil {
+				continue
+			}
+		}
+		preservedRef := preservedRefsPrefix + lostAt.UTC().Format(preservedRefsTimeFormat) + "/" + strings.TrimPrefix(ref, "refs/")
+		out, err := execCommand(gitCommand, "-C", repoDir, "update-ref", preservedRef, sha).CombinedOutput()
+		if err != nil {
+			return preserved, fmt.Errorf("failed to preserve %s: %v: %s", ref, err, out)
+		}
+		preserved = append(preserved, preservedRef)
+	}
+	sort.Strings(preserved)
+	return preserved, nil
+}
+
+// expirePreservedRefs deletes the preserved refs older than keepDays
+func expirePreservedRefs(repoDir string, keepDays int, now time.Time) error {
+	if keepDays <= 0 {
+		return nil
+	}
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		return err
+	}
+	for ref := range refs {
+		if !strings.HasPrefix(ref, preservedRefsPrefix) {
+			continue
+		}
+		lostAt, err := time.Parse(preservedRefsTimeFormat, strings.SplitN(strings.TrimPrefix(ref, preservedRefsPrefix), "/", 2)[0])
+		if err != nil || now.Sub(lostAt) < time.Duration(keepDays)*24*time.Hour {
+			continue
+		}
+		debugLogf("Expiring preserved ref %s in %s", ref, repoDir)
+		out, err := execCommand(gitCommand, "-C", repoDir, "update-ref", "-d", ref).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to expire %s: %v: %s", ref, err, out)
+		}
+	}
+	return nil
+}
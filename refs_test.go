@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func runTestGit(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+}
+
+// newTestRemote creates a repository with a commit and a tag to clone from
+func newTestRemote(t *testing.T) string {
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	remote := filepath.Join(t.TempDir(), "remote")
+	runTestGit(t, "init", "-q", "-b", "main", remote)
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "init")
+	runTestGit(t, "-C", remote, "tag", "-a", "v1", "-m", "v1")
+	return remote
+}
+
+func TestRemoteRefsUnchanged(t *testing.T) {
+	for _, bare := range []bool{true, false} {
+		remote := newTestRemote(t)
+		repoDir := filepath.Join(t.TempDir(), "clone")
+		if bare {
+			runTestGit(t, "clone", "-q", "--mirror", remote, repoDir)
+		} else {
+			runTestGit(t, "clone", "-q", remote, repoDir)
+		}
+
+		if unchanged, err := remoteRefsUnchanged(repoDir, false, bare); err != nil || !unchanged {
+			t.Errorf("bare=%t: Expected a fresh clone to be unchanged, got %t %v", bare, unchanged, err)
+		}
+
+		// A force push
+		runTestGit(t, "-C", remote, "commit", "-q", "--amend", "--allow-empty", "-m", "amended")
+		if unchanged, _ := remoteRefsUnchanged(repoDir, false, bare); unchanged {
+			t.Errorf("bare=%t: Expected a rewritten branch to be detected", bare)
+		}
+		if bare {
+			runTestGit(t, "-C", repoDir, "remote", "update", "--prune")
+		} else {
+			runTestGit(t, "-C", repoDir, "fetch", "-q", "origin")
+		}
+
+		// A moved tag
+		runTestGit(t, "-C", remote, "tag", "-f", "-a", "v1", "-m", "v1 again")
+		if unchanged, _ := remoteRefsUnchanged(repoDir, false, bare); unchanged {
+			t.Errorf("bare=%t: Expected a moved tag to be detected", bare)
+		}
+		// A moved tag is not fetched when shallow
+		if !bare {
+			if unchanged, _ := remoteRefsUnchanged(repoDir, true, bare); !unchanged {
+				t.Errorf("Expected tags to be ignored for a shallow clone")
+			}
+		}
+	}
+}
+
+func TestRemoteRefsDeletedBranch(t *testing.T) {
+	remote := newTestRemote(t)
+	runTestGit(t, "-C", remote, "branch", "feature")
+	repoDir := filepath.Join(t.TempDir(), "mirror")
+	runTestGit(t, "clone", "-q", "--mirror", remote, repoDir)
+
+	runTestGit(t, "-C", remote, "branch", "-D", "feature")
+	if unchanged, _ := remoteRefsUnchanged(repoDir, false, true); unchanged {
+		t.Errorf("Expected a deleted branch to be detected for a mirror")
+	}
+}
+
+func TestBackupCheckRefs(t *testing.T) {
+	var wg sync.WaitGroup
+	remote := newTestRemote(t)
+	backupDir := t.TempDir()
+	runTestGit(t, "clone", "-q", "--mirror", remote, filepath.Join(backupDir, "ns", "r1.git"))
+
+	appFS = afero.NewOsFs()
+	appCfg.checkRefs = true
+	currentReport = newRunReport(&appConfig{service: "github", backupDir: backupDir})
+	defer func() {
+		appCfg.checkRefs = false
+		currentReport = nil
+	}()
+
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: remote}
+	wg.Add(1)
+	if _, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "second")
+	wg.Add(1)
+	if _, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{repoActionUnchanged, repoActionUpdated}
+	for i, action := range expected {
+		if currentReport.Repositories[i].Action != action {
+			t.Errorf("Expected action %s for backup %d, got %s", action, i, currentReport.Repositories[i].Action)
+		}
+	}
+}
+
+func TestBackupPreserveRefs(t *testing.T) {
+	var wg sync.WaitGroup
+	remote := newTestRemote(t)
+	runTestGit(t, "-C", remote, "branch", "feature")
+	runTestGit(t, "-C", remote, "branch", "fast-forward")
+	backupDir := t.TempDir()
+	repoDir := filepath.Join(backupDir, "ns", "r1.git")
+	runTestGit(t, "clone", "-q", "--mirror", remote, repoDir)
+	before, err := getLocalRefs(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runTestGit(t, "-C", remote, "branch", "-D", "feature")
+	runTestGit(t, "-C", remote, "commit", "-q", "--amend", "--allow-empty", "-m", "rewritten")
+	runTestGit(t, "-C", remote, "checkout", "-q", "fast-forward")
+	runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "next")
+
+	appFS = afero.NewOsFs()
+	appCfg.preserveRefs = true
+	defer func() { appCfg.preserveRefs = false }()
+
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: remote}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := refs["refs/heads/feature"]; ok {
+		t.Errorf("Expected the deleted branch to be pruned")
+	}
+	preserved := map[string]string{}
+	for ref, sha := range refs {
+		if strings.HasPrefix(ref, preservedRefsPrefix) {
+			parts := strings.SplitN(strings.TrimPrefix(ref, preservedRefsPrefix), "/", 2)
+			preserved["refs/"+parts[1]] = sha
+		}
+	}
+	if len(preserved) != 2 || preserved["refs/heads/feature"] != before["refs/heads/feature"] || preserved["refs/heads/main"] != before["refs/heads/main"] {
+		t.Errorf("Expected the deleted and the force pushed branch to be preserved, got %v", preserved)
+	}
+
+	// Expire them
+	if err := expirePreservedRefs(repoDir, 1, time.Now().Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	refs, _ = getLocalRefs(repoDir)
+	for ref := range refs {
+		if strings.HasPrefix(ref, preservedRefsPrefix) {
+			t.Errorf("Expected %s to be expired", ref)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions recorded for each repository in the run report
+const (
+	repoActionCloned  = "cloned"
+	repoActionUpdated = "updated"
+	repoActionSkipped = "skipped"
+	repoActionFailed  = "failed"
+	// The refs of the remote matched the local ones, nothing was fetched
+	repoActionUnchanged = "unchanged"
+	// The repository is gone upstream
+	repoActionOrphaned = "orphaned"
+)
+
+// currentReport is the report of the backup run in progress, if any.
+// All the recording methods are safe to call on a nil report.
+var currentReport *runReport
+
+// runReport is the machine-readable summary of a backup run which is
+// written to the path given via -report
+type runReport struct {
+	mu              sync.Mutex
+	apiCallsAtStart int64
+
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Service         string        `json:"service"`
+	GitHost         string        `json:"git_host"`
+	Hostname        string        `json:"hostname"`
+	Success         bool          `json:"success"`
+	Error           string        `json:"error,omitempty"`
+	LastBackupAt    *time.Time    `json:"last_backup_at,omitempty"`
+	Manifest        string        `json:"manifest,omitempty"`
+	APICalls        int64         `json:"api_calls"`
+	Repositories    []*repoReport `json:"repositories"`
+}
+
+// repoReport holds the outcome of backing up a single repository
+type repoReport struct {
+	Namespace       string          `json:"namespace"`
+	Name            string          `json:"name"`
+	Action          string          `json:"action"`
+	StartedAt       time.Time       `json:"started_at"`
+	DurationSeconds float64         `json:"duration_seconds"`
+	Error           string          `json:"error,omitempty"`
+	Archives        []archiveReport `json:"archives,omitempty"`
+	// RefsFingerprint is the fingerprint of the refs which were archived
+	RefsFingerprint string         `json:"refs_fingerprint,omitempty"`
+	Health          *healthReport  `json:"health,omitempty"`
+	Restore         *restoreReport `json:"restore,omitempty"`
+}
+
+// archiveReport describes a single archive file (or volume) written
+type archiveReport struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Location is where the archive was uploaded to, if it was
+	Location string `json:"location,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+func newRunReport(c *appConfig) *runReport {
+	hostname, _ := os.Hostname()
+	return &runReport{
+		apiCallsAtStart: atomic.LoadInt64(&apiCalls),
+		StartedAt:       time.Now(),
+		Service:         c.service,
+		GitHost:         filepath.Base(c.backupDir),
+		Hostname:        hostname,
+		Repositories:    []*repoReport{},
+	}
+}
+
+// startRepo adds a new repository entry to the report and returns it
+func (r *runReport) startRepo(repo *Repository) *repoReport {
+	if r == nil {
+		return nil
+	}
+	rr := &repoReport{
+		Namespace: repo.Namespace,
+		Name:      repo.Name,
+		StartedAt: time.Now(),
+	}
+	r.mu.Lock()
+	r.Repositories = append(r.Repositories, rr)
+	r.mu.Unlock()
+	return rr
+}
+
+// setLastBackupAt records the timestamp saved for the next incremental run
+func (r *runReport) setLastBackupAt(t time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.LastBackupAt = &t
+	r.mu.Unlock()
+}
+
+// finish marks the end of the run along with the error it failed with, if any
+func (r *runReport) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.APICalls = atomic.LoadInt64(&apiCalls) - r.apiCallsAtStart
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	for _, rr := range r.Repositories {
+		if rr.Action == repoActionFailed {
+			r.Success = false
+		}
+	}
+}
+
+// write saves the report as JSON to the given path, atomically
+func (r *runReport) write(reportPath string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(reportPath, data, 0644)
+}
+
+// finish records the outcome of a repository backup
+func (rr *repoReport) finish(action string, err error, output []byte) {
+	if rr == nil {
+		return
+	}
+	rr.Action = action
+	rr.DurationSeconds = time.Since(rr.StartedAt).Seconds()
+	if err != nil {
+		rr.Action = repoActionFailed
+		rr.Error = err.Error()
+		if len(output) != 0 {
+			rr.Error += ": " + string(output)
+		}
+	}
+}
+
+// addArchives records the files written for an archive
+func (rr *repoReport) addArchives(archives []archiveReport) {
+	if rr == nil {
+		return
+	}
+	rr.Archives = append(rr.Archives, archives...)
+}
+
+// setHealth records the outcome of the health check of the backup
+func (rr *repoReport) setHealth(health *healthReport) {
+	if rr == nil {
+		return
+	}
+	rr.Health = health
+}
+
+// setRefsFingerprint records the fingerprint of the refs of an archive
+func (rr *repoReport) setRefsFingerprint(fingerprint string) {
+	if rr == nil {
+		return
+	}
+	rr.RefsFingerprint = fingerprint
+}
+
+// getArchiveFiles returns all the files written for the archive at
+// archivePath, including the volumes created when splitting it
+func getArchiveFiles(archivePath string) []archiveReport {
+	var archives []archiveReport
+	matches, _ := filepath.Glob(archivePath + "*")
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		archives = append(archives, archiveReport{Path: m, Size: info.Size()})
+	}
+	return archives
+}
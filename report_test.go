@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestBackupRecordsReport(t *testing.T) {
+	var wg sync.WaitGroup
+	backupDir := "/tmp/backupdir"
+
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll(backupDir, 0771)
+	currentReport = newRunReport(&appConfig{service: "github", backupDir: "/tmp/backupdir/github.com"})
+
+	defer func() {
+		execCommand = exec.Command
+		currentReport = nil
+		wg.Wait()
+	}()
+
+	execCommand = fakeCloneCommand
+	wg.Add(1)
+	backUp(backupDir, &Repository{Namespace: "ns", Name: "cloned", CloneURL: "git://foo.com/foo"}, false, &wg)
+
+	appFS.MkdirAll(filepath.Join(backupDir, "ns", "updated"), 0771)
+	execCommand = fakeFetchCommand
+	wg.Add(1)
+	backUp(backupDir, &Repository{Namespace: "ns", Name: "updated", CloneURL: "git://foo.com/foo"}, false, &wg)
+
+	// The clone helper fails for a pull
+	appFS.MkdirAll(filepath.Join(backupDir, "ns", "failed"), 0771)
+	execCommand = fakeCloneCommand
+	wg.Add(1)
+	backUp(backupDir, &Repository{Namespace: "ns", Name: "failed", CloneURL: "git://foo.com/foo"}, false, &wg)
+
+	expected := []string{repoActionCloned, repoActionUpdated, repoActionFailed}
+	if len(currentReport.Repositories) != len(expected) {
+		t.Fatalf("Expected %d repositories in the report, got %d", len(expected), len(currentReport.Repositories))
+	}
+	for i, action := range expected {
+		if currentReport.Repositories[i].Action != action {
+			t.Errorf("Expected action %s for %s, got %s", action, currentReport.Repositories[i].Name, currentReport.Repositories[i].Action)
+		}
+	}
+	if currentReport.Repositories[2].Error == "" {
+		t.Errorf("Expected the error text to be recorded for a failed repository")
+	}
+
+	currentReport.finish(nil)
+	if currentReport.Success {
+		t.Errorf("Expected the run to be reported as failed")
+	}
+	if currentReport.GitHost != "github.com" {
+		t.Errorf("Expected git host github.com, got %s", currentReport.GitHost)
+	}
+}
+
+func TestRunReportWrite(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "reports", "report.json")
+
+	r := newRunReport(&appConfig{service: "gitlab", backupDir: "/backups/gitlab.com"})
+	rr := r.startRepo(&Repository{Namespace: "ns", Name: "r1"})
+	rr.finish(repoActionCloned, nil, nil)
+	r.finish(errors.New("no repositories retrieved"))
+
+	if err := r.write(reportPath); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got runReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Success || got.Error != "no repositories retrieved" {
+		t.Errorf("Expected a failed run with its error, got success=%t error=%q", got.Success, got.Error)
+	}
+	if len(got.Repositories) != 1 || got.Repositories[0].Action != repoActionCloned {
+		t.Errorf("Expected one cloned repository, got %+v", got.Repositories)
+	}
+
+	// No temporary files should be left behind
+	entries, _ := os.ReadDir(filepath.Dir(reportPath))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the report file, got %d entries", len(entries))
+	}
+}
+
+func TestNilRunReport(t *testing.T) {
+	var r *runReport
+	rr := r.startRepo(&Repository{Name: "r1"})
+	rr.finish(repoActionCloned, nil, nil)
+	rr.addArchives(getArchiveFiles("/nonexistent"))
+	r.finish(nil)
+}
+
+func TestReportWrittenWithoutClient(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "")
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	c := &appConfig{service: "gitlab", backupDir: t.TempDir(), reportPath: reportPath}
+	defer func() { currentReport = nil }()
+	if err := handleGitRepositoryClone(c); err == nil {
+		t.Fatalf("Expected the run to fail without a token")
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Expected the report of the failed run: %v", err)
+	}
+	var r runReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Success || r.Error == "" {
+		t.Errorf("Expected the missing token to be reported, got %q", r.Error)
+	}
+}
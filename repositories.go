@@ -1,8 +1,10 @@
 package main
 
 import (
-	"github.com/google/go-github/v34/github"
+	"fmt"
+	"log"
 	"net/http"
+	"time"
 )
 
 // Response is derived from the following sources:
@@ -25,16 +27,44 @@ type Response struct {
 // Repository is a container for the details for a repository
 // we will backup
 type Repository struct {
-	// PushedAt represents the date and time of the last commit
-	PushedAt *github.Timestamp
+	// PushedAt represents the date and time of the last commit, or the
+	// closest the service reports: the last activity on GitLab and the
+	// last update on Bitbucket
+	PushedAt *time.Time
 	// UpdatedAt represents the date and time of the last change in the repository
-	UpdatedAt *github.Timestamp
-	//
+	UpdatedAt *time.Time
+	// ID is the provider's identifier of the repository, which unlike
+	// its name does not change when the repository is renamed
+	ID        string
 	CloneURL  string
 	Name      string
 	Namespace string
 	Private   bool
+	Fork      bool
 	Shallow   bool
+	// Visibility is public, private or internal
+	Visibility string
+	Archived   bool
+	Disabled   bool
+	Topics     []string
+	// Language is the primary language, empty when unknown
+	Language string
+	// Size is the size of the repository in bytes, 0 when unknown
+	Size int64
+	// Strategy is how much of the history is backed up, see -clone.strategy
+	Strategy cloneStrategy
+	// Superproject is the namespace/name of the repository a submodule
+	// was discovered in
+	Superproject string
+}
+
+// strategy returns the clone strategy of the repository, a shallow clone
+// of the latest commit when it is only marked as shallow
+func (r *Repository) strategy() cloneStrategy {
+	if r.Shallow && !r.Strategy.shallow() {
+		return cloneStrategy{Depth: 1}
+	}
+	return r.Strategy
 }
 
 func getRepositories(
@@ -63,6 +93,7 @@ func getRepositories(
 	case "gitlab":
 		repositories, err = getGitlabRepositories(
 			client,
+			c,
 			service,
 			githubRepoType,
 			githubNamespaceWhitelist,
@@ -83,3 +114,50 @@ func getRepositories(
 	}
 	return repositories, err
 }
+
+// changedSince returns true unless the repository is known not to have
+// been pushed to after t
+func (r *Repository) changedSince(t time.Time) bool {
+	return r.PushedAt == nil || r.PushedAt.After(t)
+}
+
+// filterUnchangedRepositories drops the repositories which were not pushed
+// to after -changed-since and, with -skip-unchanged, the ones which were
+// not pushed to since their last successful backup. The skipped
+// repositories are recorded in the run report.
+func filterUnchangedRepositories(c *appConfig, repositories []*Repository) ([]*Repository, error) {
+	var changedSince time.Time
+	if c.changedSince != "" {
+		var err error
+		changedSince, err = time.Parse(cacheSaveLastBackupDateAndContinueFromCache, c.changedSince)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse changed-since -> %v", err)
+		}
+	}
+
+	var changed []*Repository
+	for _, repo := range repositories {
+		if !changedSince.IsZero() && !repo.changedSince(changedSince) {
+			debugLogf("Skipping %s/%s, not pushed to since %s", repo.Namespace, repo.Name, c.changedSince)
+			currentReport.startRepo(repo).finish(repoActionSkipped, nil, nil)
+			continue
+		}
+		if c.skipUnchanged {
+			repoDir, _ := getRepoDir(c.backupDir, repo, c.bare)
+			unchanged, err := currentState.unchangedSinceLastBackup(repo, repoDir)
+			if err != nil {
+				return nil, err
+			}
+			if unchanged {
+				debugLogf("Skipping %s/%s, not pushed to since its last backup", repo.Namespace, repo.Name)
+				currentReport.startRepo(repo).finish(repoActionSkipped, nil, nil)
+				continue
+			}
+		}
+		changed = append(changed, repo)
+	}
+	if skipped := len(repositories) - len(changed); skipped > 0 {
+		log.Printf("%d of %d repositories unchanged, skipping them", skipped, len(repositories))
+	}
+	return changed, nil
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/v34/github"
 	"github.com/ktrysmt/go-bitbucket"
@@ -48,7 +49,7 @@ func setupRepositoryTests() {
 	GitLabClient, err = gitlab.NewClient("", gitlab.WithBaseURL(url.String()))
 
 	BitbucketClient = bitbucket.NewBasicAuth(os.Getenv("BITBUCKET_USERNAME"), os.Getenv("BITBUCKET_USERNAME"))
-	BitbucketClient.SetApiBaseURL(url.String())
+	BitbucketClient.SetApiBaseURL(*url)
 }
 
 func teardownRepositoryTests() {
@@ -72,7 +73,7 @@ func TestGetPublicGitHubRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false, Visibility: "public"})
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
@@ -91,7 +92,7 @@ func TestGetPrivateGitHubRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true, Visibility: "private"})
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
@@ -110,7 +111,7 @@ func TestGetStarredGitHubRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true, Visibility: "private"})
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
@@ -133,8 +134,8 @@ func TestGetWhitelistGitHubRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
-	expected = append(expected, &Repository{Namespace: "user1", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false, Visibility: "public"})
+	expected = append(expected, &Repository{ID: "1", Namespace: "user1", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false, Visibility: "public"})
 
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
@@ -154,7 +155,7 @@ func TestGetGitLabRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "r1"})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "r1"})
 	if !reflect.DeepEqual(repos, expected) {
 		for i := 0; i < len(repos); i++ {
 			t.Errorf("Expected %+v, Got %+v", expected[i], repos[i])
@@ -179,8 +180,8 @@ func TestGetGitLabPrivateRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test",
-		CloneURL: "https://gitlab.com/u/r1", Name: "r1", Private: true})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test",
+		CloneURL: "https://gitlab.com/u/r1", Name: "r1", Private: true, Visibility: "private"})
 	if !reflect.DeepEqual(repos, expected) {
 		for i := 0; i < len(repos); i++ {
 			t.Errorf("Expected %+v, Got %+v", expected[i], repos[i])
@@ -206,7 +207,7 @@ func TestGetStarredGitLabRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "starred-repo-r1"})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "starred-repo-r1"})
 
 	if !reflect.DeepEqual(repos, expected) {
 		if len(repos) != len(expected) {
@@ -235,10 +236,74 @@ func TestGetBitbucketRepositories(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "abc", CloneURL: "git@bitbucket.org:abc/def.git", Name: "def", Private: true})
+	expected = append(expected, &Repository{Namespace: "abc", CloneURL: "git@bitbucket.org:abc/def.git", Name: "def", Private: true, Visibility: "private"})
 	if !reflect.DeepEqual(repos, expected) {
 		for i := 0; i < len(repos); i++ {
 			t.Errorf("Expected %+v, Got %+v", expected[i], repos[i])
 		}
 	}
 }
+
+func TestGetRepositoriesLastActivity(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"path_with_namespace": "test/r1", "id":1, "ssh_url_to_repo": "https://gitlab.com/u/r1", "name": "r1", "last_activity_at": "2024-01-02T03:04:05Z"}]`)
+	})
+	mux.HandleFunc("/workspaces", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"pagelen": 10, "page": 1, "size": 1, "values": [{"slug": "abc"}]}`)
+	})
+	mux.HandleFunc("/repositories/abc", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"pagelen": 10, "page": 1, "size": 1, "values": [{"full_name":"abc/def", "slug":"def", "updated_on": "2024-01-02T03:04:05.123456+00:00", "parent": {"full_name": "xyz/def"}}]}`)
+	})
+
+	expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	repos, err := getRepositories(GitLabClient, &appCfg, "gitlab", "internal", []string{}, "", "", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(repos) != 1 || repos[0].PushedAt == nil || !repos[0].PushedAt.Equal(expected) {
+		t.Errorf("Expected the GitLab last activity as push time, got %+v", repos)
+	}
+
+	repos, err = getRepositories(BitbucketClient, &appCfg, "bitbucket", "", []string{}, "", "", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(repos) != 1 || repos[0].PushedAt == nil || !repos[0].PushedAt.Truncate(time.Second).Equal(expected) {
+		t.Errorf("Expected the Bitbucket last update as push time, got %+v", repos)
+	}
+	if !repos[0].Fork {
+		t.Errorf("Expected a Bitbucket repository with a parent to be a fork")
+	}
+}
+
+func TestFilterUnchangedRepositories(t *testing.T) {
+	pushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	older := pushedAt.Add(-time.Hour)
+	newer := pushedAt.Add(time.Hour)
+	repositories := []*Repository{
+		{Namespace: "ns", Name: "old", PushedAt: &older},
+		{Namespace: "ns", Name: "new", PushedAt: &newer},
+		{Namespace: "ns", Name: "unknown"},
+	}
+
+	currentReport = newRunReport(&appConfig{service: "gitlab", backupDir: "/backups/gitlab.com"})
+	defer func() { currentReport = nil }()
+
+	changed, err := filterUnchangedRepositories(&appConfig{changedSince: "2024-01-01 00:00:00"}, repositories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 || changed[0].Name != "new" || changed[1].Name != "unknown" {
+		t.Errorf("Expected the repositories pushed to after the date, got %+v", changed)
+	}
+	if len(currentReport.Repositories) != 1 || currentReport.Repositories[0].Action != repoActionSkipped {
+		t.Errorf("Expected the skipped repository in the report, got %+v", currentReport.Repositories)
+	}
+
+	if _, err := filterUnchangedRepositories(&appConfig{changedSince: "yesterday"}, repositories); err == nil {
+		t.Errorf("Expected an invalid date to be rejected")
+	}
+}
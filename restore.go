@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+var volumeSuffixRegexp = regexp.MustCompile(`\.[0-9]{3}$`)
+
+// handleRestore is `gitbackup restore`, which decrypts and extracts an
+// archive written by a backup, or restores the repositories of backups to
+// a target host
+func handleRestore(args []string) error {
+	var ageIdentities, pgpKeys, mappings stringsFlag
+	fs := flag.NewFlagSet("gitbackup restore", flag.ExitOnError)
+	archivePath := fs.String("archive", "", "Archive to restore, or any of its volumes, or the manifest (.bundle.json) of a chain of bundles")
+	targetDir := fs.String("dir", "", "Directory to extract the repository to")
+	source := fs.String("source", "", "Backup directory, archive, manifest (.bundle.json or MANIFEST-*.json) or GitHub migration archive whose repositories to restore to -target.service")
+	targetService := fs.String("target.service", "", "Service to restore the repositories to (github, gitlab, bitbucket, gitea), or bare for bare repositories in the -target.url directory")
+	targetURL := fs.String("target.url", "", "URL of the target host (default that of the service), or directory of the bare repositories")
+	fs.Var(&mappings, "map", "Restore the repositories of a namespace, or a repository, under another name, as <namespace>=<namespace> or <namespace>/<name>=<namespace>/<name> (repeatable)")
+	dryRun := fs.Bool("dry-run", false, "Only list the repositories which would be created and pushed")
+	reportPath := fs.String("report", "", "Write a JSON report of the restore to this path")
+	fs.Var(&ageIdentities, "identity", "age identity file decrypting the archive (repeatable)")
+	fs.Var(&pgpKeys, "pgp-key", "OpenPGP private key decrypting the archive, its passphrase in "+pgpPassphraseEnv+" (repeatable)")
+	fs.BoolVar(&appCfg.debug, "debug", false, "Enable verbose debug logging")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *source != "" || *targetService != "" {
+		if *source == "" || *targetService == "" {
+			return errors.New("Please specify the backups to restore with -source and where to with -target.service")
+		}
+	} else if *archivePath == "" || *targetDir == "" {
+		return errors.New("Please specify the archive to restore with -archive and the directory to extract it to with -dir")
+	}
+
+	decryption, err := newArchiveDecryption(ageIdentities, pgpKeys)
+	if err != nil {
+		return err
+	}
+	if *source != "" {
+		mapping, err := parseRestoreMappings(mappings)
+		if err != nil {
+			return err
+		}
+		target, err := newRestoreTarget(*targetService, *targetURL)
+		if err != nil {
+			return err
+		}
+		r := newRunReport(&appConfig{service: *targetService, backupDir: *source})
+		err = restoreToTarget(*source, target, mapping, *dryRun, decryption, r)
+		r.finish(err)
+		if *reportPath != "" {
+			if reportErr := r.write(*reportPath); reportErr != nil {
+				log.Printf("failed to write report -> %v", reportErr)
+			}
+		}
+		return err
+	}
+
+	if strings.HasSuffix(*archivePath, bundleManifestSuffix) {
+		err = restoreBundles(*archivePath, *targetDir, decryption)
+	} else {
+		err = restoreArchive(*archivePath, *targetDir, decryption)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %s to %s\n", *archivePath, *targetDir)
+	return nil
+}
+
+// getArchiveVolumes returns the files of an archive, given by its name or
+// one of its volumes, along with its name
+func getArchiveVolumes(archivePath string) (string, []string, error) {
+	archivePath = volumeSuffixRegexp.ReplaceAllString(archivePath, "")
+	if _, err := os.Stat(archivePath); err == nil {
+		return archivePath, []string{archivePath}, nil
+	}
+	volumes, _ := filepath.Glob(archivePath + ".[0-9][0-9][0-9]")
+	if len(volumes) == 0 {
+		return "", nil, fmt.Errorf("no archive at %s", archivePath)
+	}
+	sort.Strings(volumes)
+	return archivePath, volumes, nil
+}
+
+// restoreArchive decrypts and extracts an archive into the target
+// directory, refusing to overwrite any file
+func restoreArchive(archivePath, targetDir string, decryption *archiveDecryption) error {
+	name, volumes, err := getArchiveVolumes(archivePath)
+	if err != nil {
+		return err
+	}
+	var readers []io.Reader
+	for _, volume := range volumes {
+		f, err := os.Open(volume)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	debugLogf("Restoring %s from %d file(s)", name, len(volumes))
+
+	name, r, err := decryption.decrypt(name, io.MultiReader(readers...))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s -> %v", archivePath, err)
+	}
+	if err := os.MkdirAll(targetDir, 0771); err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasSuffix(name, "."+archiveFormatTarZst):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		if err := extractTar(zr, targetDir); err != nil {
+			return err
+		}
+	case strings.HasSuffix(name, "."+archiveFormatTarGz):
+		gr, err := pgzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		if err := extractTar(gr, targetDir); err != nil {
+			return err
+		}
+	case strings.HasSuffix(name, "."+archiveFormatZip):
+		if err := extractZip(r, targetDir); err != nil {
+			return err
+		}
+	case strings.HasSuffix(name, bundleSuffix):
+		return errors.New("bundles are restored from the manifest of their chain, the name of its full bundle followed by .json")
+	case strings.HasSuffix(name, "."+archiveFormat7z):
+		return fmt.Errorf("7z archives are extracted with 7z x %s", volumes[0])
+	default:
+		return fmt.Errorf("unknown archive format of %s", name)
+	}
+
+	// Only the end of the encrypted stream authenticates it
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to decrypt %s -> %v", archivePath, err)
+	}
+	return nil
+}
+
+// extractPath returns where a file of an archive is extracted, making
+// sure it is in the target directory, even through symbolic links
+func extractPath(targetDir, name string) (string, error) {
+	target := filepath.Join(targetDir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(targetDir, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %s in the archive", name)
+	}
+	root, err := filepath.EvalSymlinks(targetDir)
+	if err != nil {
+		return "", err
+	}
+	// The nearest existing parent, which may be a symbolic link
+	parent := filepath.Dir(target)
+	for {
+		resolved, err := filepath.EvalSymlinks(parent)
+		if err == nil {
+			parent = resolved
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent = filepath.Dir(parent)
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %s in the archive, out of %s", name, targetDir)
+	}
+	return target, nil
+}
+
+// extractFile creates a file of an archive
+func extractFile(target string, mode fs.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0771); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func extractTar(r io.Reader, targetDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := extractPath(targetDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, hdr.FileInfo().Mode().Perm()|0700)
+		case tar.TypeReg:
+			err = extractFile(target, hdr.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		default:
+			debugLogf("Skipping %s of type %c in the archive", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip extracts a zip archive, which is first spooled to a
+// temporary file as it can only be read at random
+func extractZip(r io.Reader, targetDir string) error {
+	tmp, err := os.CreateTemp("", "gitbackup-restore-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		target, err := extractPath(targetDir, f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if mode&fs.ModeSymlink != 0 {
+			var link []byte
+			link, err = io.ReadAll(rc)
+			if err == nil {
+				err = os.Symlink(string(link), target)
+			}
+		} else {
+			err = extractFile(target, mode, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
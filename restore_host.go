@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// repoActionRestored is recorded in the report of `gitbackup restore` to
+// a target host
+const repoActionRestored = "restored"
+
+// restoreReport is what was restored of a repository, and where to
+type restoreReport struct {
+	Source   string `json:"source"`
+	Target   string `json:"target,omitempty"`
+	Created  bool   `json:"created"`
+	Branches int    `json:"branches"`
+	Tags     int    `json:"tags"`
+	LFS      bool   `json:"lfs,omitempty"`
+}
+
+// restoreRepo is a repository found in the source of a restore
+type restoreRepo struct {
+	namespace, name string
+	// dir is the repository, a clone or a mirror
+	dir string
+	// source is the backup or the archive it comes from
+	source string
+}
+
+// restoreMapping renames the restored repositories, by namespace or by
+// repository
+type restoreMapping map[string]string
+
+func parseRestoreMappings(mappings []string) (restoreMapping, error) {
+	m := restoreMapping{}
+	for _, mapping := range mappings {
+		from, to, ok := strings.Cut(mapping, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected <namespace>=<namespace> or <namespace>/<name>=<namespace>/<name>", mapping)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// apply returns the namespace and the name a repository is restored as,
+// the mapping of the repository taking precedence over that of its
+// namespace
+func (m restoreMapping) apply(namespace, name string) (string, string) {
+	if to, ok := m[namespace+"/"+name]; ok {
+		if i := strings.LastIndex(to, "/"); i >= 0 {
+			return to[:i], to[i+1:]
+		}
+		return namespace, to
+	}
+	if to, ok := m[namespace]; ok {
+		return to, name
+	}
+	return namespace, name
+}
+
+// restoreToTarget restores every repository of the source to the target,
+// recording the outcome for each in the report
+func restoreToTarget(source string, target restoreTarget, mapping restoreMapping, dryRun bool, decryption *archiveDecryption, r *runReport) error {
+	repos, cleanup, err := findRestoreRepos(source, decryption)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		return fmt.Errorf("no repositories in %s", source)
+	}
+	failed := 0
+	for _, repo := range repos {
+		namespace, name := mapping.apply(repo.namespace, repo.name)
+		rr := r.startRepo(&Repository{Namespace: namespace, Name: name})
+		rr.Restore = &restoreReport{Source: repo.source}
+		out, err := restoreRepository(repo, namespace, name, target, dryRun, rr.Restore)
+		switch {
+		case err != nil:
+			log.Printf("Could not restore %s to %s/%s: %v\n", repo.source, namespace, name, err)
+			rr.finish(repoActionFailed, err, out)
+			failed++
+		case dryRun:
+			rr.finish(repoActionSkipped, nil, nil)
+		default:
+			rr.finish(repoActionRestored, nil, nil)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d repositories could not be restored", failed)
+	}
+	return nil
+}
+
+// restoreRepository creates a repository on the target if it is missing,
+// and pushes the branches and the tags of the backup to it, along with
+// its LFS objects if any. The push fails rather than rewrite branches
+// which diverged on the target.
+func restoreRepository(repo restoreRepo, namespace, name string, target restoreTarget, dryRun bool, report *restoreReport) ([]byte, error) {
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("no namespace for %s, map it to one with -map", repo.source)
+	}
+	refs, err := getLocalRefs(repo.dir)
+	if err != nil {
+		return nil, err
+	}
+	refspecs := restoreRefspecs(refs, report)
+	if report.Branches == 0 {
+		return nil, errors.New("no branches to push")
+	}
+	report.LFS = hasLFSObjects(repo.dir)
+
+	pushURL, created, err := target.ensureRepository(namespace, name, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get or create %s/%s -> %v", namespace, name, err)
+	}
+	report.Target = redactURL(pushURL)
+	report.Created = created
+	if dryRun {
+		if created {
+			log.Printf("Would create %s/%s and push %d branches and %d tags of %s\n", namespace, name, report.Branches, report.Tags, repo.source)
+		} else {
+			log.Printf("Would push %d branches and %d tags of %s to %s\n", report.Branches, report.Tags, repo.source, report.Target)
+		}
+		return nil, nil
+	}
+	if created {
+		log.Printf("Created %s/%s at %s\n", namespace, name, report.Target)
+	}
+
+	debugLogf("Pushing %s to %s: %s", repo.dir, report.Target, strings.Join(refspecs, " "))
+	args := append([]string{"-C", repo.dir, "push", "--quiet", pushURL}, refspecs...)
+	if out, err := execCommand(gitCommand, args...).CombinedOutput(); err != nil {
+		return redactOutput(out, pushURL), fmt.Errorf("failed to push to %s -> %v", report.Target, err)
+	}
+	if report.LFS {
+		debugLogf("Pushing the LFS objects of %s to %s", repo.dir, report.Target)
+		if out, err := execCommand(gitCommand, "-C", repo.dir, "lfs", "push", "--all", pushURL).CombinedOutput(); err != nil {
+			return redactOutput(out, pushURL), fmt.Errorf("failed to push the LFS objects to %s -> %v", report.Target, err)
+		}
+	}
+	if created {
+		if branch := getDefaultBranch(repo.dir); branch != "" {
+			if err := target.setDefaultBranch(namespace, name, branch); err != nil {
+				return nil, fmt.Errorf("failed to set the default branch of %s/%s -> %v", namespace, name, err)
+			}
+		}
+	}
+	log.Printf("Restored %d branches and %d tags of %s to %s\n", report.Branches, report.Tags, repo.source, report.Target)
+	return nil, nil
+}
+
+// restoreRefspecs returns the refspecs pushing the branches and the tags
+// of a repository, counting them. The branches of a clone are its
+// remote-tracking branches, each pushed on its own to leave origin/HEAD
+// out.
+func restoreRefspecs(refs map[string]string, report *restoreReport) []string {
+	var branches []string
+	clone := false
+	for _, ref := range sortedRefs(refs) {
+		switch {
+		case strings.HasPrefix(ref, "refs/remotes/origin/"):
+			// The local branches of a clone, sorted first, are left out
+			if !clone {
+				clone, branches = true, nil
+			}
+			if ref != "refs/remotes/origin/HEAD" {
+				branches = append(branches, ref+":refs/heads/"+strings.TrimPrefix(ref, "refs/remotes/origin/"))
+			}
+		case strings.HasPrefix(ref, "refs/heads/") && !clone:
+			branches = append(branches, ref)
+		case strings.HasPrefix(ref, "refs/tags/"):
+			report.Tags++
+		}
+	}
+	report.Branches = len(branches)
+	if !clone {
+		branches = []string{"refs/heads/*:refs/heads/*"}
+	}
+	return append(branches, "refs/tags/*:refs/tags/*")
+}
+
+// getDefaultBranch returns the default branch of a clone or a mirror
+func getDefaultBranch(repoDir string) string {
+	if out, err := execCommand(gitCommand, "-C", repoDir, "symbolic-ref", "-q", "refs/remotes/origin/HEAD").Output(); err == nil {
+		return strings.TrimPrefix(strings.TrimSpace(string(out)), "refs/remotes/origin/")
+	}
+	if out, err := execCommand(gitCommand, "-C", repoDir, "symbolic-ref", "-q", "HEAD").Output(); err == nil {
+		return strings.TrimPrefix(strings.TrimSpace(string(out)), "refs/heads/")
+	}
+	return ""
+}
+
+// hasLFSObjects returns true when a clone or a mirror has LFS objects
+func hasLFSObjects(repoDir string) bool {
+	gitDir := repoDir
+	if fi, err := os.Stat(filepath.Join(repoDir, ".git")); err == nil && fi.IsDir() {
+		gitDir = filepath.Join(repoDir, ".git")
+	}
+	entries, _ := os.ReadDir(filepath.Join(gitDir, "lfs", "objects"))
+	return len(entries) > 0
+}
+
+// redactURL removes the credentials of a URL
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
+
+// redactOutput removes the password of the push URL from the output of
+// git
+func redactOutput(out []byte, pushURL string) []byte {
+	u, err := url.Parse(pushURL)
+	if err != nil || u.User == nil {
+		return out
+	}
+	if password, ok := u.User.Password(); ok && password != "" {
+		return bytes.ReplaceAll(out, []byte(password), []byte("***"))
+	}
+	return out
+}
+
+// findRestoreRepos returns the repositories of the source of a restore: a
+// backup directory, the manifest of a run or of a chain of bundles, an
+// archive or a GitHub migration archive. The archives are extracted into
+// a temporary directory, which the returned function removes.
+func findRestoreRepos(source string, decryption *archiveDecryption) ([]restoreRepo, func(), error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if info.IsDir() {
+		repos, err := walkRestoreRepos(source, source)
+		return repos, func() {}, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gitbackup-restore-")
+	if err != nil {
+		return nil, func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	base := filepath.Base(source)
+	switch {
+	case strings.HasPrefix(base, manifestPrefix) && strings.HasSuffix(base, ".json"):
+		manifest, err := readRunManifest(source, "")
+		if err != nil {
+			return nil, cleanup, err
+		}
+		var repos []restoreRepo
+		for i, repo := range manifest.Repositories {
+			archivePath := filepath.Join(filepath.Dir(source), manifestArchiveName(repo.Archives))
+			repoDir, err := extractRepository(archivePath, filepath.Join(tmpDir, strconv.Itoa(i)), decryption)
+			if err != nil {
+				return nil, cleanup, fmt.Errorf("failed to extract %s -> %v", archivePath, err)
+			}
+			repos = append(repos, restoreRepo{namespace: repo.Namespace, name: repo.Name, dir: repoDir, source: archivePath})
+		}
+		return repos, cleanup, nil
+
+	case strings.HasSuffix(base, bundleManifestSuffix):
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		chain := &bundleManifest{}
+		if err := json.Unmarshal(data, chain); err != nil {
+			return nil, cleanup, fmt.Errorf("invalid manifest %s -> %v", source, err)
+		}
+		repoDir, err := extractRepository(source, tmpDir, decryption)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		return []restoreRepo{{namespace: chain.Namespace, name: chain.Name, dir: repoDir, source: source}}, cleanup, nil
+	}
+
+	if err := restoreArchive(source, tmpDir, decryption); err != nil {
+		return nil, cleanup, err
+	}
+	// An archive of gitbackup has a single repository, the namespace
+	// being in its name, <namespace>-<name>-<time>
+	name := volumeSuffixRegexp.ReplaceAllString(base, "")
+	if m := archiveNameRegexp.FindStringSubmatch(name); m != nil {
+		if repoDir, err := getExtractedRepoDir(tmpDir); err == nil {
+			repoName := strings.TrimSuffix(filepath.Base(repoDir), ".git")
+			if namespace := strings.TrimSuffix(m[1], "-"+repoName); namespace != m[1] {
+				return []restoreRepo{{namespace: namespace, name: repoName, dir: repoDir, source: source}}, cleanup, nil
+			}
+		}
+	}
+	repos, err := walkRestoreRepos(tmpDir, source)
+	return repos, cleanup, err
+}
+
+// manifestArchiveName returns the name of the file a repository is
+// restored from among its archive files in a run manifest
+func manifestArchiveName(archives []archiveReport) string {
+	for _, a := range archives {
+		if strings.HasSuffix(a.Path, bundleManifestSuffix) {
+			return filepath.Base(a.Path)
+		}
+	}
+	if len(archives) == 0 {
+		return ""
+	}
+	return filepath.Base(archives[0].Path)
+}
+
+// walkRestoreRepos returns the clones and the mirrors under a directory
+// laid out as a backup directory, <namespace>/<name>[.git], or as a GitHub
+// migration archive, repositories/<owner>/<name>.git. The _orphaned
+// directory and the like, and the worktrees of the mirrors, are skipped.
+func walkRestoreRepos(root, source string) ([]restoreRepo, error) {
+	var repos []restoreRepo
+	add := func(repoDir string) {
+		rel, _ := filepath.Rel(root, repoDir)
+		rel = filepath.ToSlash(rel)
+		namespace := strings.TrimPrefix(path.Dir(rel), "repositories/")
+		if namespace == "." {
+			namespace = ""
+		}
+		// The repositories of an archive are named after it
+		src := repoDir
+		if source != root {
+			src = source + ":" + rel
+		}
+		repos = append(repos, restoreRepo{namespace: namespace, name: strings.TrimSuffix(path.Base(rel), ".git"), dir: repoDir, source: src})
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != root && strings.HasPrefix(d.Name(), "_") {
+			return filepath.SkipDir
+		}
+		if fi, err := os.Stat(filepath.Join(p, ".git")); err == nil {
+			// A .git file is a worktree or a submodule
+			if fi.IsDir() {
+				add(p)
+			}
+			return filepath.SkipDir
+		}
+		if isBareRepository(p) {
+			add(p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return repos, err
+}
+
+// isBareRepository returns true when the directory is a bare repository
+func isBareRepository(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
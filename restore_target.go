@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v34/github"
+	bitbucket "github.com/ktrysmt/go-bitbucket"
+	"github.com/xanzy/go-gitlab"
+)
+
+// Targets `gitbackup restore` pushes to besides the services backed up
+const (
+	restoreTargetBare  = "bare"
+	restoreTargetGitea = "gitea"
+)
+
+// restoreTarget is a host the backups are restored to
+type restoreTarget interface {
+	// ensureRepository returns the URL to push a repository to, along
+	// with whether it was missing, creating it unless with dryRun. The
+	// URL may be empty for a missing repository with dryRun.
+	ensureRepository(namespace, name string, dryRun bool) (string, bool, error)
+	// setDefaultBranch sets the default branch of a repository
+	setDefaultBranch(namespace, name, branch string) error
+}
+
+// newRestoreTarget returns the target of -target.service, at -target.url
+// if any. The credentials are those used for backing up the service, or
+// GITEA_TOKEN for Gitea.
+func newRestoreTarget(service, targetURL string) (restoreTarget, error) {
+	switch service {
+	case restoreTargetBare:
+		if targetURL == "" {
+			return nil, errors.New("Please specify the directory of the bare repositories with -target.url")
+		}
+		return &bareRestoreTarget{dir: targetURL}, nil
+	case restoreTargetGitea:
+		return newGiteaRestoreTarget(targetURL, os.Getenv("GITEA_TOKEN"))
+	case "github", "gitlab", "bitbucket":
+		client, err := newClient(service, targetURL)
+		if err != nil {
+			return nil, err
+		}
+		username, err := getUsername(client, service)
+		if err != nil {
+			return nil, err
+		}
+		switch service {
+		case "github":
+			return &githubRestoreTarget{client: client.(*github.Client), username: username, token: gitHostToken}, nil
+		case "gitlab":
+			return &gitlabRestoreTarget{client: client.(*gitlab.Client), username: username, token: gitHostToken}, nil
+		default:
+			return &bitbucketRestoreTarget{client: client.(*bitbucket.Client), username: username, token: gitHostToken}, nil
+		}
+	}
+	return nil, errors.New("Please specify a valid target service - github/gitlab/bitbucket/gitea/bare")
+}
+
+// withCredentials adds the credentials to an HTTPS clone URL
+func withCredentials(cloneURL, username, token string) string {
+	u, err := url.Parse(cloneURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return cloneURL
+	}
+	u.User = url.UserPassword(username, token)
+	return u.String()
+}
+
+// bareRestoreTarget restores the repositories as bare repositories in a
+// directory, <namespace>/<name>.git
+type bareRestoreTarget struct {
+	dir string
+}
+
+func (t *bareRestoreTarget) repoDir(namespace, name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(namespace), name+".git")
+}
+
+func (t *bareRestoreTarget) ensureRepository(namespace, name string, dryRun bool) (string, bool, error) {
+	repoDir := t.repoDir(namespace, name)
+	if _, err := os.Stat(repoDir); err == nil {
+		return repoDir, false, nil
+	}
+	if dryRun {
+		return repoDir, true, nil
+	}
+	if out, err := execCommand(gitCommand, "init", "--quiet", "--bare", repoDir).CombinedOutput(); err != nil {
+		return "", false, fmt.Errorf("%v: %s", err, out)
+	}
+	return repoDir, true, nil
+}
+
+func (t *bareRestoreTarget) setDefaultBranch(namespace, name, branch string) error {
+	if out, err := execCommand(gitCommand, "-C", t.repoDir(namespace, name), "symbolic-ref", "HEAD", "refs/heads/"+branch).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// githubRestoreTarget creates the missing repositories as private
+// repositories of the organization, or of the user
+type githubRestoreTarget struct {
+	client          *github.Client
+	username, token string
+}
+
+func (t *githubRestoreTarget) ensureRepository(namespace, name string, dryRun bool) (string, bool, error) {
+	ctx := context.Background()
+	repo, resp, err := t.client.Repositories.Get(ctx, namespace, name)
+	if err == nil {
+		return withCredentials(repo.GetCloneURL(), t.username, t.token), false, nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return "", false, err
+	}
+	if dryRun {
+		return "", true, nil
+	}
+	org := namespace
+	if strings.EqualFold(namespace, t.username) {
+		org = ""
+	}
+	repo, _, err = t.client.Repositories.Create(ctx, org, &github.Repository{Name: github.String(name), Private: github.Bool(true)})
+	if err != nil {
+		return "", false, err
+	}
+	return withCredentials(repo.GetCloneURL(), t.username, t.token), true, nil
+}
+
+func (t *githubRestoreTarget) setDefaultBranch(namespace, name, branch string) error {
+	_, _, err := t.client.Repositories.Edit(context.Background(), namespace, name, &github.Repository{DefaultBranch: github.String(branch)})
+	return err
+}
+
+// gitlabRestoreTarget creates the missing projects as private projects
+// of the group, or of the user
+type gitlabRestoreTarget struct {
+	client          *gitlab.Client
+	username, token string
+}
+
+func (t *gitlabRestoreTarget) ensureRepository(namespace, name string, dryRun bool) (string, bool, error) {
+	project, resp, err := t.client.Projects.GetProject(namespace+"/"+name, nil)
+	if err == nil {
+		return withCredentials(project.HTTPURLToRepo, t.username, t.token), false, nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return "", false, err
+	}
+	if dryRun {
+		return "", true, nil
+	}
+	opt := &gitlab.CreateProjectOptions{
+		Name:       gitlab.Ptr(name),
+		Path:       gitlab.Ptr(name),
+		Visibility: gitlab.Ptr(gitlab.PrivateVisibility),
+	}
+	if !strings.EqualFold(namespace, t.username) {
+		ns, _, err := t.client.Namespaces.GetNamespace(namespace)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to get the namespace %s -> %v", namespace, err)
+		}
+		opt.NamespaceID = gitlab.Ptr(ns.ID)
+	}
+	project, _, err = t.client.Projects.CreateProject(opt)
+	if err != nil {
+		return "", false, err
+	}
+	return withCredentials(project.HTTPURLToRepo, t.username, t.token), true, nil
+}
+
+func (t *gitlabRestoreTarget) setDefaultBranch(namespace, name, branch string) error {
+	_, _, err := t.client.Projects.EditProject(namespace+"/"+name, &gitlab.EditProjectOptions{DefaultBranch: gitlab.Ptr(branch)})
+	return err
+}
+
+// bitbucketRestoreTarget creates the missing repositories as private
+// repositories of the workspace
+type bitbucketRestoreTarget struct {
+	client          *bitbucket.Client
+	username, token string
+}
+
+func (t *bitbucketRestoreTarget) ensureRepository(namespace, name string, dryRun bool) (string, bool, error) {
+	opt := &bitbucket.RepositoryOptions{Owner: namespace, RepoSlug: name}
+	repo, err := t.client.Repositories.Repository.Get(opt)
+	if err == nil {
+		return withCredentials(bitbucketCloneLink(repo.Links, "https"), t.username, t.token), false, nil
+	}
+	var statusErr *bitbucket.UnexpectedResponseStatusError
+	if !errors.As(err, &statusErr) || !strings.HasPrefix(statusErr.Status, "404") {
+		return "", false, err
+	}
+	if dryRun {
+		return "", true, nil
+	}
+	opt.Scm = "git"
+	opt.IsPrivate = "true"
+	if repo, err = t.client.Repositories.Repository.Create(opt); err != nil {
+		return "", false, err
+	}
+	return withCredentials(bitbucketCloneLink(repo.Links, "https"), t.username, t.token), true, nil
+}
+
+func (t *bitbucketRestoreTarget) setDefaultBranch(namespace, name, branch string) error {
+	// Not supported by the client, the first branch pushed is the default
+	log.Printf("Set the default branch of %s/%s to %s in its settings on Bitbucket if needed\n", namespace, name, branch)
+	return nil
+}
+
+// giteaRestoreTarget creates the missing repositories as private
+// repositories of the organization, or of the user, with the API of
+// Gitea (or Forgejo)
+type giteaRestoreTarget struct {
+	baseURL         *url.URL
+	username, token string
+	client          *http.Client
+}
+
+// giteaRepository is the part of a repository of the Gitea API we use
+type giteaRepository struct {
+	CloneURL string `json:"clone_url"`
+}
+
+func newGiteaRestoreTarget(targetURL, token string) (*giteaRestoreTarget, error) {
+	if targetURL == "" {
+		return nil, errors.New("Please specify the URL of the Gitea host with -target.url")
+	}
+	if token == "" {
+		return nil, errors.New("GITEA_TOKEN environment variable not set")
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Gitea URL %s: %v", targetURL, err)
+	}
+	t := &giteaRestoreTarget{baseURL: u, token: token, client: &http.Client{Transport: &apiCallCounter{}}}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if _, err := t.do(http.MethodGet, "user", nil, &user); err != nil {
+		return nil, fmt.Errorf("failed to get the Gitea user -> %v", err)
+	}
+	t.username = user.Login
+	return t, nil
+}
+
+// do calls the Gitea API, returning the status of the response
+func (t *giteaRestoreTarget) do(method, apiPath string, body, out interface{}) (int, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+	u := t.baseURL.JoinPath("api/v1", apiPath)
+	req, err := http.NewRequest(method, u.String(), &reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "token "+t.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (t *giteaRestoreTarget) ensureRepository(namespace, name string, dryRun bool) (string, bool, error) {
+	var repo giteaRepository
+	status, err := t.do(http.MethodGet, "repos/"+namespace+"/"+name, nil, &repo)
+	if err == nil {
+		return withCredentials(repo.CloneURL, t.username, t.token), false, nil
+	}
+	if status != http.StatusNotFound {
+		return "", false, err
+	}
+	if dryRun {
+		return "", true, nil
+	}
+	createPath := "orgs/" + namespace + "/repos"
+	if strings.EqualFold(namespace, t.username) {
+		createPath = "user/repos"
+	}
+	if _, err := t.do(http.MethodPost, createPath, map[string]interface{}{"name": name, "private": true}, &repo); err != nil {
+		return "", false, err
+	}
+	return withCredentials(repo.CloneURL, t.username, t.token), true, nil
+}
+
+func (t *giteaRestoreTarget) setDefaultBranch(namespace, name, branch string) error {
+	_, err := t.do(http.MethodPatch, "repos/"+namespace+"/"+name, map[string]string{"default_branch": branch}, nil)
+	return err
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveTimeLayout is the layout of the timestamp in the archive names
+const archiveTimeLayout = "2006-01-02-15-04-05-0700"
+
+// archiveNameRegexp matches <namespace>-<repo>-<timestamp><suffix>
+var archiveNameRegexp = regexp.MustCompile(`^(.+)-([0-9]{4}-[0-9]{2}-[0-9]{2}-[0-9]{2}-[0-9]{2}-[0-9]{2}[+-][0-9]{4})(\..+)$`)
+
+var retentionDurationRegexp = regexp.MustCompile(`^(?:([0-9]+)y)?(?:([0-9]+)m)?(?:([0-9]+)w)?(?:([0-9]+)d)?(?:([0-9]+)h)?$`)
+
+// retentionPolicy holds the -retention.* rules. They are evaluated per
+// repository, and an archive is kept when any of them keeps it.
+type retentionPolicy struct {
+	keepLast    int
+	keepDaily   int
+	keepWeekly  int
+	keepMonthly int
+	keepWithin  retentionDuration
+	dryRun      bool
+}
+
+// retentionDuration is the duration of -retention.keep-within, in
+// calendar years, months and days
+type retentionDuration struct {
+	years, months, days, hours int
+}
+
+// parseRetentionDuration parses a duration such as 7d, 2w or 1y6m, with
+// the units y, m (months), w, d and h
+func parseRetentionDuration(s string) (retentionDuration, error) {
+	m := retentionDurationRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || m[0] == "" {
+		return retentionDuration{}, fmt.Errorf("invalid duration %q, e.g. 30d, 2w or 1y6m", s)
+	}
+	n := make([]int, len(m))
+	for i, v := range m[1:] {
+		n[i+1], _ = strconv.Atoi(v)
+	}
+	return retentionDuration{years: n[1], months: n[2], days: 7*n[3] + n[4], hours: n[5]}, nil
+}
+
+func (d retentionDuration) isZero() bool {
+	return d == retentionDuration{}
+}
+
+// before returns the time the duration before t
+func (d retentionDuration) before(t time.Time) time.Time {
+	return t.AddDate(-d.years, -d.months, -d.days).Add(-time.Duration(d.hours) * time.Hour)
+}
+
+// enabled returns true when any rule is set, otherwise nothing is pruned
+func (p retentionPolicy) enabled() bool {
+	return p.keepLast > 0 || p.keepDaily > 0 || p.keepWeekly > 0 || p.keepMonthly > 0 || !p.keepWithin.isZero()
+}
+
+// archiveSet is an archive along with its volumes, or a chain of bundles
+// along with its manifest
+type archiveSet struct {
+	repo  string
+	name  string
+	path  string
+	stamp string
+	time  time.Time
+	files []string
+}
+
+// groupArchives groups the files of the archives by repository, the
+// archives of each repository being sorted from the newest. The files
+// which aren't archives are left out. The files may be in subdirectories,
+// the archives of a repository being grouped whichever their directory.
+func groupArchives(files []string) map[string][]*archiveSet {
+	sets := map[string]*archiveSet{}
+	for _, file := range files {
+		if strings.HasSuffix(file, partialUploadSuffix) {
+			continue
+		}
+		// The volumes of an archive, and a manifest and its signature,
+		// go together
+		name := volumeSuffixRegexp.ReplaceAllString(path.Base(file), "")
+		if strings.HasPrefix(name, manifestPrefix) {
+			name = strings.TrimSuffix(name, manifestSignatureSuffix)
+		}
+		m := archiveNameRegexp.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		t, err := time.Parse(archiveTimeLayout, m[2])
+		if err != nil {
+			continue
+		}
+		p := path.Join(path.Dir(file), name)
+		set := sets[p]
+		if set == nil {
+			set = &archiveSet{repo: m[1], name: name, path: p, stamp: m[2], time: t}
+			sets[p] = set
+		}
+		set.files = append(set.files, file)
+	}
+
+	repos := map[string][]*archiveSet{}
+	for _, set := range sets {
+		repos[set.repo] = append(repos[set.repo], set)
+	}
+	for repo, archives := range repos {
+		sortArchives(archives)
+		archives = mergeBundleChains(archives)
+		for _, set := range archives {
+			sort.Strings(set.files)
+		}
+		sortArchives(archives)
+		repos[repo] = archives
+	}
+	return repos
+}
+
+// abandonedUploads returns the partial uploads which are not resumed: those
+// of the archives uploaded since, and those of repositories with a newer
+// archive, unless their prefix is ambiguous
+func abandonedUploads(files []string, ambiguous map[string]bool) []string {
+	complete := map[string]bool{}
+	for _, file := range files {
+		complete[file] = true
+	}
+	repos := groupArchives(files)
+	var abandoned []string
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file, partialUploadSuffix)
+		if !ok {
+			continue
+		}
+		if complete[name] {
+			abandoned = append(abandoned, file)
+			continue
+		}
+		m := archiveNameRegexp.FindStringSubmatch(volumeSuffixRegexp.ReplaceAllString(path.Base(name), ""))
+		if m == nil {
+			continue
+		}
+		t, err := time.Parse(archiveTimeLayout, m[2])
+		if err != nil {
+			continue
+		}
+		if archives := repos[m[1]]; !ambiguous[m[1]] && len(archives) > 0 && archives[0].time.After(t) {
+			abandoned = append(abandoned, file)
+		}
+	}
+	return abandoned
+}
+
+// sortArchives sorts archives from the newest
+func sortArchives(archives []*archiveSet) {
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].time.Equal(archives[j].time) {
+			return archives[i].path > archives[j].path
+		}
+		return archives[i].time.After(archives[j].time)
+	})
+}
+
+// mergeBundleChains merges the incremental bundles of the archives of a
+// repository, sorted from the newest, into the full bundle they extend,
+// along with the manifest of the chain, so that chains are only pruned as
+// a whole. A chain is as old as its last bundle.
+func mergeBundleChains(archives []*archiveSet) []*archiveSet {
+	var merged []*archiveSet
+	var chain *archiveSet
+	for i := len(archives) - 1; i >= 0; i-- {
+		archive := archives[i]
+		suffix := strings.TrimPrefix(archive.name, archive.repo+"-"+archive.stamp)
+		incremental := strings.HasPrefix(suffix, incrementalBundleSuffix)
+		// The full bundle, or the manifest of its chain
+		full := strings.HasPrefix(suffix, bundleSuffix)
+		switch {
+		case incremental && chain != nil:
+			chain.files = append(chain.files, archive.files...)
+			chain.time = archive.time
+		case full && chain != nil && archive.stamp == chain.stamp:
+			chain.files = append(chain.files, archive.files...)
+		case full:
+			chain = archive
+			merged = append(merged, archive)
+		default:
+			chain = nil
+			merged = append(merged, archive)
+		}
+	}
+	return merged
+}
+
+// prunedArchives returns the archives of a repository, sorted from the
+// newest, which no rule of the policy keeps. The last archive of a day,
+// week or month is kept for each of the last keep-daily days,
+// keep-weekly weeks and keep-monthly months with archives, in the time
+// zone they were written in, and keep-within is counted from the newest
+// archive, so that the archives aren't all pruned when the backups stop.
+func (p retentionPolicy) prunedArchives(archives []*archiveSet) []*archiveSet {
+	if !p.enabled() || len(archives) == 0 {
+		return nil
+	}
+	buckets := []struct {
+		keep   int
+		period func(t time.Time) string
+		last   string
+	}{
+		{keep: p.keepDaily, period: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{keep: p.keepWeekly, period: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{keep: p.keepMonthly, period: func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	within := p.keepWithin.before(archives[0].time)
+
+	var pruned []*archiveSet
+	for i, archive := range archives {
+		keep := i < p.keepLast || (!p.keepWithin.isZero() && !archive.time.Before(within))
+		for b := range buckets {
+			if buckets[b].keep == 0 {
+				continue
+			}
+			if period := buckets[b].period(archive.time); period != buckets[b].last {
+				buckets[b].last = period
+				buckets[b].keep--
+				keep = true
+			}
+		}
+		if !keep {
+			pruned = append(pruned, archive)
+		}
+	}
+	return pruned
+}
+
+// pruneArchives applies the retention policy to the archives of the git
+// host in the archive directory and in the storage they are uploaded to
+func pruneArchives(c *appConfig) error {
+	if !c.retention.enabled() || c.archiveDir == "" {
+		return nil
+	}
+	ambiguous, err := ambiguousArchivePrefixes()
+	if err != nil {
+		return err
+	}
+	gitHost := filepath.Base(c.backupDir)
+	entries, err := os.ReadDir(archiveHostDir(c))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, path.Join(gitHost, entry.Name()))
+		}
+	}
+	// The archives written before they were kept by git host, in the
+	// archive directory itself, are pruned along with the newer ones
+	legacy, err := legacyArchiveFiles(c.archiveDir, gitHost, ambiguous)
+	if err != nil {
+		return err
+	}
+	files = append(files, legacy...)
+	err = pruneArchiveFiles(c.retention, files, ambiguous, c.archiveDir, func(name string) error {
+		return os.Remove(filepath.Join(c.archiveDir, filepath.FromSlash(name)))
+	})
+	if err != nil || c.archiveStorage == nil {
+		return err
+	}
+
+	if files, err = c.archiveStorage.list(gitHost); err != nil {
+		return fmt.Errorf("failed to list the archives of %s -> %v", c.archiveStorage.location(gitHost), err)
+	}
+	return pruneArchiveFiles(c.retention, files, ambiguous, c.archiveStorage.location(gitHost), func(name string) error {
+		return c.archiveStorage.remove(gitHost + "/" + name)
+	})
+}
+
+// ambiguousArchivePrefixes returns the archive name prefixes shared by
+// several repositories of the git host, e.g. a-b/c and a/b-c, whose
+// archives can't be told apart
+func ambiguousArchivePrefixes() (map[string]bool, error) {
+	states, err := currentState.listRepos()
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]map[string]bool{}
+	for _, rs := range states {
+		prefix := archiveNamePrefix(rs.Namespace, rs.Name)
+		if keys[prefix] == nil {
+			keys[prefix] = map[string]bool{}
+		}
+		keys[prefix][string(stateKey(rs.repository()))] = true
+	}
+	ambiguous := map[string]bool{}
+	for prefix, repos := range keys {
+		if len(repos) > 1 {
+			ambiguous[prefix] = true
+		}
+	}
+	return ambiguous, nil
+}
+
+// legacyArchiveFiles returns the archives of the git host left in the
+// archive directory itself, as they were written before being kept by git
+// host. The archives of all the git hosts were written there, so only those
+// whose prefix is that of a single repository of the git host, and of no
+// repository of another git host backed up with the same state database,
+// are returned.
+func legacyArchiveFiles(archiveDir string, gitHost string, ambiguous map[string]bool) ([]string, error) {
+	hosts, err := currentState.listAllRepos()
+	if err != nil {
+		return nil, err
+	}
+	owned := map[string]bool{manifestPrefix + gitHost: true}
+	for _, rs := range hosts[gitHost] {
+		owned[archiveNamePrefix(rs.Namespace, rs.Name)] = true
+	}
+	for host, states := range hosts {
+		if host == gitHost {
+			continue
+		}
+		for _, rs := range states {
+			delete(owned, archiveNamePrefix(rs.Namespace, rs.Name))
+		}
+	}
+
+	entries, err := os.ReadDir(archiveDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), partialUploadSuffix)
+		name = volumeSuffixRegexp.ReplaceAllString(name, "")
+		if strings.HasPrefix(name, manifestPrefix) {
+			name = strings.TrimSuffix(name, manifestSignatureSuffix)
+		}
+		if m := archiveNameRegexp.FindStringSubmatch(name); m != nil && owned[m[1]] && !ambiguous[m[1]] {
+			files = append(files, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// pruneArchiveFiles removes the files of the archives the policy prunes,
+// and the abandoned partial uploads, or only logs them with
+// -retention.dry-run. The archives of the ambiguous prefixes are kept.
+func pruneArchiveFiles(p retentionPolicy, files []string, ambiguous map[string]bool, location string, remove func(name string) error) error {
+	for _, file := range abandonedUploads(files, ambiguous) {
+		if p.dryRun {
+			log.Printf("Would remove the partial upload %s/%s\n", location, file)
+			continue
+		}
+		if err := remove(file); err != nil {
+			return fmt.Errorf("failed to remove %s/%s -> %v", location, file, err)
+		}
+		log.Printf("Removed the partial upload %s/%s\n", location, file)
+	}
+
+	repos := groupArchives(files)
+	var names []string
+	for repo := range repos {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+	for _, repo := range names {
+		if ambiguous[repo] {
+			log.Printf("Not pruning the archives of %s in %s, several repositories have archives named %s-*\n", repo, location, repo)
+			continue
+		}
+		pruned := p.prunedArchives(repos[repo])
+		debugLogf("Keeping %d of the %d archives of %s in %s", len(repos[repo])-len(pruned), len(repos[repo]), repo, location)
+		for _, archive := range pruned {
+			if p.dryRun {
+				log.Printf("Would prune %s/%s\n", location, archive.path)
+				continue
+			}
+			for _, file := range archive.files {
+				if err := remove(file); err != nil {
+					return fmt.Errorf("failed to prune %s/%s -> %v", location, file, err)
+				}
+			}
+			log.Printf("Pruned %s/%s\n", location, archive.path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want retentionDuration
+		err  bool
+	}{
+		{in: "30d", want: retentionDuration{days: 30}},
+		{in: "2w", want: retentionDuration{days: 14}},
+		{in: "1y6m", want: retentionDuration{years: 1, months: 6}},
+		{in: "1m2w3d12h", want: retentionDuration{months: 1, days: 17, hours: 12}},
+		{in: "", err: true},
+		{in: "30", err: true},
+		{in: "6m1y", err: true},
+	}
+	for _, tc := range tests {
+		got, err := parseRetentionDuration(tc.in)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("parseRetentionDuration(%q) = %+v, %v, expected %+v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestGroupArchives(t *testing.T) {
+	repos := groupArchives([]string{
+		"org-my-app-2024-01-01-00-00-00+0000.tar.zst",
+		"org-my-app-2024-01-02-00-00-00+0000.7z.001",
+		"org-my-app-2024-01-02-00-00-00+0000.7z.002",
+		"org-lib-2024-01-03-10-00-00-0500.tar.gz.age",
+		"org-lib-2024-01-04-00-00-00+0000.zip.part",
+		"README.txt",
+	})
+	if len(repos) != 2 || len(repos["org-my-app"]) != 2 || len(repos["org-lib"]) != 1 {
+		t.Fatalf("Unexpected archives %+v", repos)
+	}
+	newest := repos["org-my-app"][0]
+	if newest.name != "org-my-app-2024-01-02-00-00-00+0000.7z" || len(newest.files) != 2 {
+		t.Errorf("Expected the volumes of the newest archive first, got %+v", newest)
+	}
+	if want := time.Date(2024, 1, 3, 15, 0, 0, 0, time.UTC); !repos["org-lib"][0].time.Equal(want) {
+		t.Errorf("Expected the archive written at %s, got %s", want, repos["org-lib"][0].time)
+	}
+}
+
+func TestAbandonedUploads(t *testing.T) {
+	abandoned := abandonedUploads([]string{
+		// Uploaded since
+		"org-app-2024-01-01-00-00-00+0000.tar.zst",
+		"org-app-2024-01-01-00-00-00+0000.tar.zst.part",
+		// Older than the newest archive
+		"org-app-2023-12-31-00-00-00+0000.7z.002.part",
+		// The newest, which may be resumed
+		"org-lib-2024-01-01-00-00-00+0000.tar.zst",
+		"org-lib-2024-01-02-00-00-00+0000.tar.zst.part",
+		"org-new-2024-01-02-00-00-00+0000.tar.zst.part",
+		// Which may be of another repository
+		"a-b-c-2024-01-01-00-00-00+0000.tar.zst",
+		"a-b-c-2023-12-31-00-00-00+0000.tar.zst.part",
+	}, map[string]bool{"a-b-c": true})
+	want := []string{
+		"org-app-2024-01-01-00-00-00+0000.tar.zst.part",
+		"org-app-2023-12-31-00-00-00+0000.7z.002.part",
+	}
+	if !reflect.DeepEqual(abandoned, want) {
+		t.Errorf("Expected the abandoned uploads %v, got %v", want, abandoned)
+	}
+}
+
+func TestPrunedArchives(t *testing.T) {
+	// An archive every day at noon from 2024-01-01 to 2024-03-31
+	var archives []*archiveSet
+	for d := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC); d.Year() == 2024; d = d.AddDate(0, 0, -1) {
+		archives = append(archives, &archiveSet{name: d.Format("2006-01-02"), time: d})
+	}
+	// Along with a second one on the last day
+	last := time.Date(2024, 3, 31, 18, 0, 0, 0, time.UTC)
+	archives = append([]*archiveSet{{name: "2024-03-31-evening", time: last}}, archives...)
+
+	kept := func(p retentionPolicy) []string {
+		pruned := map[*archiveSet]bool{}
+		for _, a := range p.prunedArchives(archives) {
+			pruned[a] = true
+		}
+		var names []string
+		for _, a := range archives {
+			if !pruned[a] {
+				names = append(names, a.name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		want   []string
+	}{
+		{
+			name:   "no rules",
+			policy: retentionPolicy{},
+			want:   kept(retentionPolicy{keepLast: len(archives)}),
+		},
+		{
+			name:   "keep-last",
+			policy: retentionPolicy{keepLast: 3},
+			want:   []string{"2024-03-30", "2024-03-31", "2024-03-31-evening"},
+		},
+		{
+			name:   "keep-daily",
+			policy: retentionPolicy{keepDaily: 3},
+			want:   []string{"2024-03-29", "2024-03-30", "2024-03-31-evening"},
+		},
+		{
+			// Sundays, the last days of the ISO weeks
+			name:   "keep-weekly",
+			policy: retentionPolicy{keepWeekly: 3},
+			want:   []string{"2024-03-17", "2024-03-24", "2024-03-31-evening"},
+		},
+		{
+			name:   "keep-monthly",
+			policy: retentionPolicy{keepMonthly: 6},
+			want:   []string{"2024-01-31", "2024-02-29", "2024-03-31-evening"},
+		},
+		{
+			name:   "keep-within",
+			policy: retentionPolicy{keepWithin: retentionDuration{days: 2}},
+			want:   []string{"2024-03-30", "2024-03-31", "2024-03-31-evening"},
+		},
+		{
+			name:   "combined",
+			policy: retentionPolicy{keepLast: 1, keepDaily: 2, keepWeekly: 2, keepMonthly: 2},
+			want:   []string{"2024-02-29", "2024-03-24", "2024-03-30", "2024-03-31-evening"},
+		},
+	}
+	for _, tc := range tests {
+		if got := kept(tc.policy); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: kept %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPruneArchives(t *testing.T) {
+	fake, storage := newFakeS3Storage(t, "")
+
+	archiveDir := t.TempDir()
+	hostDir := filepath.Join(archiveDir, "github.com")
+	os.MkdirAll(hostDir, 0755)
+	names := []string{
+		"ns-r1-2024-01-01-00-00-00+0000.tar.zst",
+		"ns-r1-2024-01-02-00-00-00+0000.tar.zst.001",
+		"ns-r1-2024-01-02-00-00-00+0000.tar.zst.002",
+		"ns-r1-2024-01-03-00-00-00+0000.tar.zst",
+		"ns-r2-2024-01-01-00-00-00+0000.tar.zst",
+		"notes.txt",
+	}
+	for _, name := range names {
+		file := filepath.Join(hostDir, name)
+		os.WriteFile(file, []byte(name), 0644)
+		if err := storage.upload(file, "github.com/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.objects["backups/gitlab.com/ns-r1-2024-01-01-00-00-00+0000.tar.zst"] = &fakeS3Object{}
+	otherHost := filepath.Join(archiveDir, "gitlab.com", "ns-r1-2024-01-01-00-00-00+0000.tar.zst")
+	os.MkdirAll(filepath.Dir(otherHost), 0755)
+	os.WriteFile(otherHost, []byte("archive"), 0644)
+
+	c := &appConfig{
+		backupDir:      "/backups/github.com",
+		archiveDir:     archiveDir,
+		archiveStorage: storage,
+		retention:      retentionPolicy{keepLast: 1, dryRun: true},
+	}
+	if err := pruneArchives(c); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(hostDir); len(entries) != len(names) || len(fake.objects) != len(names)+1 {
+		t.Fatalf("Expected nothing to be pruned in a dry run")
+	}
+
+	c.retention.dryRun = false
+	if err := pruneArchives(c); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"notes.txt",
+		"ns-r1-2024-01-03-00-00-00+0000.tar.zst",
+		"ns-r2-2024-01-01-00-00-00+0000.tar.zst",
+	}
+	var local []string
+	entries, _ := os.ReadDir(hostDir)
+	for _, entry := range entries {
+		local = append(local, entry.Name())
+	}
+	if !reflect.DeepEqual(local, want) {
+		t.Errorf("Expected the local archives %v, got %v", want, local)
+	}
+	remote, err := storage.list("github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(remote)
+	if !reflect.DeepEqual(remote, want) {
+		t.Errorf("Expected the uploaded archives %v, got %v", want, remote)
+	}
+	if _, ok := fake.objects["backups/gitlab.com/ns-r1-2024-01-01-00-00-00+0000.tar.zst"]; !ok {
+		t.Errorf("Expected the archives of the other git hosts to be left alone")
+	}
+	if _, err := os.Stat(otherHost); err != nil {
+		t.Errorf("Expected the local archives of the other git hosts to be left alone")
+	}
+}
+
+func TestPruneAmbiguousArchives(t *testing.T) {
+	currentState = newTestStateStore(t)
+	t.Cleanup(func() { currentState = nil })
+	for _, repo := range []*Repository{{ID: "1", Namespace: "a-b", Name: "c"}, {ID: "2", Namespace: "a", Name: "b-c"}} {
+		if err := currentState.updateRepo(repo, func(rs *repoState) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiveDir := t.TempDir()
+	hostDir := filepath.Join(archiveDir, "github.com")
+	os.MkdirAll(hostDir, 0755)
+	names := []string{
+		"a-b-c-2024-01-01-00-00-00+0000.tar.zst",
+		"a-b-c-2024-01-02-00-00-00+0000.tar.zst",
+		"x-y-2024-01-01-00-00-00+0000.tar.zst",
+		"x-y-2024-01-02-00-00-00+0000.tar.zst",
+	}
+	for _, name := range names {
+		os.WriteFile(filepath.Join(hostDir, name), []byte(name), 0644)
+	}
+	c := &appConfig{
+		backupDir:  "/backups/github.com",
+		archiveDir: archiveDir,
+		retention:  retentionPolicy{keepLast: 1},
+	}
+	if err := pruneArchives(c); err != nil {
+		t.Fatal(err)
+	}
+	var local []string
+	entries, _ := os.ReadDir(hostDir)
+	for _, entry := range entries {
+		local = append(local, entry.Name())
+	}
+	if want := append(names[:2:2], names[3]); !reflect.DeepEqual(local, want) {
+		t.Errorf("Expected the archives of a-b/c and a/b-c to be kept, %v, got %v", want, local)
+	}
+}
+
+func TestPruneLegacyArchives(t *testing.T) {
+	currentState = newTestStateStore(t)
+	t.Cleanup(func() { currentState = nil })
+	for _, repo := range []*Repository{{ID: "1", Namespace: "ns", Name: "r1"}, {ID: "2", Namespace: "ns", Name: "shared"}} {
+		if err := currentState.updateRepo(repo, func(rs *repoState) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitlab, err := openStateStore(currentState.path, "gitlab.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gitlab.updateRepo(&Repository{ID: "3", Namespace: "ns", Name: "shared"}, func(rs *repoState) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	archiveDir := t.TempDir()
+	hostDir := filepath.Join(archiveDir, "github.com")
+	os.MkdirAll(hostDir, 0755)
+	os.WriteFile(filepath.Join(hostDir, "ns-r1-2024-01-03-00-00-00+0000.tar.zst"), []byte("archive"), 0644)
+	legacy := []string{
+		"MANIFEST-github.com-2024-01-01-00-00-00+0000.json",
+		"MANIFEST-gitlab.com-2024-01-01-00-00-00+0000.json",
+		"ns-r1-2024-01-01-00-00-00+0000.tar.zst",
+		"ns-r1-2024-01-02-00-00-00+0000.7z.001",
+		"ns-shared-2024-01-01-00-00-00+0000.tar.zst",
+		"ns-shared-2024-01-02-00-00-00+0000.tar.zst",
+		"other-repo-2024-01-01-00-00-00+0000.tar.zst",
+		"other-repo-2024-01-02-00-00-00+0000.tar.zst",
+	}
+	for _, name := range legacy {
+		os.WriteFile(filepath.Join(archiveDir, name), []byte(name), 0644)
+	}
+	os.WriteFile(filepath.Join(archiveDir, "MANIFEST-github.com-2024-01-02-00-00-00+0000.json"), []byte("manifest"), 0644)
+
+	c := &appConfig{
+		backupDir:  "/backups/github.com",
+		archiveDir: archiveDir,
+		retention:  retentionPolicy{keepLast: 1},
+	}
+	if err := pruneArchives(c); err != nil {
+		t.Fatal(err)
+	}
+	var local []string
+	entries, _ := os.ReadDir(archiveDir)
+	for _, entry := range entries {
+		local = append(local, entry.Name())
+	}
+	want := []string{
+		"MANIFEST-github.com-2024-01-02-00-00-00+0000.json",
+		"MANIFEST-gitlab.com-2024-01-01-00-00-00+0000.json",
+		"github.com",
+		"ns-shared-2024-01-01-00-00-00+0000.tar.zst",
+		"ns-shared-2024-01-02-00-00-00+0000.tar.zst",
+		"other-repo-2024-01-01-00-00-00+0000.tar.zst",
+		"other-repo-2024-01-02-00-00-00+0000.tar.zst",
+	}
+	if !reflect.DeepEqual(local, want) {
+		t.Errorf("Expected only the legacy archives of the repositories of the git host to be pruned, %v, got %v", want, local)
+	}
+	if _, err := os.Stat(filepath.Join(hostDir, "ns-r1-2024-01-03-00-00-00+0000.tar.zst")); err != nil {
+		t.Errorf("Expected the newest archive to be kept")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// The server side encryptions of -storage.s3.sse
+const (
+	s3SSEAES256 = "AES256"
+	s3SSEKMS    = "aws:kms"
+)
+
+// s3Config holds the -storage.s3.* options
+type s3Config struct {
+	endpoint    string
+	bucket      string
+	prefix      string
+	region      string
+	insecure    bool
+	sse         string
+	sseKMSKeyID string
+	partSize    int64
+	// transport replaces the default HTTP transport, in tests
+	transport http.RoundTripper
+}
+
+// s3Storage uploads the archives to an S3 compatible object storage. The
+// credentials are read from the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or
+// MINIO_ACCESS_KEY/MINIO_SECRET_KEY environment variables, the AWS
+// credentials file or the IAM role of the host.
+type s3Storage struct {
+	client *minio.Client
+	config s3Config
+	sse    encrypt.ServerSide
+}
+
+func newS3Storage(config s3Config) (*s3Storage, error) {
+	if config.bucket == "" {
+		return nil, errors.New("no -storage.s3.bucket to upload the archives to")
+	}
+	var sse encrypt.ServerSide
+	switch config.sse {
+	case "":
+	case s3SSEAES256:
+		sse = encrypt.NewSSE()
+	case s3SSEKMS:
+		var err error
+		if sse, err = encrypt.NewSSEKMS(config.sseKMSKeyID, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown server side encryption %s, expected %s or %s", config.sse, s3SSEAES256, s3SSEKMS)
+	}
+
+	client, err := minio.New(config.endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure:    !config.insecure,
+		Region:    config.region,
+		Transport: config.transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{client: client, config: config, sse: sse}, nil
+}
+
+func (s *s3Storage) objectName(key string) string {
+	return strings.TrimPrefix(path.Join(s.config.prefix, key), "/")
+}
+
+func (s *s3Storage) location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.config.bucket, s.objectName(key))
+}
+
+// upload uploads a file, in parts of -storage.s3.part-size when larger,
+// each part being checked by the server against its MD5. The object is
+// then checked to have the size and, unless encrypted with KMS, the ETag
+// of the file: its MD5, or the MD5 of the MD5s of its parts. The SHA-256
+// of the file is recorded in the metadata of the object, to check the
+// downloads against.
+func (s *s3Storage) upload(localPath, key string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sha256Hash := sha256.New()
+	etag, err := s3ETag(io.TeeReader(f, sha256Hash), info.Size(), s.config.partSize)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	objectName := s.objectName(key)
+	_, err = s.client.PutObject(ctx, s.config.bucket, objectName, f, info.Size(), minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		UserMetadata:         map[string]string{"sha256": hex.EncodeToString(sha256Hash.Sum(nil))},
+		ServerSideEncryption: s.sse,
+		PartSize:             uint64(s.config.partSize),
+		SendContentMd5:       true,
+	})
+	if err != nil {
+		return err
+	}
+
+	object, err := s.client.StatObject(ctx, s.config.bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+	if object.Size != info.Size() {
+		return fmt.Errorf("uploaded %d bytes, %s has %d", info.Size(), s.location(key), object.Size)
+	}
+	// The ETag of an object encrypted with KMS is not derived from its MD5
+	if s.config.sse != s3SSEKMS {
+		if objectETag := strings.Trim(object.ETag, `"`); objectETag != etag {
+			return fmt.Errorf("the ETag of %s is %s, expected %s", s.location(key), objectETag, etag)
+		}
+	}
+	return nil
+}
+
+// s3ETag computes the ETag S3 gives to an object uploaded with PutObject:
+// the MD5 of its content, or when uploaded in parts the MD5 of the MD5s of
+// the parts followed by the number of parts
+func s3ETag(r io.Reader, size, partSize int64) (string, error) {
+	if size <= partSize {
+		hash := md5.New()
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+	parts, partSize, _, err := minio.OptimalPartInfo(size, uint64(partSize))
+	if err != nil {
+		return "", err
+	}
+	var sums []byte
+	for i := 0; i < parts; i++ {
+		hash := md5.New()
+		if _, err := io.CopyN(hash, r, partSize); err != nil && err != io.EOF {
+			return "", err
+		}
+		sums = hash.Sum(sums)
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+func (s *s3Storage) list(dir string) ([]string, error) {
+	var names []string
+	// Cancelled when returning early, to stop listing
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.config.bucket, minio.ListObjectsOptions{
+		Prefix: s.objectName(dir) + "/",
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if !strings.HasSuffix(object.Key, "/") {
+			names = append(names, path.Base(object.Key))
+		}
+	}
+	return names, nil
+}
+
+func (s *s3Storage) remove(key string) error {
+	return s.client.RemoveObject(context.Background(), s.config.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3Object is an object stored by fakeS3
+type fakeS3Object struct {
+	data     []byte
+	etag     string
+	metadata http.Header
+}
+
+// fakeS3 is an in-process S3 server, with just enough of the API for the
+// uploads of the archives
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+	uploads map[string]map[int][]byte
+	// uploadMetadata holds the metadata of the multipart uploads
+	uploadMetadata map[string]http.Header
+	// corrupt alters the next stored object, to fail its verification
+	corrupt bool
+}
+
+func newFakeS3Storage(t *testing.T, prefix string) (*fakeS3, *s3Storage) {
+	fake := &fakeS3{objects: map[string]*fakeS3Object{}, uploads: map[string]map[int][]byte{}, uploadMetadata: map[string]http.Header{}}
+	ts := httptest.NewTLSServer(fake)
+	t.Cleanup(ts.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+
+	storage, err := newS3Storage(s3Config{
+		endpoint:  strings.TrimPrefix(ts.URL, "https://"),
+		bucket:    "backups",
+		prefix:    prefix,
+		region:    "us-east-1",
+		partSize:  5 * 1024 * 1024,
+		transport: ts.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, storage
+}
+
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = map[int][]byte{}
+		f.uploadMetadata[uploadID] = r.Header.Clone()
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadID)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+			sum := md5.Sum(data)
+			if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+				http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+				return
+			}
+		}
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+			f.uploads[uploadID][partNumber] = data
+		} else {
+			f.store(key, data, md5ETag(data), r.Header)
+		}
+		w.Header().Set("ETag", `"`+md5ETag(data)+`"`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data, sums []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+			sum := md5.Sum(parts[n])
+			sums = append(sums, sum[:]...)
+		}
+		etag := fmt.Sprintf("%s-%d", md5ETag(sums), len(numbers))
+		f.store(key, data, etag, f.uploadMetadata[query.Get("uploadId")])
+		bucket, object, _ := strings.Cut(key, "/")
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, bucket, object, etag)
+	case r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range object.metadata {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("ETag", `"`+object.etag+`"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		prefix := key + query.Get("prefix")
+		var keys []string
+		for k := range f.objects {
+			// Without the "subdirectories", as with the delimiter /
+			if strings.HasPrefix(k, prefix) && !strings.Contains(k[len(prefix):], "/") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>", strings.TrimSuffix(key, "/"), len(keys))
+		for _, k := range keys {
+			_, object, _ := strings.Cut(k, "/")
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"%s"</ETag><LastModified>%s</LastModified></Contents>`, object, len(f.objects[k].data), f.objects[k].etag, time.Now().UTC().Format(time.RFC3339))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) store(key string, data []byte, etag string, header http.Header) {
+	metadata := http.Header{}
+	for k, v := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			metadata[k] = v
+		}
+	}
+	if f.corrupt {
+		data = append(data, 0)
+		f.corrupt = false
+	}
+	f.objects[key] = &fakeS3Object{data: data, etag: etag, metadata: metadata}
+}
+
+func TestS3StorageUpload(t *testing.T) {
+	fake, storage := newFakeS3Storage(t, "gitbackup/")
+	dir := t.TempDir()
+	small := filepath.Join(dir, "ns-r1.tar.zst")
+	os.WriteFile(small, []byte("archive"), 0644)
+	// Large enough to be uploaded in 3 parts
+	large := filepath.Join(dir, "ns-r2.tar.zst")
+	os.WriteFile(large, bytes.Repeat([]byte("0123456789abcdef"), 11*1024*1024/16), 0644)
+
+	for _, file := range []string{small, large} {
+		key := "github.com/" + filepath.Base(file)
+		if err := storage.upload(file, key); err != nil {
+			t.Fatalf("Failed to upload %s: %v", file, err)
+		}
+		data, _ := os.ReadFile(file)
+		object := fake.objects["backups/gitbackup/"+key]
+		if object == nil || !bytes.Equal(object.data, data) {
+			t.Errorf("Expected %s to be uploaded to backups/gitbackup/%s", file, key)
+		}
+	}
+	if etag := fake.objects["backups/gitbackup/github.com/ns-r2.tar.zst"].etag; !strings.HasSuffix(etag, "-3") {
+		t.Errorf("Expected a multipart upload of 3 parts, got the ETag %s", etag)
+	}
+	if location := storage.location("github.com/ns-r1.tar.zst"); location != "s3://backups/gitbackup/github.com/ns-r1.tar.zst" {
+		t.Errorf("Unexpected location %s", location)
+	}
+
+	fake.corrupt = true
+	if err := storage.upload(small, "github.com/ns-r1.tar.zst"); err == nil {
+		t.Errorf("Expected the verification of an altered upload to fail")
+	}
+}
+
+func TestUploadArchives(t *testing.T) {
+	_, storage := newFakeS3Storage(t, "")
+	saved := appCfg
+	t.Cleanup(func() { appCfg = saved })
+	appCfg.backupDir = "/backups/github.com"
+	appCfg.archiveStorage = storage
+	appCfg.storageDeleteLocal = true
+
+	archive := filepath.Join(t.TempDir(), "ns-r1.tar.zst")
+	os.WriteFile(archive, []byte("archive"), 0644)
+	archives := []archiveReport{{Path: archive, Size: 7}}
+	if err := uploadArchives(archives); err != nil {
+		t.Fatal(err)
+	}
+	if archives[0].Location != "s3://backups/github.com/ns-r1.tar.zst" {
+		t.Errorf("Expected the location in the report, got %+v", archives[0])
+	}
+	if _, err := os.Stat(archive); err == nil {
+		t.Errorf("Expected the local archive to be deleted")
+	}
+}
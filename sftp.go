@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpKeyPassphraseEnv is the environment variable with the passphrase of
+// the private key of -storage.sftp.key
+const sftpKeyPassphraseEnv = "GITBACKUP_SFTP_KEY_PASSPHRASE"
+
+// partialUploadSuffix is added to the name of the archives while they
+// are uploaded, they are renamed once complete
+const partialUploadSuffix = ".part"
+
+// sftpConfig holds the -storage.sftp.* options
+type sftpConfig struct {
+	host       string
+	user       string
+	dir        string
+	keyFile    string
+	knownHosts string
+}
+
+// sftpStorage uploads the archives to a directory of an SFTP server,
+// authenticating with a private key and verifying the host key against
+// a known_hosts file
+type sftpStorage struct {
+	config       sftpConfig
+	clientConfig *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+func newSFTPStorage(config sftpConfig) (*sftpStorage, error) {
+	if config.host == "" || config.user == "" || config.keyFile == "" {
+		return nil, errors.New("the SFTP storage needs -storage.sftp.host, -storage.sftp.user and -storage.sftp.key")
+	}
+	if _, _, err := net.SplitHostPort(config.host); err != nil {
+		config.host = net.JoinHostPort(config.host, "22")
+	}
+	key, err := os.ReadFile(config.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if passphrase := os.Getenv(sftpKeyPassphraseEnv); passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP key %s: %v", config.keyFile, err)
+	}
+
+	knownHostsFile := config.knownHosts
+	if knownHostsFile == "" {
+		homeDir, err := gethomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the known hosts -> %v", err)
+	}
+
+	return &sftpStorage{
+		config: config,
+		clientConfig: &ssh.ClientConfig{
+			User:            config.user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// connect returns the connection to the server, shared by the uploads,
+// connecting again after it was lost
+func (s *sftpStorage) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		if _, err := s.client.Getwd(); err == nil {
+			return s.client, nil
+		}
+		s.client.Close()
+		s.client = nil
+	}
+	conn, err := ssh.Dial("tcp", s.config.host, s.clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.client = client
+	return client, nil
+}
+
+func (s *sftpStorage) location(key string) string {
+	return fmt.Sprintf("sftp://%s@%s%s", s.config.user, s.config.host, path.Join("/", s.config.dir, key))
+}
+
+// upload uploads a file to <key>.part, resuming a previous upload of the
+// same file, and renames it to key once its SHA-256 is verified
+func (s *sftpStorage) upload(localPath, key string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sum, err := hashReader(f)
+	if err != nil {
+		return err
+	}
+
+	remotePath := path.Join(s.config.dir, key)
+	partPath := remotePath + partialUploadSuffix
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+
+	var offset int64
+	if partInfo, err := client.Stat(partPath); err == nil && resumablePart(partInfo.Size(), partInfo.ModTime(), info) {
+		offset = partInfo.Size()
+		debugLogf("Resuming the upload of %s at %d bytes", localPath, offset)
+	}
+	err = s.uploadPart(client, f, partPath, offset)
+	if err == nil {
+		err = s.verifyPart(client, partPath, s.location(key)+partialUploadSuffix, info.Size(), sum)
+	}
+	if err != nil && offset > 0 {
+		debugLogf("Could not resume the upload of %s, uploading it again: %v", localPath, err)
+		if err = s.uploadPart(client, f, partPath, 0); err == nil {
+			err = s.verifyPart(client, partPath, s.location(key)+partialUploadSuffix, info.Size(), sum)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return client.PosixRename(partPath, remotePath)
+}
+
+// uploadPart writes the file to partPath from offset, keeping what is
+// before it
+func (s *sftpStorage) uploadPart(client *sftp.Client, f *os.File, partPath string, offset int64) error {
+	remote, err := client.OpenFile(partPath, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if err := remote.Truncate(offset); err != nil {
+		remote.Close()
+		return err
+	}
+	if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+		remote.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		remote.Close()
+		return err
+	}
+	if _, err := remote.ReadFrom(f); err != nil {
+		remote.Close()
+		return err
+	}
+	return remote.Close()
+}
+
+// verifyPart checks that partPath has the size and the SHA-256 of the
+// file, and removes it when it has not
+func (s *sftpStorage) verifyPart(client *sftp.Client, partPath, location string, size int64, sum string) error {
+	partInfo, err := client.Stat(partPath)
+	if err != nil {
+		return err
+	}
+	if partInfo.Size() != size {
+		client.Remove(partPath)
+		return fmt.Errorf("uploaded %d bytes, %s has %d", size, location, partInfo.Size())
+	}
+	remote, err := client.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	partSum, err := hashReader(remote)
+	if err != nil {
+		return err
+	}
+	if partSum != sum {
+		client.Remove(partPath)
+		return fmt.Errorf("the SHA-256 of %s is %s, expected %s", location, partSum, sum)
+	}
+	return nil
+}
+
+func (s *sftpStorage) list(dir string) ([]string, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := client.ReadDir(path.Join(s.config.dir, dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *sftpStorage) remove(key string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return client.Remove(path.Join(s.config.dir, key))
+}
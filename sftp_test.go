@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestSFTPServer serves SFTP to the holder of the returned key, and
+// returns the storage config to use it
+func newTestSFTPServer(t *testing.T) sftpConfig {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	userPublic, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	userSSHPublic, _ := ssh.NewPublicKey(userPublic)
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(userSSHPublic.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, serverConfig)
+		}
+	}()
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	block, _ := ssh.MarshalPrivateKey(userKey, "")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{listener.Addr().String()}, hostSigner.PublicKey())+"\n"), 0644)
+
+	return sftpConfig{
+		host:       listener.Addr().String(),
+		user:       "backup",
+		dir:        t.TempDir(),
+		keyFile:    keyFile,
+		knownHosts: knownHostsFile,
+	}
+}
+
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+	}
+}
+
+func TestSFTPStorageUpload(t *testing.T) {
+	config := newTestSFTPServer(t)
+	storage, err := newSFTPStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "ns-r1.tar.zst")
+	os.WriteFile(archive, []byte("0123456789"), 0644)
+
+	// An interrupted upload is resumed
+	remoteDir := filepath.Join(config.dir, "github.com")
+	os.MkdirAll(remoteDir, 0755)
+	os.WriteFile(filepath.Join(remoteDir, "ns-r1.tar.zst.part"), []byte("01234"), 0644)
+
+	if err := storage.upload(archive, "github.com/ns-r1.tar.zst"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(remoteDir, "ns-r1.tar.zst")); string(data) != "0123456789" {
+		t.Errorf("Expected the archive to be uploaded, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "ns-r1.tar.zst.part")); err == nil {
+		t.Errorf("Expected the partial upload to be renamed")
+	}
+
+	// A partial upload of another file is uploaded again, whether older
+	// than the file or with other content
+	stale := filepath.Join(remoteDir, "ns-r1.tar.zst.part")
+	for _, modTime := range []time.Time{time.Now().Add(-time.Hour), time.Now().Add(time.Hour)} {
+		os.WriteFile(stale, []byte("abcde"), 0644)
+		os.Chtimes(stale, modTime, modTime)
+		if err := storage.upload(archive, "github.com/ns-r1.tar.zst"); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(remoteDir, "ns-r1.tar.zst")); string(data) != "0123456789" {
+			t.Errorf("Expected the partial upload of another file to be discarded, got %q", data)
+		}
+	}
+
+	if names, err := storage.list("github.com"); err != nil || !reflect.DeepEqual(names, []string{"ns-r1.tar.zst"}) {
+		t.Errorf("Expected the archive to be listed, got %v, %v", names, err)
+	}
+	if err := storage.remove("github.com/ns-r1.tar.zst"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := storage.list("github.com"); err != nil || len(names) != 0 {
+		t.Errorf("Expected the archive to be removed, got %v, %v", names, err)
+	}
+	if names, err := storage.list("gitlab.com"); err != nil || len(names) != 0 {
+		t.Errorf("Expected no archives of another git host, got %v, %v", names, err)
+	}
+
+	// The host key is verified
+	os.WriteFile(config.knownHosts, nil, 0644)
+	storage, err = newSFTPStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.upload(archive, "github.com/ns-r1.tar.zst"); err == nil {
+		t.Errorf("Expected an unknown host to be rejected")
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultStateDBFilename = "state.db"
+
+// stateLockTimeout is how long a transaction waits for another process,
+// e.g. the webhook receiver and a scheduled run, to release the database
+const stateLockTimeout = 30 * time.Second
+
+var (
+	stateRepositoriesBucket = []byte("repositories")
+	stateRunsBucket         = []byte("runs")
+)
+
+// currentState is the state store of the backup run in progress, if any.
+// All the methods are safe to call on a nil store.
+var currentState *stateStore
+
+// stateStore persists the state of every backed up repository, keyed by
+// git host and repository ID, in an embedded bbolt database. bbolt locks
+// the database file while it is open, so that it is opened for every
+// transaction rather than for the whole run, letting the processes which
+// share it take turns.
+type stateStore struct {
+	path    string
+	gitHost string
+	// mu serializes the transactions of the process
+	mu sync.Mutex
+}
+
+// repoState is what we know about a repository from the previous runs
+type repoState struct {
+	ID            string            `json:"id"`
+	Namespace     string            `json:"namespace"`
+	Name          string            `json:"name"`
+	Path          string            `json:"path"`
+	LastBackupAt  time.Time         `json:"last_backup_at"`
+	LastPushedAt  *time.Time        `json:"last_pushed_at,omitempty"`
+	LastAttemptAt time.Time         `json:"last_attempt_at"`
+	Refs          map[string]string `json:"refs,omitempty"`
+	Archives      []string          `json:"archives,omitempty"`
+	// ArchivedAt and ArchiveFingerprint are the time and the fingerprint
+	// of the refs of the last archive
+	ArchivedAt         *time.Time `json:"archived_at,omitempty"`
+	ArchiveFingerprint string     `json:"archive_fingerprint,omitempty"`
+	// BundleChain is the chain of bundles the next incremental bundle
+	// extends
+	BundleChain *bundleManifest `json:"bundle_chain,omitempty"`
+	Failures    int             `json:"failures"`
+	LastError   string          `json:"last_error,omitempty"`
+	// OrphanedAt is set when the repository is gone upstream
+	OrphanedAt *time.Time `json:"orphaned_at,omitempty"`
+	// Superproject is set for submodules, which are not listed upstream,
+	// along with their clone URL
+	Superproject string `json:"superproject,omitempty"`
+	CloneURL     string `json:"clone_url,omitempty"`
+	// ListedScope is the listing options of the last run which listed the
+	// repository, see listingScope
+	ListedScope string `json:"listed_scope,omitempty"`
+}
+
+// repository returns the repository the state is about
+func (rs *repoState) repository() *Repository {
+	return &Repository{ID: rs.ID, Namespace: rs.Namespace, Name: rs.Name, Superproject: rs.Superproject, CloneURL: rs.CloneURL}
+}
+
+// runState is what we know about the previous runs for a git host
+type runState struct {
+	LastFullBackupAt time.Time `json:"last_full_backup_at"`
+}
+
+func getStateDBPath(c *appConfig) string {
+	if c.stateDBPath != "" {
+		return c.stateDBPath
+	}
+	return filepath.Join(c.cacheDir, defaultStateDBFilename)
+}
+
+func openStateStore(dbPath string, gitHost string) (*stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0751); err != nil {
+		return nil, err
+	}
+	s := &stateStore{path: dbPath, gitHost: gitHost}
+	err := s.update(func(tx *bolt.Tx) error {
+		repos, err := tx.CreateBucketIfNotExists(stateRepositoriesBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := repos.CreateBucketIfNotExists([]byte(gitHost)); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(stateRunsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// transaction opens the database, runs a read-only or a read-write
+// transaction, and closes it
+func (s *stateStore) transaction(writable bool, fn func(tx *bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db, err := bolt.Open(s.path, 0640, &bolt.Options{Timeout: stateLockTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open state database %s: %v", s.path, err)
+	}
+	defer db.Close()
+	if writable {
+		return db.Update(fn)
+	}
+	return db.View(fn)
+}
+
+func (s *stateStore) view(fn func(tx *bolt.Tx) error) error {
+	return s.transaction(false, fn)
+}
+
+func (s *stateStore) update(fn func(tx *bolt.Tx) error) error {
+	return s.transaction(true, fn)
+}
+
+// stateKey identifies a repository in the state store. The provider ID
+// survives renames, the full name is only used when there is no ID.
+func stateKey(repo *Repository) []byte {
+	if repo.ID != "" {
+		return []byte("id:" + repo.ID)
+	}
+	return []byte("name:" + repo.Namespace + "/" + repo.Name)
+}
+
+func (s *stateStore) getRepo(repo *Repository) (*repoState, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var rs *repoState
+	err := s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(stateRepositoriesBucket).Bucket([]byte(s.gitHost)).Get(stateKey(repo))
+		if data == nil {
+			return nil
+		}
+		rs = &repoState{}
+		return json.Unmarshal(data, rs)
+	})
+	return rs, err
+}
+
+// updateRepo atomically updates the state of a repository
+func (s *stateStore) updateRepo(repo *Repository, update func(rs *repoState)) error {
+	if s == nil {
+		return nil
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return putRepo(tx.Bucket(stateRepositoriesBucket).Bucket([]byte(s.gitHost)), repo, update)
+	})
+}
+
+// updateRepos updates the state of several repositories in a single
+// transaction
+func (s *stateStore) updateRepos(repos []*Repository, update func(rs *repoState)) error {
+	if s == nil {
+		return nil
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateRepositoriesBucket).Bucket([]byte(s.gitHost))
+		for _, repo := range repos {
+			if err := putRepo(bucket, repo, update); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func putRepo(bucket *bolt.Bucket, repo *Repository, update func(rs *repoState)) error {
+	key := stateKey(repo)
+	rs := &repoState{}
+	if data := bucket.Get(key); data != nil {
+		if err := json.Unmarshal(data, rs); err != nil {
+			return err
+		}
+	}
+	update(rs)
+	rs.ID = repo.ID
+	rs.Namespace = repo.Namespace
+	rs.Name = repo.Name
+	rs.Superproject = repo.Superproject
+	if repo.Superproject != "" && repo.CloneURL != "" {
+		// Without the credentials added for cloning
+		rs.CloneURL = redactURL(repo.CloneURL)
+	}
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func (s *stateStore) deleteRepo(repo *Repository) error {
+	if s == nil {
+		return nil
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateRepositoriesBucket).Bucket([]byte(s.gitHost)).Delete(stateKey(repo))
+	})
+}
+
+// listRepos returns the state of all the repositories of the git host
+func (s *stateStore) listRepos() ([]*repoState, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var states []*repoState
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateRepositoriesBucket).Bucket([]byte(s.gitHost)).ForEach(func(k, v []byte) error {
+			rs := &repoState{}
+			if err := json.Unmarshal(v, rs); err != nil {
+				return err
+			}
+			states = append(states, rs)
+			return nil
+		})
+	})
+	return states, err
+}
+
+// listAllRepos returns the state of the repositories of every git host
+// backed up with this database, by git host
+func (s *stateStore) listAllRepos() (map[string][]*repoState, error) {
+	if s == nil {
+		return nil, nil
+	}
+	hosts := map[string][]*repoState{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateRepositoriesBucket).ForEachBucket(func(host []byte) error {
+			return tx.Bucket(stateRepositoriesBucket).Bucket(host).ForEach(func(k, v []byte) error {
+				rs := &repoState{}
+				if err := json.Unmarshal(v, rs); err != nil {
+					return err
+				}
+				hosts[string(host)] = append(hosts[string(host)], rs)
+				return nil
+			})
+		})
+	})
+	return hosts, err
+}
+
+// recordBackup updates the state of a repository after backing it up
+func (s *stateStore) recordBackup(repo *Repository, repoDir string, startedAt time.Time, archives []string, backupErr error) {
+	if s == nil {
+		return
+	}
+	var refs map[string]string
+	if backupErr == nil {
+		var err error
+		refs, err = getLocalRefs(repoDir)
+		if err != nil {
+			debugLogf("Could not read the refs of %s: %v", repoDir, err)
+		}
+	}
+	err := s.updateRepo(repo, func(rs *repoState) {
+		rs.LastAttemptAt = startedAt
+		rs.Path = repoDir
+		if backupErr != nil {
+			rs.Failures++
+			rs.LastError = backupErr.Error()
+			return
+		}
+		rs.Failures = 0
+		rs.LastError = ""
+		rs.LastBackupAt = startedAt
+		if repo.PushedAt != nil {
+			pushedAt := *repo.PushedAt
+			rs.LastPushedAt = &pushedAt
+		}
+		if refs != nil {
+			rs.Refs = refs
+		}
+		if len(archives) != 0 {
+			rs.Archives = archives
+			archivedAt := startedAt
+			rs.ArchivedAt = &archivedAt
+			rs.ArchiveFingerprint = ""
+			if refs != nil {
+				rs.ArchiveFingerprint = refsFingerprint(refs)
+			}
+		}
+	})
+	if err != nil {
+		debugLogf("Could not save the state of %s/%s: %v", repo.Namespace, repo.Name, err)
+	}
+}
+
+// unchangedSinceLastBackup returns true when the repository was backed up
+// successfully and has not been pushed to since. A repository with no
+// state yet, backed up to repoDir before the state database, is compared
+// to the last run which backed up every repository of the git host.
+func (s *stateStore) unchangedSinceLastBackup(repo *Repository, repoDir string) (bool, error) {
+	if s == nil || repo.PushedAt == nil {
+		return false, nil
+	}
+	rs, err := s.getRepo(repo)
+	if err != nil {
+		return false, err
+	}
+	if rs == nil {
+		lastFullBackupAt, err := s.lastFullBackupAt()
+		if err != nil || lastFullBackupAt.IsZero() || repo.changedSince(lastFullBackupAt) {
+			return false, err
+		}
+		_, err = appFS.Stat(repoDir)
+		return err == nil, nil
+	}
+	if rs.Failures != 0 || rs.LastBackupAt.IsZero() || rs.LastPushedAt == nil {
+		return false, nil
+	}
+	if repo.changedSince(*rs.LastPushedAt) {
+		return false, nil
+	}
+	// Make sure the backup is still there
+	if _, err := appFS.Stat(rs.Path); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// lastFullBackupAt returns the start of the last run which backed up every
+// repository of the git host, zero when there is none
+func (s *stateStore) lastFullBackupAt() (time.Time, error) {
+	if s == nil {
+		return time.Time{}, nil
+	}
+	rs := &runState{}
+	err := s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(stateRunsBucket).Get([]byte(s.gitHost))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, rs)
+	})
+	return rs.LastFullBackupAt, err
+}
+
+func (s *stateStore) setLastFullBackupAt(t time.Time) error {
+	if s == nil {
+		return nil
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(&runState{LastFullBackupAt: t})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(stateRunsBucket).Put([]byte(s.gitHost), data)
+	})
+}
+
+// importLegacyLastBackup imports the time of the last run which backed up
+// every repository from the file -github.saveLastBackupDateAndContinueFrom
+// wrote before the state database, once, when the database has none
+func (s *stateStore) importLegacyLastBackup(legacyPath string) error {
+	lastFullBackupAt, err := s.lastFullBackupAt()
+	if err != nil || !lastFullBackupAt.IsZero() {
+		return err
+	}
+	data, err := os.ReadFile(legacyPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return nil
+	}
+	t, err := time.ParseInLocation(cacheSaveLastBackupDateAndContinueFromCache, strings.TrimSpace(string(data)), time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid time in %s -> %v", legacyPath, err)
+	}
+	debugLogf("Imported the time of the last backup, %s, from %s", t, legacyPath)
+	return s.setLastFullBackupAt(t)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func newTestStateStore(t *testing.T) *stateStore {
+	s, err := openStateStore(filepath.Join(t.TempDir(), "state.db"), "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStateRecordBackup(t *testing.T) {
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	repoDir := t.TempDir()
+	for _, args := range [][]string{{"init", "-q", "-b", "main"}, {"commit", "-q", "--allow-empty", "-m", "init"}} {
+		if out, err := exec.Command("git", append([]string{"-C", repoDir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	s := newTestStateStore(t)
+	pushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := &Repository{ID: "42", Namespace: "ns", Name: "r1", PushedAt: &pushedAt}
+	startedAt := time.Now()
+	s.recordBackup(repo, repoDir, startedAt, []string{"/archives/r1.tar.gz"}, nil)
+
+	rs, err := s.getRepo(repo)
+	if err != nil || rs == nil {
+		t.Fatalf("Expected the repository state, got %v %v", rs, err)
+	}
+	if rs.Path != repoDir || !rs.LastBackupAt.Equal(startedAt) || !rs.LastPushedAt.Equal(pushedAt) {
+		t.Errorf("Unexpected state %+v", rs)
+	}
+	if _, ok := rs.Refs["refs/heads/main"]; !ok {
+		t.Errorf("Expected the refs of the repository to be recorded, got %v", rs.Refs)
+	}
+	if len(rs.Archives) != 1 {
+		t.Errorf("Expected the archive to be recorded, got %v", rs.Archives)
+	}
+
+	// A failure keeps the last successful backup
+	s.recordBackup(repo, repoDir, startedAt.Add(time.Hour), nil, errors.New("timeout"))
+	s.recordBackup(repo, repoDir, startedAt.Add(2*time.Hour), nil, errors.New("timeout"))
+	rs, _ = s.getRepo(repo)
+	if rs.Failures != 2 || rs.LastError != "timeout" || !rs.LastBackupAt.Equal(startedAt) {
+		t.Errorf("Expected two failures after the last backup, got %+v", rs)
+	}
+}
+
+func TestStateKeyedByID(t *testing.T) {
+	s := newTestStateStore(t)
+	s.updateRepo(&Repository{ID: "42", Namespace: "ns", Name: "old"}, func(rs *repoState) { rs.Path = "/backups/ns/old" })
+
+	rs, err := s.getRepo(&Repository{ID: "42", Namespace: "ns", Name: "new"})
+	if err != nil || rs == nil || rs.Path != "/backups/ns/old" {
+		t.Fatalf("Expected the state of the renamed repository, got %+v %v", rs, err)
+	}
+	if rs, _ := s.getRepo(&Repository{Namespace: "ns", Name: "old"}); rs != nil {
+		t.Errorf("Expected no state for a repository without an ID, got %+v", rs)
+	}
+
+	states, err := s.listRepos()
+	if err != nil || len(states) != 1 {
+		t.Errorf("Expected one repository, got %d %v", len(states), err)
+	}
+}
+
+func TestStateUnchangedSinceLastBackup(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backups/ns/r1", 0771)
+
+	s := newTestStateStore(t)
+	pushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := &Repository{ID: "1", Namespace: "ns", Name: "r1", PushedAt: &pushedAt}
+
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); unchanged {
+		t.Errorf("Expected a repository never backed up to be changed")
+	}
+
+	s.updateRepo(repo, func(rs *repoState) {
+		rs.Path = "/backups/ns/r1"
+		rs.LastBackupAt = pushedAt.Add(time.Hour)
+		rs.LastPushedAt = &pushedAt
+	})
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); !unchanged {
+		t.Errorf("Expected the repository to be unchanged")
+	}
+
+	pushedLater := pushedAt.Add(time.Minute)
+	repo.PushedAt = &pushedLater
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); unchanged {
+		t.Errorf("Expected a pushed repository to be changed")
+	}
+
+	repo.PushedAt = &pushedAt
+	s.updateRepo(repo, func(rs *repoState) { rs.Failures = 1 })
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); unchanged {
+		t.Errorf("Expected a repository which failed to be backed up again")
+	}
+
+	s.updateRepo(repo, func(rs *repoState) { rs.Failures = 0 })
+	appFS.RemoveAll("/backups/ns/r1")
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); unchanged {
+		t.Errorf("Expected a repository whose backup is gone to be backed up again")
+	}
+}
+
+func TestStateLegacyLastBackup(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backups/ns/r1", 0771)
+	s := newTestStateStore(t)
+	legacyPath := filepath.Join(t.TempDir(), "github_save_last_backup_date_and_continue_from")
+	if err := s.importLegacyLastBackup(legacyPath); err != nil {
+		t.Fatalf("Expected no legacy file to be imported, got %v", err)
+	}
+
+	os.WriteFile(legacyPath, []byte("2024-01-02 00:00:00"), 0644)
+	if err := s.importLegacyLastBackup(legacyPath); err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)
+	if got, err := s.lastFullBackupAt(); err != nil || !got.Equal(expected) {
+		t.Fatalf("Expected the legacy time of the last backup %s, got %s (%v)", expected, got, err)
+	}
+	// Only once
+	os.WriteFile(legacyPath, []byte("2024-06-01 00:00:00"), 0644)
+	if err := s.importLegacyLastBackup(legacyPath); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.lastFullBackupAt(); !got.Equal(expected) {
+		t.Errorf("Expected the legacy file to be imported once, got %s", got)
+	}
+
+	// A repository backed up before the state database
+	pushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	repo := &Repository{ID: "1", Namespace: "ns", Name: "r1", PushedAt: &pushedAt}
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); !unchanged {
+		t.Errorf("Expected a repository not pushed to since the last backup to be unchanged")
+	}
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/gone"); unchanged {
+		t.Errorf("Expected a repository with no backup to be changed")
+	}
+	pushedLater := expected.Add(time.Minute)
+	repo.PushedAt = &pushedLater
+	if unchanged, _ := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); unchanged {
+		t.Errorf("Expected a repository pushed to since the last backup to be changed")
+	}
+}
+
+func TestNilStateStore(t *testing.T) {
+	var s *stateStore
+	repo := &Repository{Name: "r1"}
+	s.recordBackup(repo, "/nonexistent", time.Now(), nil, nil)
+	if unchanged, err := s.unchangedSinceLastBackup(repo, "/backups/ns/r1"); unchanged || err != nil {
+		t.Errorf("Expected a nil store to never skip a repository")
+	}
+	if err := s.setLastFullBackupAt(time.Now()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStateStoreOpenedTwice(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	// e.g. the webhook receiver and a scheduled run sharing the cache
+	receiver, err := openStateStore(dbPath, "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sweep, err := openStateStore(dbPath, "github.com")
+	if err != nil {
+		t.Fatalf("Expected the database to be opened again: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		for _, s := range []*stateStore{receiver, sweep} {
+			go func(s *stateStore, i int) {
+				defer wg.Done()
+				repo := &Repository{ID: strconv.Itoa(i), Namespace: "ns", Name: "r" + strconv.Itoa(i)}
+				if err := s.updateRepo(repo, func(rs *repoState) { rs.Failures++ }); err != nil {
+					t.Error(err)
+				}
+			}(s, i)
+		}
+	}
+	wg.Wait()
+
+	states, err := receiver.listRepos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 10 {
+		t.Fatalf("Expected the state of 10 repositories, got %d", len(states))
+	}
+	for _, rs := range states {
+		if rs.Failures != 2 {
+			t.Errorf("Expected both stores to update %s, got %d failures", rs.Name, rs.Failures)
+		}
+	}
+}
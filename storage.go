@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// The storage backends the archives can be uploaded to
+const (
+	storageBackendS3     = "s3"
+	storageBackendSFTP   = "sftp"
+	storageBackendWebDAV = "webdav"
+)
+
+// archiveStorage is a remote storage the archives are uploaded to
+type archiveStorage interface {
+	// upload uploads a local file as key, and verifies it was stored
+	// unaltered
+	upload(localPath, key string) error
+	// location returns where the key is stored, for the report
+	location(key string) string
+	// list returns the names of the files in a directory, e.g. the
+	// archives of a git host
+	list(dir string) ([]string, error)
+	// remove deletes a key
+	remove(key string) error
+}
+
+func validStorageBackend(backend string) bool {
+	switch backend {
+	case "", storageBackendS3, storageBackendSFTP, storageBackendWebDAV:
+		return true
+	}
+	return false
+}
+
+// newArchiveStorage returns the -storage.backend, or nil if the archives
+// are only kept locally
+func newArchiveStorage(c *appConfig) (archiveStorage, error) {
+	switch c.storageBackend {
+	case "":
+		return nil, nil
+	case storageBackendS3:
+		return newS3Storage(c.storageS3)
+	case storageBackendSFTP:
+		return newSFTPStorage(c.storageSFTP)
+	case storageBackendWebDAV:
+		return newWebDAVStorage(c.storageWebDAV)
+	}
+	return nil, fmt.Errorf("unknown storage backend %s", c.storageBackend)
+}
+
+// uploadArchives uploads the files of an archive to the storage, under
+// the name of the git host, deleting the local files afterwards with
+// -storage.delete-local
+func uploadArchives(archives []archiveReport) error {
+	if appCfg.archiveStorage == nil {
+		return nil
+	}
+	gitHost := filepath.Base(appCfg.backupDir)
+	for i := range archives {
+		key := path.Join(gitHost, filepath.Base(archives[i].Path))
+		debugLogf("Uploading %s to %s", archives[i].Path, appCfg.archiveStorage.location(key))
+		if err := appCfg.archiveStorage.upload(archives[i].Path, key); err != nil {
+			return fmt.Errorf("failed to upload %s -> %v", archives[i].Path, err)
+		}
+		archives[i].Location = appCfg.archiveStorage.location(key)
+		log.Printf("Uploaded %s to %s\n", archives[i].Path, archives[i].Location)
+		if appCfg.storageDeleteLocal {
+			if err := os.Remove(archives[i].Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resumablePart returns true when a partial upload, of the given size and
+// modification time, can be resumed to upload a file. A partial upload
+// older than the file is of another file uploaded under the same key, e.g.
+// a previous version of the manifest of a bundle chain. The servers only
+// keep the modification times to the second.
+func resumablePart(size int64, modTime time.Time, info os.FileInfo) bool {
+	return size > 0 && size <= info.Size() && !modTime.Before(info.ModTime().Truncate(time.Second))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloneStrategy is how much of the history of a repository is backed up
+type cloneStrategy struct {
+	// Depth is the number of commits kept per branch, for shallow clones
+	Depth int
+	// Since is the date from which the history is kept, for shallow clones
+	Since string
+	// Filter is the object filter of partial clones, e.g. blob:none
+	Filter string
+}
+
+// cloneStrategyRule is a -clone.strategy option: the strategy of the
+// repositories matching the pattern
+type cloneStrategyRule struct {
+	pattern  *repoPattern
+	strategy cloneStrategy
+}
+
+var blobLimitRegexp = regexp.MustCompile(`^blob:limit=[0-9]+[kmg]?$`)
+
+// parseCloneStrategy parses a strategy: full, shallow, shallow:<depth>,
+// since:<YYYY-MM-DD>, blobless (or blob:none) and blob:limit=<size>
+func parseCloneStrategy(s string) (cloneStrategy, error) {
+	switch {
+	case s == "full":
+		return cloneStrategy{}, nil
+	case s == "shallow":
+		return cloneStrategy{Depth: 1}, nil
+	case strings.HasPrefix(s, "shallow:"):
+		depth, err := strconv.Atoi(strings.TrimPrefix(s, "shallow:"))
+		if err != nil || depth < 1 {
+			return cloneStrategy{}, fmt.Errorf("invalid depth in %q", s)
+		}
+		return cloneStrategy{Depth: depth}, nil
+	case strings.HasPrefix(s, "since:"):
+		since := strings.TrimPrefix(s, "since:")
+		if _, err := time.Parse("2006-01-02", since); err != nil {
+			return cloneStrategy{}, fmt.Errorf("invalid date in %q, expected YYYY-MM-DD", s)
+		}
+		return cloneStrategy{Since: since}, nil
+	case s == "blobless", s == "blob:none":
+		return cloneStrategy{Filter: "blob:none"}, nil
+	case blobLimitRegexp.MatchString(s):
+		return cloneStrategy{Filter: s}, nil
+	}
+	return cloneStrategy{}, fmt.Errorf("unknown clone strategy %q", s)
+}
+
+// parseCloneStrategyRules parses the -clone.strategy options, given as
+// <pattern>=<strategy>
+func parseCloneStrategyRules(rules []string) ([]cloneStrategyRule, error) {
+	var parsed []cloneStrategyRule
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		// blob:limit=<size> has an = too
+		if j := strings.LastIndex(rule, "=blob:limit="); j != -1 {
+			i = j
+		}
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid clone strategy %q, expected <pattern>=<strategy>", rule)
+		}
+		pattern, err := newRepoPattern(rule[:i])
+		if err != nil {
+			return nil, err
+		}
+		strategy, err := parseCloneStrategy(rule[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, cloneStrategyRule{pattern: pattern, strategy: strategy})
+	}
+	return parsed, nil
+}
+
+// setCloneStrategy sets the strategy of a repository from -shallow.repos
+// and the first matching -clone.strategy
+func setCloneStrategy(c *appConfig, repo *Repository) {
+	if shallowCloneRequested(c.shallowCloneRepos, repo.Namespace, repo.Name) {
+		repo.Strategy = cloneStrategy{Depth: 1}
+	} else {
+		for _, rule := range c.cloneStrategyRules {
+			if rule.pattern.match(repo) {
+				repo.Strategy = rule.strategy
+				break
+			}
+		}
+	}
+	repo.Shallow = repo.Strategy.shallow()
+	if repo.Strategy != (cloneStrategy{}) {
+		debugLogf("Clone strategy of %s/%s: %s", repo.Namespace, repo.Name, repo.Strategy)
+	}
+}
+
+func (s cloneStrategy) shallow() bool {
+	return s.Depth > 0 || s.Since != ""
+}
+
+func (s cloneStrategy) String() string {
+	switch {
+	case s.Depth > 0:
+		return fmt.Sprintf("shallow:%d", s.Depth)
+	case s.Since != "":
+		return "since:" + s.Since
+	case s.Filter != "":
+		return s.Filter
+	}
+	return "full"
+}
+
+// cloneArgs returns the options of git clone for the strategy
+func (s cloneStrategy) cloneArgs() []string {
+	switch {
+	case s.Depth > 0:
+		return []string{fmt.Sprintf("--depth=%d", s.Depth), "--no-single-branch"}
+	case s.Since != "":
+		return []string{"--shallow-since=" + s.Since, "--no-single-branch"}
+	case s.Filter != "":
+		return []string{"--filter=" + s.Filter}
+	}
+	return nil
+}
+
+// fetchArgs returns the options of git fetch keeping a repository cloned
+// with the strategy consistent. A shallow repository is deepened when it
+// is to be backed up in full.
+func (s cloneStrategy) fetchArgs(repoDir string, bare bool) []string {
+	switch {
+	case s.Depth > 0:
+		return []string{fmt.Sprintf("--depth=%d", s.Depth), "--no-tags"}
+	case s.Since != "":
+		return []string{"--shallow-since=" + s.Since, "--no-tags"}
+	case s.Filter != "":
+		return []string{"--filter=" + s.Filter}
+	}
+	gitDir := repoDir
+	if !bare {
+		gitDir = path.Join(repoDir, ".git")
+	}
+	if _, err := appFS.Stat(path.Join(gitDir, "shallow")); err == nil {
+		return []string{"--unshallow"}
+	}
+	return nil
+}
+
+// isPartialClone returns true when the repository was cloned with a filter,
+// some of its objects being left out
+func isPartialClone(repoDir string) bool {
+	for _, key := range []string{"extensions.partialClone", "remote.origin.partialclonefilter"} {
+		// Exits with 1 when the option isn't set
+		if out, err := execCommand(gitCommand, "-C", repoDir, "config", key).Output(); err == nil && strings.TrimSpace(string(out)) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// unsetGitConfig removes options from the configuration of a repository,
+// whether they are set or not
+func unsetGitConfig(repoDir string, keys ...string) error {
+	for _, key := range keys {
+		out, err := execCommand(gitCommand, "-C", repoDir, "config", "--unset-all", key).CombinedOutput()
+		// Exits with 5 when the option isn't set
+		var exitErr *exec.ExitError
+		if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 5) {
+			return fmt.Errorf("failed to unset %s -> %v: %s", key, err, out)
+		}
+	}
+	return nil
+}
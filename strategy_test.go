@@ -0,0 +1,123 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestParseCloneStrategyRules(t *testing.T) {
+	rules, err := parseCloneStrategyRules([]string{
+		"org/huge=blobless",
+		"org/media-*=blob:limit=1m",
+		"re:^archive/=shallow:5",
+		"old/**=since:2024-01-01",
+		"**=full",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &appConfig{shallowCloneRepos: []string{"org/huge"}, cloneStrategyRules: rules}
+
+	var testCases = []struct {
+		namespace string
+		name      string
+		expected  cloneStrategy
+	}{
+		// -shallow.repos comes first
+		{"org", "huge", cloneStrategy{Depth: 1}},
+		{"org", "media-assets", cloneStrategy{Filter: "blob:limit=1m"}},
+		{"archive", "app", cloneStrategy{Depth: 5}},
+		{"old/team", "app", cloneStrategy{Since: "2024-01-01"}},
+		{"org", "app", cloneStrategy{}},
+	}
+	for _, tc := range testCases {
+		repo := &Repository{Namespace: tc.namespace, Name: tc.name}
+		setCloneStrategy(c, repo)
+		if repo.Strategy != tc.expected {
+			t.Errorf("Expected the strategy of %s/%s to be %s, got %s", tc.namespace, tc.name, tc.expected, repo.Strategy)
+		}
+		if repo.Shallow != tc.expected.shallow() {
+			t.Errorf("Expected %s/%s shallow to be %t", tc.namespace, tc.name, tc.expected.shallow())
+		}
+	}
+
+	for _, invalid := range []string{"org/app", "org/app=shallow:0", "org/app=since:yesterday", "org/app=blob:limit=big", "org/app=lazy"} {
+		if _, err := parseCloneStrategyRules([]string{invalid}); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestCloneStrategyArgs(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backups/full.git", 0771)
+	appFS.MkdirAll("/backups/deepened.git", 0771)
+	afero.WriteFile(appFS, "/backups/deepened.git/shallow", nil, 0644)
+
+	var testCases = []struct {
+		strategy  cloneStrategy
+		repoDir   string
+		cloneArgs []string
+		fetchArgs []string
+	}{
+		{cloneStrategy{}, "/backups/full.git", nil, nil},
+		{cloneStrategy{}, "/backups/deepened.git", nil, []string{"--unshallow"}},
+		{cloneStrategy{Depth: 3}, "/backups/full.git", []string{"--depth=3", "--no-single-branch"}, []string{"--depth=3", "--no-tags"}},
+		{cloneStrategy{Since: "2024-01-01"}, "/backups/full.git", []string{"--shallow-since=2024-01-01", "--no-single-branch"}, []string{"--shallow-since=2024-01-01", "--no-tags"}},
+		{cloneStrategy{Filter: "blob:none"}, "/backups/full.git", []string{"--filter=blob:none"}, []string{"--filter=blob:none"}},
+	}
+	for _, tc := range testCases {
+		if got := tc.strategy.cloneArgs(); !reflect.DeepEqual(got, tc.cloneArgs) {
+			t.Errorf("Expected the clone options of %s to be %v, got %v", tc.strategy, tc.cloneArgs, got)
+		}
+		if got := tc.strategy.fetchArgs(tc.repoDir, true); !reflect.DeepEqual(got, tc.fetchArgs) {
+			t.Errorf("Expected the fetch options of %s in %s to be %v, got %v", tc.strategy, tc.repoDir, tc.fetchArgs, got)
+		}
+	}
+}
+
+func TestBloblessMirrorBackup(t *testing.T) {
+	var wg sync.WaitGroup
+	remote := newTestRemote(t)
+	// Partial clones need the server to allow filters
+	runTestGit(t, "-C", remote, "config", "uploadpack.allowFilter", "true")
+	backupDir := t.TempDir()
+	appFS = afero.NewOsFs()
+
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: "file://" + remote, Strategy: cloneStrategy{Filter: "blob:none"}}
+	for i := 0; i < 2; i++ {
+		runTestGit(t, "-C", remote, "commit", "-q", "--allow-empty", "-m", "next")
+		wg.Add(1)
+		if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+
+	repoDir := filepath.Join(backupDir, "ns", "r1.git")
+	if filter := gitOutput(t, "-C", repoDir, "config", "remote.origin.partialclonefilter"); filter != "blob:none" {
+		t.Errorf("Expected a partial clone filtering blob:none, got %q", filter)
+	}
+	if head, upstream := gitOutput(t, "-C", repoDir, "rev-parse", "main"), gitOutput(t, "-C", remote, "rev-parse", "main"); head != upstream {
+		t.Errorf("Expected main to be updated to %s, got %s", upstream, head)
+	}
+
+	// Backed up in full again, even with its refs unchanged
+	appCfg.checkRefs = true
+	defer func() { appCfg.checkRefs = false }()
+	repo.Strategy = cloneStrategy{}
+	wg.Add(1)
+	if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if isPartialClone(repoDir) {
+		t.Errorf("Expected the partial clone to be a full one again")
+	}
+	if missing := gitOutput(t, "-C", repoDir, "rev-list", "--objects", "--missing=print", "--all"); strings.Contains(missing, "?") {
+		t.Errorf("Expected the objects left out to be fetched, missing:\n%s", missing)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// submodulesDirName is where the submodules hosted elsewhere than the git
+// host being backed up are kept, under the backup directory
+const submodulesDirName = "_submodules"
+
+// getSubmoduleURLs returns the URLs of the submodules declared in the
+// .gitmodules of every backed up branch and tag of a repository
+func getSubmoduleURLs(repoDir string, bare bool) ([]string, error) {
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	var objects strings.Builder
+	for _, ref := range sortedRefs(refs) {
+		if strings.HasPrefix(ref, "refs/tags/") ||
+			(bare && strings.HasPrefix(ref, "refs/heads/")) ||
+			(!bare && strings.HasPrefix(ref, "refs/remotes/origin/") && ref != "refs/remotes/origin/HEAD") {
+			fmt.Fprintf(&objects, "%s:.gitmodules\n", ref)
+		}
+	}
+	cmd := execCommand(gitCommand, "-C", repoDir, "cat-file", "--batch-check=%(objectname) %(objecttype)")
+	cmd.Stdin = strings.NewReader(objects.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// The same .gitmodules is usually found on most refs
+	blobs := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 2 && parts[1] == "blob" {
+			blobs[parts[0]] = true
+		}
+	}
+	urls := map[string]bool{}
+	for blob := range blobs {
+		// Exits with 1 when there is no match
+		out, _ := execCommand(gitCommand, "-C", repoDir, "config", "--blob", blob, "--get-regexp", `^submodule\..*\.url$`).Output()
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) == 2 && parts[1] != "" {
+				urls[parts[1]] = true
+			}
+		}
+	}
+	var sorted []string
+	for u := range urls {
+		sorted = append(sorted, u)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// resolveSubmoduleURL resolves a submodule URL relative to the URL of its
+// superproject, as git does: ../lib.git next to https://host/org/app.git
+// is https://host/org/lib.git
+func resolveSubmoduleURL(superprojectURL, submoduleURL string) string {
+	if !strings.HasPrefix(submoduleURL, "./") && !strings.HasPrefix(submoduleURL, "../") {
+		return submoduleURL
+	}
+	if u, err := url.Parse(superprojectURL); err == nil && u.Host != "" {
+		u.Path = path.Join(u.Path, submoduleURL)
+		return u.String()
+	}
+	// scp-like: git@host:org/app.git
+	if i := strings.Index(superprojectURL, ":"); i != -1 {
+		return superprojectURL[:i+1] + strings.TrimPrefix(path.Join(superprojectURL[i+1:], submoduleURL), "/")
+	}
+	return submoduleURL
+}
+
+// cloneURLPath returns the path of a HTTPS or SSH (including scp-like)
+// clone URL, without the .git suffix
+func cloneURLPath(cloneURL string) string {
+	p := cloneURL
+	if u, err := url.Parse(cloneURL); err == nil && u.Host != "" {
+		p = u.Path
+	} else if i := strings.Index(cloneURL, ":"); i != -1 {
+		p = cloneURL[i+1:]
+	}
+	return strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
+
+// repositoryURLKey identifies a repository by its clone URL, whichever the
+// protocol
+func repositoryURLKey(cloneURL string) string {
+	return strings.ToLower(cloneURLHost(cloneURL) + "/" + cloneURLPath(cloneURL))
+}
+
+// submoduleURLSchemes are the protocols the submodules are cloned over,
+// along with the scp-like user@host:path
+var submoduleURLSchemes = map[string]bool{"https": true, "ssh": true, "git": true}
+
+// scpLikeURLRegexp matches the scp-like SSH URLs, user@host:path
+var scpLikeURLRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]+@[A-Za-z0-9.-]+:[^/]`)
+
+// checkSubmoduleURL rejects the URLs of .gitmodules which are not those of
+// a remote repository, such as file:// or ext:: URLs cloning or running
+// something on the backup host, and the ones git could read as an option
+func checkSubmoduleURL(cloneURL string) error {
+	if strings.HasPrefix(cloneURL, "-") {
+		return fmt.Errorf("submodule URL %s looks like an option", cloneURL)
+	}
+	if strings.Contains(cloneURL, "://") {
+		u, err := url.Parse(cloneURL)
+		if err != nil {
+			return err
+		}
+		if !submoduleURLSchemes[u.Scheme] {
+			return fmt.Errorf("unsupported submodule URL scheme %s", u.Scheme)
+		}
+		if u.Host == "" || strings.HasPrefix(u.Host, "-") {
+			return fmt.Errorf("invalid submodule URL host in %s", cloneURL)
+		}
+		return nil
+	}
+	if !scpLikeURLRegexp.MatchString(cloneURL) || strings.HasPrefix(cloneURLHost(cloneURL), "-") {
+		return fmt.Errorf("unsupported submodule URL %s", cloneURL)
+	}
+	return nil
+}
+
+// newSubmoduleRepository returns the repository of a submodule. Submodules
+// on the git host are backed up next to the other repositories, the ones
+// hosted elsewhere under _submodules/<host>/.
+func newSubmoduleRepository(superproject *Repository, submoduleURL string, gitHost string) (*Repository, error) {
+	cloneURL := resolveSubmoduleURL(superproject.CloneURL, submoduleURL)
+	if err := checkSubmoduleURL(cloneURL); err != nil {
+		return nil, err
+	}
+	if u, err := url.Parse(cloneURL); err == nil && u.Host != "" {
+		// The credentials are added when cloning, if at all
+		u.User = nil
+		cloneURL = u.String()
+	}
+	host, p := cloneURLHost(cloneURL), cloneURLPath(cloneURL)
+	if host == "" || host == cloneURL || p == "" || strings.Contains(p, "..") {
+		return nil, fmt.Errorf("unsupported submodule URL %s", submoduleURL)
+	}
+	namespace := path.Dir(p)
+	if host != gitHost {
+		namespace = path.Join(submodulesDirName, host, namespace)
+	}
+	return &Repository{
+		CloneURL:     cloneURL,
+		Name:         path.Base(p),
+		Namespace:    namespace,
+		Superproject: superproject.Namespace + "/" + superproject.Name,
+	}, nil
+}
+
+// discoverSubmodules returns the submodules of a backed up repository
+func discoverSubmodules(repo *Repository, repoDir string, bare bool, gitHost string) []*Repository {
+	urls, err := getSubmoduleURLs(repoDir, bare)
+	if err != nil {
+		debugLogf("Could not look for the submodules of %s/%s: %v", repo.Namespace, repo.Name, err)
+		return nil
+	}
+	var submodules []*Repository
+	for _, u := range urls {
+		submodule, err := newSubmoduleRepository(repo, u, gitHost)
+		if err != nil {
+			debugLogf("Skipping a submodule of %s/%s: %v", repo.Namespace, repo.Name, err)
+			continue
+		}
+		submodules = append(submodules, submodule)
+	}
+	sort.Slice(submodules, func(i, j int) bool { return submodules[i].CloneURL < submodules[j].CloneURL })
+	return submodules
+}
+
+// knownSubmodules returns the submodules recorded in the state whose
+// superproject is listed, or is itself such a submodule. They are backed up
+// on every run, as they change independently of their superproject, which
+// may not even be fetched when it is unchanged.
+func knownSubmodules(listed []*Repository) ([]*Repository, error) {
+	states, err := currentState.listRepos()
+	if err != nil {
+		return nil, err
+	}
+	superprojects := map[string]bool{}
+	for _, repo := range listed {
+		superprojects[repo.Namespace+"/"+repo.Name] = true
+	}
+	var submodules []*Repository
+	for found := true; found; {
+		found = false
+		for _, rs := range states {
+			fullName := rs.Namespace + "/" + rs.Name
+			if rs.Superproject == "" || rs.CloneURL == "" || superprojects[fullName] || !superprojects[rs.Superproject] {
+				continue
+			}
+			superprojects[fullName] = true
+			submodules = append(submodules, rs.repository())
+			found = true
+		}
+	}
+	sort.Slice(submodules, func(i, j int) bool { return submodules[i].CloneURL < submodules[j].CloneURL })
+	return submodules, nil
+}
+
+// useCredentials returns true when our credentials are to be added to the
+// clone URL: always for the repositories listed by the git host, only for
+// HTTPS URLs on the same host for submodules
+func (r *Repository) useCredentials(gitHost string) bool {
+	if r.Superproject == "" {
+		return true
+	}
+	return strings.HasPrefix(r.CloneURL, "https://") && cloneURLHost(r.CloneURL) == gitHost
+}
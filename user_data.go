@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -233,11 +234,15 @@ type GithubUserMigrationDeleteResult struct {
 
 // DeleteGithubUserMigration deletes an existing migration
 func DeleteGithubUserMigration(id *int64) GithubUserMigrationDeleteResult {
-	client := newClient("github", "https://github.com")
+	result := GithubUserMigrationDeleteResult{}
+	client, err := newClient("github", "https://github.com")
+	if err != nil {
+		result.GhResponseBody = err.Error()
+		return result
+	}
 	ctx := context.Background()
 	response, err := client.(*github.Client).Migrations.DeleteUserMigration(ctx, *id)
 
-	result := GithubUserMigrationDeleteResult{}
 	result.GhStatusCode = response.StatusCode
 	if err != nil {
 		result.GhResponseBody = err.Error()
@@ -289,7 +294,13 @@ func getGithubOrgRepositories(ctx context.Context, client interface{}, o *github
 			} else {
 				cloneURL = *repo.SSHURL
 			}
-			repositories = append(repositories, &Repository{CloneURL: cloneURL, Name: *repo.Name, Namespace: namespace, Private: *repo.Private})
+			repositories = append(repositories, &Repository{
+				ID:        strconv.FormatInt(repo.GetID(), 10),
+				CloneURL:  cloneURL,
+				Name:      *repo.Name,
+				Namespace: namespace,
+				Private:   *repo.Private,
+			})
 		}
 		if resp.NextPage == 0 {
 			break
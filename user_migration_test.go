@@ -210,3 +210,27 @@ func TestDownloadGithubUserMigrationDataArchiveDownload(t *testing.T) {
 		t.Fatalf("Expected %s to exist", archiveFilepath)
 	}
 }
+
+func TestListGithubUserMigrationsNotifies(t *testing.T) {
+	var pingPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pingPaths = append(pingPaths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	mockedHTTPClient := githubmock.NewMockedHTTPClient(
+		githubmock.WithRequestMatchHandler(
+			githubmock.GetUserMigrations,
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				githubmock.WriteError(w, http.StatusBadGateway, "github 502")
+			}),
+		),
+	)
+	c := &appConfig{service: "github", backupDir: "/backups/github.com", notifyPingURL: server.URL + "/ping"}
+	if err := handleGithubListUserMigrations(github.NewClient(mockedHTTPClient), c); err == nil {
+		t.Fatal("Expected listing the migrations to fail")
+	}
+	if len(pingPaths) != 1 || pingPaths[0] != "/ping/fail" {
+		t.Errorf("Expected the failure to be notified, got %v", pingPaths)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// handleVerify is `gitbackup verify`, which checks the archives listed in
+// the manifest of a backup run
+func handleVerify(args []string) error {
+	var ageIdentities, pgpKeys stringsFlag
+	fs := flag.NewFlagSet("gitbackup verify", flag.ExitOnError)
+	manifestPath := fs.String("manifest", "", "Manifest (MANIFEST-*.json) of the backup run whose archives to verify")
+	archiveDir := fs.String("dir", "", "Directory of the archives (default the directory of the manifest)")
+	signerKey := fs.String("signer-key", "", "OpenPGP public key the manifest must be signed with, in its .asc file")
+	hashOnly := fs.Bool("hash-only", false, "Only check the sizes and SHA-256 of the archives, without extracting them")
+	password := fs.String("password", "", "Password of the encrypted 7z archives")
+	fs.Var(&ageIdentities, "identity", "age identity file decrypting the archives (repeatable)")
+	fs.Var(&pgpKeys, "pgp-key", "OpenPGP private key decrypting the archives, its passphrase in "+pgpPassphraseEnv+" (repeatable)")
+	fs.BoolVar(&appCfg.debug, "debug", false, "Enable verbose debug logging")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *manifestPath == "" {
+		return errors.New("Please specify the manifest of the archives to verify with -manifest")
+	}
+	if *archiveDir == "" {
+		*archiveDir = filepath.Dir(*manifestPath)
+	}
+
+	decryption, err := newArchiveDecryption(ageIdentities, pgpKeys)
+	if err != nil {
+		return err
+	}
+	decryption.password = *password
+	manifest, err := readRunManifest(*manifestPath, *signerKey)
+	if err != nil {
+		return err
+	}
+	failed := verifyManifest(manifest, *archiveDir, *hashOnly, decryption)
+	if failed > 0 {
+		return fmt.Errorf("%d of the %d archived repositories failed the verification", failed, len(manifest.Repositories))
+	}
+	log.Printf("Verified the archives of the %d repositories of %s\n", len(manifest.Repositories), *manifestPath)
+	return nil
+}
+
+// readRunManifest reads the manifest of a backup run, making sure it is
+// signed by the signer key if any
+func readRunManifest(manifestPath, signerKey string) (*runManifest, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if signerKey != "" {
+		keys, err := readPGPKeyRing(signerKey)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := os.Open(manifestPath + manifestSignatureSuffix)
+		if err != nil {
+			return nil, fmt.Errorf("no signature of %s -> %v", manifestPath, err)
+		}
+		defer signature.Close()
+		if _, err := openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(data), signature, nil); err != nil {
+			return nil, fmt.Errorf("invalid signature of %s -> %v", manifestPath, err)
+		}
+		debugLogf("The signature of %s is valid", manifestPath)
+	}
+	manifest := &runManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s -> %v", manifestPath, err)
+	}
+	return manifest, nil
+}
+
+// verifyManifest checks the archives of every repository of a manifest,
+// logging the failures, and returns the number of repositories whose
+// archives failed
+func verifyManifest(manifest *runManifest, archiveDir string, hashOnly bool, decryption *archiveDecryption) int {
+	failed := 0
+	for _, repo := range manifest.Repositories {
+		if err := verifyArchives(repo.Archives, archiveDir, hashOnly, decryption); err != nil {
+			log.Printf("FAILED %s/%s: %v\n", repo.Namespace, repo.Name, err)
+			failed++
+			continue
+		}
+		log.Printf("OK %s/%s\n", repo.Namespace, repo.Name)
+	}
+	return failed
+}
+
+// verifyArchives checks the sizes and SHA-256 of the files of the archives
+// of a repository, in the archive directory, then extracts them into a
+// temporary directory, with the external 7z tool for the 7z archives, and
+// runs git fsck on the extracted repository.
+// The manifest of a chain of bundles is written again along with each
+// bundle, so that only the bundles it lists are checked, as they are
+// restored.
+func verifyArchives(archives []archiveReport, archiveDir string, hashOnly bool, decryption *archiveDecryption) error {
+	var extract string
+	for _, a := range archives {
+		file := filepath.Join(archiveDir, filepath.Base(a.Path))
+		if strings.HasSuffix(file, bundleManifestSuffix) {
+			if _, err := os.Stat(file); err != nil {
+				return err
+			}
+			extract = file
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		if info.Size() != a.Size || sum != a.SHA256 {
+			return fmt.Errorf("%s has %d bytes of SHA-256 %s, expected %d bytes of SHA-256 %s", file, info.Size(), sum, a.Size, a.SHA256)
+		}
+		if extract == "" {
+			extract = file
+		}
+	}
+	if hashOnly || extract == "" {
+		return nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gitbackup-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	var repoDir string
+	if strings.Contains(filepath.Base(extract), "."+archiveFormat7z) {
+		repoDir, err = extract7zArchive(extract, tmpDir, decryption.password)
+	} else {
+		repoDir, err = extractRepository(extract, tmpDir, decryption)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %s -> %v", extract, err)
+	}
+	debugLogf("Running git fsck in %s", repoDir)
+	if out, err := execCommand(gitCommand, "-C", repoDir, "fsck", "--no-progress", "--no-dangling").CombinedOutput(); err != nil {
+		return fmt.Errorf("git fsck of %s failed -> %v: %s", extract, err, out)
+	}
+	return nil
+}
+
+// extractRepository extracts the repository of an archive into a
+// directory, or restores it from the manifest of a chain of bundles, and
+// returns the directory of the repository
+func extractRepository(archivePath, dir string, decryption *archiveDecryption) (string, error) {
+	repoDir := filepath.Join(dir, "repo")
+	if strings.HasSuffix(archivePath, bundleManifestSuffix) {
+		return repoDir, restoreBundles(archivePath, repoDir, decryption)
+	}
+	if err := restoreArchive(archivePath, repoDir, decryption); err != nil {
+		return "", err
+	}
+	return getExtractedRepoDir(repoDir)
+}
+
+// extract7zArchive extracts the repository of a 7z archive, or of its
+// first volume, into a directory with the external 7z tool, and returns
+// the directory of the repository
+func extract7zArchive(archivePath, dir, password string) (string, error) {
+	repoDir := filepath.Join(dir, "repo")
+	args := []string{"x", "-y", "-o" + repoDir}
+	if password != "" {
+		args = append(args, "-p"+password)
+	}
+	// 7z reads no password from the standard input, and fails on the
+	// encrypted archives when none is given
+	out, err := execCommand(archiveCommand, append(args, archivePath)...).CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%s is needed to verify the 7z archives -> %v", archiveCommand, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	return getExtractedRepoDir(repoDir)
+}
+
+// getExtractedRepoDir returns the directory of the repository extracted
+// from an archive, its only entry
+func getExtractedRepoDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return "", fmt.Errorf("expected a single repository in the archive, got %d entries", len(entries))
+	}
+	return filepath.Join(dir, entries[0].Name()), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// setupVerifyTests clones a new remote to archive
+func setupVerifyTests(t *testing.T, format string) string {
+	remote := newTestRemote(t)
+	setupArchiveTests(t, format)
+	repoDir := filepath.Join(t.TempDir(), "r1")
+	runTestGit(t, "clone", "-q", remote, repoDir)
+	return repoDir
+}
+
+// writeTestRunManifest archives the repository and writes the manifest
+// of a run which archived it
+func writeTestRunManifest(t *testing.T, repoDir string) (string, *runReport) {
+	t.Helper()
+	archives, out, err := archiveRepository(&Repository{Namespace: "ns", Name: "r1"}, filepath.Base(repoDir), repoDir)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	r := &runReport{
+		StartedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		GitHost:   "github.com",
+		Repositories: []*repoReport{
+			{Namespace: "ns", Name: "r1", Archives: archives, RefsFingerprint: "fingerprint"},
+			{Namespace: "ns", Name: "r2"},
+		},
+	}
+	manifestPath, err := writeRunManifest(&appCfg, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifestPath, r
+}
+
+func TestVerifyManifest(t *testing.T) {
+	repoDir := setupVerifyTests(t, archiveFormatTarZst)
+	appCfg.archiveVolumeSize = 1000
+	manifestPath, r := writeTestRunManifest(t, repoDir)
+	if filepath.Base(manifestPath) != "MANIFEST-github.com-2024-01-01-00-00-00+0000.json" || r.Manifest != manifestPath {
+		t.Fatalf("Unexpected manifest %s", manifestPath)
+	}
+
+	manifest, err := readRunManifest(manifestPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Repositories) != 1 || manifest.Tool != "gitbackup" || manifest.Version == "" {
+		t.Fatalf("Expected a single archived repository, got %+v", manifest)
+	}
+	archives := manifest.Repositories[0].Archives
+	if len(archives) < 2 || len(archives[0].SHA256) != 64 {
+		t.Fatalf("Expected the volumes of the archive with their SHA-256, got %+v", archives)
+	}
+	if failed := verifyManifest(manifest, appCfg.archiveDir, false, &archiveDecryption{}); failed != 0 {
+		t.Fatalf("Expected the archives to be verified")
+	}
+
+	data, _ := os.ReadFile(archives[1].Path)
+	data[0] ^= 0xff
+	os.WriteFile(archives[1].Path, data, 0640)
+	err = verifyArchives(archives, appCfg.archiveDir, true, &archiveDecryption{})
+	if err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("Expected an altered volume to be detected, got %v", err)
+	}
+	os.Remove(archives[1].Path)
+	if failed := verifyManifest(manifest, appCfg.archiveDir, true, &archiveDecryption{}); failed != 1 {
+		t.Errorf("Expected a missing volume to fail the verification")
+	}
+}
+
+func TestVerifyManifestFsck(t *testing.T) {
+	repoDir := setupVerifyTests(t, archiveFormatTarGz)
+	// Corrupt a loose object of the repository
+	objects, _ := filepath.Glob(filepath.Join(repoDir, ".git", "objects", "??", "*"))
+	if len(objects) == 0 {
+		t.Fatal("Expected loose objects")
+	}
+	for _, object := range objects {
+		os.Remove(object)
+		os.WriteFile(object, []byte("corrupt"), 0644)
+	}
+	manifestPath, _ := writeTestRunManifest(t, repoDir)
+	manifest, err := readRunManifest(manifestPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyArchives(manifest.Repositories[0].Archives, appCfg.archiveDir, false, &archiveDecryption{})
+	if err == nil || !strings.Contains(err.Error(), "git fsck") {
+		t.Errorf("Expected git fsck to fail, got %v", err)
+	}
+}
+
+func TestVerifyManifestBundles(t *testing.T) {
+	_, repoDir := setupBundleTests(t)
+	manifestPath, _ := writeTestRunManifest(t, repoDir)
+	manifest, err := readRunManifest(manifestPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := verifyManifest(manifest, appCfg.archiveDir, false, &archiveDecryption{}); failed != 0 {
+		t.Errorf("Expected the chain of bundles to be verified")
+	}
+}
+
+// fake7zExtractCommand runs TestHelper7zExtractProcess instead of 7z, and
+// git itself
+func fake7zExtractCommand(command string, args ...string) *exec.Cmd {
+	if command != archiveCommand {
+		return exec.Command(command, args...)
+	}
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelper7zExtractProcess", "--", command}, args...)...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+func TestHelper7zExtractProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args[3:]
+	if args[1] != "x" || !strings.HasPrefix(args[3], "-o") {
+		fmt.Fprintf(os.Stdout, "Expected 7z x to be executed. Got %v", args)
+		os.Exit(1)
+	}
+	if !contains(args, "-psecret") {
+		fmt.Fprintf(os.Stdout, "ERROR: Wrong password")
+		os.Exit(2)
+	}
+	if out, err := exec.Command("git", "init", "-q", filepath.Join(strings.TrimPrefix(args[3], "-o"), "r1")).CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stdout, "%v: %s", err, out)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestVerifyArchives7z(t *testing.T) {
+	archiveDir := t.TempDir()
+	archivePath := filepath.Join(archiveDir, "ns-r1-2024-01-01-00-00-00+0000.enc.7z.001")
+	os.WriteFile(archivePath, []byte("7z"), 0640)
+	sum, err := hashFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives := []archiveReport{{Path: archivePath, Size: 2, SHA256: sum}}
+	execCommand = fake7zExtractCommand
+	defer func() { execCommand = exec.Command }()
+
+	if err := verifyArchives(archives, archiveDir, false, &archiveDecryption{password: "secret"}); err != nil {
+		t.Errorf("Expected the 7z archive to be extracted and verified, got %v", err)
+	}
+	err = verifyArchives(archives, archiveDir, false, &archiveDecryption{})
+	if err == nil || !strings.Contains(err.Error(), "Wrong password") {
+		t.Errorf("Expected an encrypted 7z archive to fail without its password, got %v", err)
+	}
+
+	defer func(command string) { archiveCommand = command }(archiveCommand)
+	archiveCommand = filepath.Join(t.TempDir(), "7z")
+	execCommand = exec.Command
+	err = verifyArchives(archives, archiveDir, false, &archiveDecryption{password: "secret"})
+	if err == nil || !strings.Contains(err.Error(), "is needed to verify the 7z archives") {
+		t.Errorf("Expected the verification to fail without 7z, got %v", err)
+	}
+}
+
+func TestRunManifestSignature(t *testing.T) {
+	repoDir := setupVerifyTests(t, archiveFormatZip)
+	keyDir := t.TempDir()
+	writePublicKey := func(entity *openpgp.Entity) string {
+		var public bytes.Buffer
+		w, _ := armor.Encode(&public, openpgp.PublicKeyType, nil)
+		entity.Serialize(w)
+		w.Close()
+		file := filepath.Join(keyDir, entity.PrimaryKey.KeyIdString()+".asc")
+		os.WriteFile(file, public.Bytes(), 0644)
+		return file
+	}
+	signer, err := openpgp.NewEntity("gitbackup", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := filepath.Join(keyDir, "private.gpg")
+	var private bytes.Buffer
+	signer.SerializePrivate(&private, nil)
+	os.WriteFile(privateKey, private.Bytes(), 0600)
+	if appCfg.manifestSignKey, err = readManifestSignKey(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { appCfg.manifestSignKey = nil })
+
+	manifestPath, _ := writeTestRunManifest(t, repoDir)
+	if _, err := readRunManifest(manifestPath, writePublicKey(signer)); err != nil {
+		t.Errorf("Expected the signature to be valid, got %v", err)
+	}
+	if _, err := readRunManifest(manifestPath, writePublicKey(other)); err == nil {
+		t.Errorf("Expected the signature of another key to be rejected")
+	}
+	data, _ := os.ReadFile(manifestPath)
+	os.WriteFile(manifestPath, bytes.Replace(data, []byte(`"ns"`), []byte(`"xx"`), 1), 0640)
+	if _, err := readRunManifest(manifestPath, writePublicKey(signer)); err == nil {
+		t.Errorf("Expected an altered manifest to be rejected")
+	}
+}
+
+func TestGroupArchivesManifests(t *testing.T) {
+	repos := groupArchives([]string{
+		"MANIFEST-github.com-2024-01-01-00-00-00+0000.json",
+		"MANIFEST-github.com-2024-01-01-00-00-00+0000.json.asc",
+		"MANIFEST-github.com-2024-01-02-00-00-00+0000.json",
+	})
+	manifests := repos["MANIFEST-github.com"]
+	if len(repos) != 1 || len(manifests) != 2 || len(manifests[1].files) != 2 {
+		t.Errorf("Expected the manifests along with their signatures, got %+v", manifests)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webdavPasswordEnv is the environment variable with the password of the
+// WebDAV user
+const webdavPasswordEnv = "GITBACKUP_WEBDAV_PASSWORD"
+
+// webdavConfig holds the -storage.webdav.* options
+type webdavConfig struct {
+	url  string
+	user string
+}
+
+// webdavStorage uploads the archives to a WebDAV share, e.g. Nextcloud
+type webdavStorage struct {
+	baseURL  *url.URL
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newWebDAVStorage(config webdavConfig) (*webdavStorage, error) {
+	if config.url == "" {
+		return nil, errors.New("no -storage.webdav.url to upload the archives to")
+	}
+	u, err := url.Parse(strings.TrimSuffix(config.url, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebDAV URL %s: %v", config.url, err)
+	}
+	return &webdavStorage{
+		baseURL:  u,
+		user:     config.user,
+		password: os.Getenv(webdavPasswordEnv),
+		client:   &http.Client{},
+	}, nil
+}
+
+func (s *webdavStorage) url(key string) string {
+	u := *s.baseURL
+	u.Path = path.Join(u.Path, key)
+	return u.String()
+}
+
+func (s *webdavStorage) location(key string) string {
+	return s.url(key)
+}
+
+// do sends a request, with a body of the given length which is sent
+// chunked when -1. The body is not closed, so a file can be sent again.
+func (s *webdavStorage) do(method, key string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	if body != nil {
+		body = io.NopCloser(body)
+	}
+	req, err := http.NewRequest(method, s.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	return s.client.Do(req)
+}
+
+// expectStatus drains and closes the response, returning an error unless
+// it has one of the expected status codes
+func expectStatus(resp *http.Response, err error, method, key string, expected ...int) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("WebDAV %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// stat returns the size and the modification time of a file of the share,
+// a size of -1 if it does not exist
+func (s *webdavStorage) stat(key string) (int64, time.Time, error) {
+	propfind := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/></prop></propfind>`
+	resp, err := s.do("PROPFIND", key, strings.NewReader(propfind), int64(len(propfind)), http.Header{
+		"Depth":        {"0"},
+		"Content-Type": {"application/xml"},
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return -1, time.Time{}, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return 0, time.Time{}, fmt.Errorf("WebDAV PROPFIND %s: %s", key, resp.Status)
+	}
+	var multistatus struct {
+		Responses []struct {
+			ContentLength string `xml:"propstat>prop>getcontentlength"`
+			LastModified  string `xml:"propstat>prop>getlastmodified"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return 0, time.Time{}, err
+	}
+	if len(multistatus.Responses) == 0 {
+		return 0, time.Time{}, fmt.Errorf("WebDAV PROPFIND %s: no size", key)
+	}
+	size, err := strconv.ParseInt(multistatus.Responses[0].ContentLength, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	// Unknown when missing or invalid, and then not resumed
+	modTime, _ := http.ParseTime(multistatus.Responses[0].LastModified)
+	return size, modTime, nil
+}
+
+// list returns the files of a collection, from a PROPFIND of depth 1
+func (s *webdavStorage) list(dir string) ([]string, error) {
+	propfind := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+	resp, err := s.do("PROPFIND", dir+"/", strings.NewReader(propfind), int64(len(propfind)), http.Header{
+		"Depth":        {"1"},
+		"Content-Type": {"application/xml"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("WebDAV PROPFIND %s: %s", dir, resp.Status)
+	}
+	var multistatus struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, r := range multistatus.Responses {
+		if r.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, path.Base(href))
+	}
+	return names, nil
+}
+
+func (s *webdavStorage) remove(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, nil)
+	return expectStatus(resp, err, http.MethodDelete, key, http.StatusOK, http.StatusNoContent)
+}
+
+// mkdirAll creates a collection and its parents
+func (s *webdavStorage) mkdirAll(dir string) error {
+	var current string
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		current = path.Join(current, name)
+		resp, err := s.do("MKCOL", current+"/", nil, 0, nil)
+		// 405 Method Not Allowed when it exists
+		if err := expectStatus(resp, err, "MKCOL", current, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload uploads a file to <key>.part, resuming a previous upload of the
+// same file where the server supports appending to a file (sabre/dav, used
+// by Nextcloud), and moves it to key once its SHA-256 is verified
+func (s *webdavStorage) upload(localPath, key string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sum, err := hashReader(f)
+	if err != nil {
+		return err
+	}
+	if err := s.mkdirAll(path.Dir(key)); err != nil {
+		return err
+	}
+
+	partKey := key + partialUploadSuffix
+	partSize, partModTime, err := s.stat(partKey)
+	if err != nil {
+		return err
+	}
+	resumed := false
+	if resumablePart(partSize, partModTime, info) {
+		debugLogf("Resuming the upload of %s at %d bytes", localPath, partSize)
+		if _, err := f.Seek(partSize, io.SeekStart); err != nil {
+			return err
+		}
+		resp, err := s.do(http.MethodPatch, partKey, f, info.Size()-partSize, http.Header{
+			"Content-Type":   {"application/x-sabredav-partialupdate"},
+			"X-Update-Range": {"append"},
+		})
+		err = expectStatus(resp, err, http.MethodPatch, partKey, http.StatusOK, http.StatusNoContent)
+		if err == nil {
+			err = s.verifyPart(partKey, info.Size(), sum)
+		}
+		if err != nil {
+			debugLogf("Could not resume the upload of %s, uploading it again: %v", localPath, err)
+		} else {
+			resumed = true
+		}
+	}
+	if !resumed {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		resp, err := s.do(http.MethodPut, partKey, f, info.Size(), http.Header{"Content-Type": {"application/octet-stream"}})
+		if err := expectStatus(resp, err, http.MethodPut, partKey, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+			return err
+		}
+		if err := s.verifyPart(partKey, info.Size(), sum); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.do("MOVE", partKey, nil, 0, http.Header{
+		"Destination": {s.url(key)},
+		"Overwrite":   {"T"},
+	})
+	return expectStatus(resp, err, "MOVE", partKey, http.StatusCreated, http.StatusNoContent)
+}
+
+// verifyPart checks that partKey has the size and the SHA-256 of the
+// file, downloading it, and removes it when it has not
+func (s *webdavStorage) verifyPart(partKey string, size int64, sum string) error {
+	partSize, _, err := s.stat(partKey)
+	if err != nil {
+		return err
+	}
+	if partSize != size {
+		s.remove(partKey)
+		return fmt.Errorf("uploaded %d bytes, %s has %d", size, s.location(partKey), partSize)
+	}
+	resp, err := s.do(http.MethodGet, partKey, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WebDAV %s %s: %s", http.MethodGet, partKey, resp.Status)
+	}
+	partSum, err := hashReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	if partSum != sum {
+		s.remove(partKey)
+		return fmt.Errorf("the SHA-256 of %s is %s, expected %s", s.location(partKey), partSum, sum)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// newTestWebDAVServer serves a directory over WebDAV, with the appending
+// PATCH of sabre/dav when appendable is set
+func newTestWebDAVServer(t *testing.T, appendable bool) (string, *webdavStorage) {
+	dir := t.TempDir()
+	handler := &webdav.Handler{Prefix: "/dav", FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "backup" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			if !appendable || r.Header.Get("X-Update-Range") != "append" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			f, err := os.OpenFile(filepath.Join(dir, strings.TrimPrefix(r.URL.Path, "/dav/")), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			defer f.Close()
+			io.Copy(f, r.Body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	t.Setenv(webdavPasswordEnv, "secret")
+
+	storage, err := newWebDAVStorage(webdavConfig{url: ts.URL + "/dav/", user: "backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, storage
+}
+
+func TestWebDAVStorageUpload(t *testing.T) {
+	for _, appendable := range []bool{true, false} {
+		dir, storage := newTestWebDAVServer(t, appendable)
+		archive := filepath.Join(t.TempDir(), "ns-r1.tar.zst")
+		os.WriteFile(archive, []byte("0123456789"), 0644)
+
+		// An interrupted upload is resumed, or uploaded again
+		os.MkdirAll(filepath.Join(dir, "github.com"), 0755)
+		os.WriteFile(filepath.Join(dir, "github.com", "ns-r1.tar.zst.part"), []byte("01234"), 0644)
+
+		if err := storage.upload(archive, "github.com/ns-r1.tar.zst"); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "github.com", "ns-r1.tar.zst")); string(data) != "0123456789" {
+			t.Errorf("appendable=%t: expected the archive to be uploaded, got %q", appendable, data)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "github.com", "ns-r1.tar.zst.part")); err == nil {
+			t.Errorf("appendable=%t: expected the partial upload to be moved", appendable)
+		}
+
+		// A partial upload of another file is uploaded again, whether
+		// older than the file or with other content
+		stale := filepath.Join(dir, "github.com", "ns-r1.tar.zst.part")
+		for _, modTime := range []time.Time{time.Now().Add(-time.Hour), time.Now().Add(time.Hour)} {
+			os.WriteFile(stale, []byte("abcde"), 0644)
+			os.Chtimes(stale, modTime, modTime)
+			if err := storage.upload(archive, "github.com/ns-r1.tar.zst"); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, "github.com", "ns-r1.tar.zst")); string(data) != "0123456789" {
+				t.Errorf("appendable=%t: expected the partial upload of another file to be discarded, got %q", appendable, data)
+			}
+		}
+	}
+
+	// A new directory is created
+	dir, storage := newTestWebDAVServer(t, true)
+	archive := filepath.Join(t.TempDir(), "ns-r2.tar.zst")
+	os.WriteFile(archive, []byte("archive"), 0644)
+	if err := storage.upload(archive, "gitlab.com/ns-r2.tar.zst"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gitlab.com", "ns-r2.tar.zst")); err != nil {
+		t.Errorf("Expected the archive in a new directory")
+	}
+}
+
+func TestWebDAVStorageList(t *testing.T) {
+	dir, storage := newTestWebDAVServer(t, true)
+	os.MkdirAll(filepath.Join(dir, "github.com", "subdir"), 0755)
+	os.WriteFile(filepath.Join(dir, "github.com", "ns-r1 2024.tar.zst"), []byte("archive"), 0644)
+
+	if names, err := storage.list("github.com"); err != nil || !reflect.DeepEqual(names, []string{"ns-r1 2024.tar.zst"}) {
+		t.Errorf("Expected the archive to be listed, got %v, %v", names, err)
+	}
+	if err := storage.remove("github.com/ns-r1 2024.tar.zst"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := storage.list("github.com"); err != nil || len(names) != 0 {
+		t.Errorf("Expected the archive to be removed, got %v, %v", names, err)
+	}
+	if names, err := storage.list("gitlab.com"); err != nil || len(names) != 0 {
+		t.Errorf("Expected no archives of another git host, got %v, %v", names, err)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Maximum size of a webhook payload we accept
+const maxWebhookPayloadSize = 25 << 20
+
+var errWebhookSignature = errors.New("invalid webhook signature")
+
+// webhookReceiver backs up single repositories on push webhooks from
+// GitHub, GitLab, Gitea and Bitbucket. Pushes to the same repository
+// within the debounce period result in a single update.
+type webhookReceiver struct {
+	c        *appConfig
+	secret   string
+	debounce time.Duration
+	gitHost  string
+
+	mu      sync.Mutex
+	jobs    map[string]*webhookJob
+	tokens  chan bool
+	running sync.WaitGroup
+
+	// backup is called to back up a repository, it's a field so that we
+	// can override it in the tests
+	backup func(repo *Repository)
+}
+
+type webhookJob struct {
+	repo    *Repository
+	timer   *time.Timer
+	running bool
+	again   bool
+}
+
+// webhookRepository is the part of the push payloads we are interested in.
+// GitHub and Gitea use the same payload format.
+type webhookRepository struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Private  bool   `json:"private"`
+	Fork     bool   `json:"fork"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+
+	// Bitbucket
+	UUID      string `json:"uuid"`
+	IsPrivate bool   `json:"is_private"`
+	Links     struct {
+		HTML struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+}
+
+type webhookPayload struct {
+	Repository webhookRepository `json:"repository"`
+
+	// GitLab
+	Project struct {
+		ID                int64  `json:"id"`
+		Name              string `json:"name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		GitHTTPURL        string `json:"git_http_url"`
+		VisibilityLevel   int    `json:"visibility_level"`
+	} `json:"project"`
+}
+
+func newWebhookReceiver(c *appConfig, secret string) *webhookReceiver {
+	r := &webhookReceiver{
+		c:        c,
+		secret:   secret,
+		debounce: c.webhookDebounce,
+		gitHost:  filepath.Base(c.backupDir),
+		jobs:     map[string]*webhookJob{},
+		tokens:   make(chan bool, c.maxConcurrentClones),
+	}
+	r.backup = func(repo *Repository) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &wg)
+		if err != nil {
+			log.Printf("Error backing up %s: %s\n", repo.Name, stdoutStderr)
+		} else {
+			log.Printf("Backed up %s/%s on push", repo.Namespace, repo.Name)
+		}
+	}
+	return r
+}
+
+func handleWebhookReceiver(client interface{}, c *appConfig) error {
+	secret := os.Getenv("GITBACKUP_WEBHOOK_SECRET")
+	if secret == "" {
+		return errors.New("GITBACKUP_WEBHOOK_SECRET environment variable not set")
+	}
+	var err error
+	gitHostUsername, err = getUsername(client, c.service)
+	if err != nil {
+		return err
+	}
+	if len(gitHostUsername) == 0 && !*ignorePrivate && *useHTTPSClone {
+		return errors.New("Your Git host's username is needed for backing up private repositories via HTTPS")
+	}
+
+	currentState, err = openStateStore(getStateDBPath(c), filepath.Base(c.backupDir))
+	if err != nil {
+		return err
+	}
+	defer func() { currentState = nil }()
+
+	r := newWebhookReceiver(c, secret)
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", r)
+	server := &http.Server{Addr: c.webhookListenAddr, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("Listening for push webhooks on %s/webhook", c.webhookListenAddr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Println("Waiting for the running backups to finish")
+	r.wait()
+	return nil
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookPayloadSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo, err := r.parsePush(req.Header, body)
+	if err != nil {
+		if errors.Is(err, errWebhookSignature) {
+			log.Printf("Rejected webhook from %s: %v", req.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if repo == nil {
+		// Not a push, e.g. a ping
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if reason := r.ignoreReason(repo); reason != "" {
+		debugLogf("Ignoring push to %s/%s: %s", repo.Namespace, repo.Name, reason)
+		http.Error(w, reason, http.StatusUnprocessableEntity)
+		return
+	}
+
+	debugLogf("Push to %s/%s, backing up in %s", repo.Namespace, repo.Name, r.debounce)
+	r.enqueue(repo)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parsePush verifies the webhook and maps its payload to the pushed
+// repository. It returns no repository for events other than pushes.
+func (r *webhookReceiver) parsePush(header http.Header, body []byte) (*Repository, error) {
+	var event string
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		event = header.Get("X-Gitea-Event")
+		if !validHMACSignature(r.secret, body, header.Get("X-Gitea-Signature")) {
+			return nil, errWebhookSignature
+		}
+	case header.Get("X-GitHub-Event") != "":
+		event = header.Get("X-GitHub-Event")
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") || !validHMACSignature(r.secret, body, strings.TrimPrefix(signature, "sha256=")) {
+			return nil, errWebhookSignature
+		}
+	case header.Get("X-Gitlab-Event") != "":
+		event = header.Get("X-Gitlab-Event")
+		if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(r.secret)) != 1 {
+			return nil, errWebhookSignature
+		}
+	case header.Get("X-Event-Key") != "":
+		event = header.Get("X-Event-Key")
+		signature := header.Get("X-Hub-Signature")
+		if !strings.HasPrefix(signature, "sha256=") || !validHMACSignature(r.secret, body, strings.TrimPrefix(signature, "sha256=")) {
+			return nil, errWebhookSignature
+		}
+	default:
+		return nil, errors.New("unknown webhook sender")
+	}
+
+	if event != "push" && event != "Push Hook" && event != "Tag Push Hook" && event != "repo:push" {
+		return nil, nil
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %v", err)
+	}
+
+	var repo *Repository
+	switch event {
+	case "Push Hook", "Tag Push Hook":
+		p := payload.Project
+		repo = &Repository{
+			ID:        webhookRepositoryID(p.ID),
+			Name:      p.Name,
+			Namespace: strings.Split(p.PathWithNamespace, "/")[0],
+			Private:   p.VisibilityLevel == 0,
+			CloneURL:  p.GitSSHURL,
+		}
+		if *useHTTPSClone {
+			repo.CloneURL = p.GitHTTPURL
+		}
+	case "repo:push":
+		p := payload.Repository
+		parts := strings.SplitN(p.FullName, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid repository name: %s", p.FullName)
+		}
+		u, err := url.Parse(p.Links.HTML.Href)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid repository link: %s", p.Links.HTML.Href)
+		}
+		repo = &Repository{
+			ID:        p.UUID,
+			Name:      parts[1],
+			Namespace: parts[0],
+			Private:   p.IsPrivate,
+			CloneURL:  fmt.Sprintf("git@%s:%s.git", u.Host, p.FullName),
+		}
+		if *useHTTPSClone {
+			repo.CloneURL = fmt.Sprintf("https://%s/%s.git", u.Host, p.FullName)
+		}
+	default:
+		p := payload.Repository
+		repo = &Repository{
+			ID:        webhookRepositoryID(p.ID),
+			Name:      p.Name,
+			Namespace: strings.Split(p.FullName, "/")[0],
+			Private:   p.Private,
+			Fork:      p.Fork,
+			CloneURL:  p.SSHURL,
+		}
+		if *useHTTPSClone {
+			repo.CloneURL = p.CloneURL
+		}
+	}
+	if repo.Name == "" || repo.Namespace == "" || repo.CloneURL == "" {
+		return nil, errors.New("webhook payload is missing the repository details")
+	}
+	return repo, nil
+}
+
+// webhookRepositoryID returns the ID of a repository in a push payload the
+// way it is listed, so that its state is the same whether it is backed up
+// on push or by a full backup run
+func webhookRepositoryID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// ignoreReason returns why a pushed repository is not backed up, if it is
+// not, applying the same options as a full backup run
+func (r *webhookReceiver) ignoreReason(repo *Repository) string {
+	if host := cloneURLHost(repo.CloneURL); host != r.gitHost {
+		return fmt.Sprintf("repository is hosted on %s, not %s", host, r.gitHost)
+	}
+	if repo.Private && r.c.ignorePrivate {
+		return "private repositories are ignored"
+	}
+	if repo.Fork && r.c.ignoreFork {
+		return "forks are ignored"
+	}
+	if r.c.service == "github" && len(r.c.githubNamespaceWhitelist) > 0 && !contains(r.c.githubNamespaceWhitelist, repo.Namespace) {
+		return "namespace is not whitelisted"
+	}
+	// The push payloads do not have the other attributes of the repository
+	if reason := r.c.filter.nameExclusionReason(repo); reason != "" {
+		return reason
+	}
+	return ""
+}
+
+// enqueue schedules a backup of the repository after the debounce period,
+// postponing an already scheduled one
+func (r *webhookReceiver) enqueue(repo *Repository) {
+	key := repo.Namespace + "/" + repo.Name
+	setCloneStrategy(r.c, repo)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[key]
+	if !ok {
+		job = &webhookJob{}
+		r.jobs[key] = job
+	}
+	job.repo = repo
+	if job.timer != nil {
+		job.timer.Reset(r.debounce)
+		return
+	}
+	job.timer = time.AfterFunc(r.debounce, func() { r.fire(key) })
+}
+
+// fire starts the backup of a repository once its debounce period is over.
+// If a backup of the repository is still running, another one is made
+// after it, so that the latest push is always backed up.
+func (r *webhookReceiver) fire(key string) {
+	r.mu.Lock()
+	job := r.jobs[key]
+	job.timer = nil
+	if job.running {
+		job.again = true
+		r.mu.Unlock()
+		return
+	}
+	job.running = true
+	r.running.Add(1)
+	r.mu.Unlock()
+
+	go func() {
+		defer r.running.Done()
+		for {
+			r.mu.Lock()
+			// backUp modifies the clone URL, so we work on a copy
+			repo := *job.repo
+			r.mu.Unlock()
+
+			r.tokens <- true
+			r.backup(&repo)
+			<-r.tokens
+
+			r.mu.Lock()
+			if job.again {
+				job.again = false
+				r.mu.Unlock()
+				continue
+			}
+			job.running = false
+			if job.timer == nil {
+				delete(r.jobs, key)
+			}
+			r.mu.Unlock()
+			return
+		}
+	}()
+}
+
+// wait waits for the scheduled and running backups to finish
+func (r *webhookReceiver) wait() {
+	for {
+		r.mu.Lock()
+		pending := len(r.jobs)
+		r.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	r.running.Wait()
+}
+
+func validHMACSignature(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// cloneURLHost returns the host of a HTTPS or SSH (including scp-like
+// user@host:path) clone URL
+func cloneURLHost(cloneURL string) string {
+	if u, err := url.Parse(cloneURL); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	host := cloneURL
+	if i := strings.Index(host, "@"); i != -1 {
+		host = host[i+1:]
+	}
+	if i := strings.Index(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	return host
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "s3cr3t"
+
+func signWebhook(body string) string {
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestWebhookReceiver(service, gitHost string) *webhookReceiver {
+	useHTTPSClone = new(bool)
+	c := &appConfig{service: service, backupDir: "/backups/" + gitHost, maxConcurrentClones: 2, webhookDebounce: 50 * time.Millisecond}
+	return newWebhookReceiver(c, testWebhookSecret)
+}
+
+func TestWebhookParsePush(t *testing.T) {
+	githubPayload := `{"repository": {"id": 1296269, "name": "r1", "full_name": "user1/r1", "private": true, "ssh_url": "git@github.com:user1/r1.git", "clone_url": "https://github.com/user1/r1.git"}}`
+	gitlabPayload := `{"project": {"id": 15, "name": "r2", "path_with_namespace": "group1/r2", "git_ssh_url": "git@gitlab.com:group1/r2.git", "visibility_level": 20}}`
+	bitbucketPayload := `{"repository": {"uuid": "{21fa9bf8-b5b2-4891-97ed-d590bad0f871}", "full_name": "ws1/r3", "name": "R3", "is_private": true, "links": {"html": {"href": "https://bitbucket.org/ws1/r3"}}}}`
+
+	var testCases = []struct {
+		name     string
+		headers  map[string]string
+		body     string
+		wantErr  bool
+		wantRepo *Repository
+	}{
+		{
+			"github push",
+			map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(githubPayload)},
+			githubPayload, false,
+			&Repository{ID: "1296269", Namespace: "user1", Name: "r1", Private: true, CloneURL: "git@github.com:user1/r1.git"},
+		},
+		{
+			"github invalid signature",
+			map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook("other")},
+			githubPayload, true, nil,
+		},
+		{
+			"github ping",
+			map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + signWebhook("{}")},
+			"{}", false, nil,
+		},
+		{
+			"gitea push",
+			map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push", "X-Gitea-Signature": signWebhook(githubPayload)},
+			githubPayload, false,
+			&Repository{ID: "1296269", Namespace: "user1", Name: "r1", Private: true, CloneURL: "git@github.com:user1/r1.git"},
+		},
+		{
+			"gitlab push",
+			map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": testWebhookSecret},
+			gitlabPayload, false,
+			&Repository{ID: "15", Namespace: "group1", Name: "r2", CloneURL: "git@gitlab.com:group1/r2.git"},
+		},
+		{
+			"gitlab invalid token",
+			map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"},
+			gitlabPayload, true, nil,
+		},
+		{
+			"bitbucket push",
+			map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=" + signWebhook(bitbucketPayload)},
+			bitbucketPayload, false,
+			&Repository{ID: "{21fa9bf8-b5b2-4891-97ed-d590bad0f871}", Namespace: "ws1", Name: "r3", Private: true, CloneURL: "git@bitbucket.org:ws1/r3.git"},
+		},
+		{
+			"unknown sender",
+			map[string]string{},
+			githubPayload, true, nil,
+		},
+	}
+
+	r := newTestWebhookReceiver("github", "github.com")
+	for _, tc := range testCases {
+		header := http.Header{}
+		for k, v := range tc.headers {
+			header.Set(k, v)
+		}
+		repo, err := r.parsePush(header, []byte(tc.body))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if tc.wantRepo == nil {
+			if repo != nil {
+				t.Errorf("%s: expected no repository, got %+v", tc.name, repo)
+			}
+			continue
+		}
+		if repo == nil || !reflect.DeepEqual(repo, tc.wantRepo) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.wantRepo, repo)
+		}
+	}
+}
+
+func TestWebhookIgnoresOtherHosts(t *testing.T) {
+	r := newTestWebhookReceiver("gitlab", "gitlab.com")
+	if reason := r.ignoreReason(&Repository{Namespace: "ns", Name: "r", CloneURL: "https://gitlab.com/ns/r.git"}); reason != "" {
+		t.Errorf("Expected the repository to be backed up, got %s", reason)
+	}
+	if reason := r.ignoreReason(&Repository{Namespace: "ns", Name: "r", CloneURL: "git@github.com:ns/r.git"}); reason == "" {
+		t.Errorf("Expected a repository on another host to be ignored")
+	}
+	r.c.ignoreFork = true
+	if reason := r.ignoreReason(&Repository{Namespace: "ns", Name: "r", CloneURL: "git@gitlab.com:ns/r.git", Fork: true}); reason == "" {
+		t.Errorf("Expected a fork to be ignored")
+	}
+}
+
+func TestWebhookDebounce(t *testing.T) {
+	r := newTestWebhookReceiver("github", "github.com")
+	var mu sync.Mutex
+	backups := map[string]int{}
+	r.backup = func(repo *Repository) {
+		mu.Lock()
+		backups[repo.Namespace+"/"+repo.Name]++
+		mu.Unlock()
+	}
+
+	body := `{"repository": {"id": 1296269, "name": "r1", "full_name": "user1/r1", "ssh_url": "git@github.com:user1/r1.git"}}`
+	server := httptest.NewServer(r)
+	defer server.Close()
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", "sha256="+signWebhook(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected the push to be accepted, got %s", resp.Status)
+		}
+	}
+	r.enqueue(&Repository{Namespace: "user1", Name: "r2", CloneURL: "git@github.com:user1/r2.git"})
+	r.wait()
+
+	if backups["user1/r1"] != 1 || backups["user1/r2"] != 1 {
+		t.Errorf("Expected a single backup per repository, got %v", backups)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// getRemoteDefaultBranch returns the default branch of the origin remote,
+// falling back to the branch HEAD points to locally
+func getRemoteDefaultBranch(repoDir string) (string, error) {
+	out, err := execCommand(gitCommand, "-C", repoDir, "ls-remote", "--symref", "origin", "HEAD").Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "ref: refs/heads/") && strings.HasSuffix(line, "\tHEAD") {
+				return strings.TrimSuffix(strings.TrimPrefix(line, "ref: refs/heads/"), "\tHEAD"), nil
+			}
+		}
+	}
+	out, err = execCommand(gitCommand, "-C", repoDir, "symbolic-ref", "--short", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not find the default branch of %s: %v", repoDir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runGitCommands runs git commands in a repository until one fails,
+// returning their combined output
+func runGitCommands(repoDir string, commands ...[]string) ([]byte, error) {
+	var output []byte
+	for _, args := range commands {
+		out, err := execCommand(gitCommand, append([]string{"-C", repoDir}, args...)...).CombinedOutput()
+		output = append(output, out...)
+		if err != nil {
+			return output, fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+		}
+	}
+	return output, nil
+}
+
+// syncWorkingTree brings a non-bare clone in line with the remote once
+// fetched: the default branch is checked out at the remote commit,
+// discarding any local change, and every remote branch gets a local
+// branch tracking it
+func syncWorkingTree(repoDir string) ([]byte, error) {
+	branch, err := getRemoteDefaultBranch(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	commands := [][]string{
+		{"checkout", "--force", "-B", branch, "refs/remotes/origin/" + branch},
+		{"clean", "-ffdx"},
+	}
+	refs, err := getLocalRefs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	for ref, sha := range refs {
+		b := strings.TrimPrefix(ref, "refs/remotes/origin/")
+		if b == ref || b == "HEAD" || b == branch || refs["refs/heads/"+b] == sha {
+			continue
+		}
+		commands = append(commands, []string{"branch", "--force", "--track", b, "refs/remotes/origin/" + b})
+	}
+	return runGitCommands(repoDir, commands...)
+}
+
+// getMirrorWorktreeDir returns where the worktree of a mirror is checked out
+func getMirrorWorktreeDir(mirrorDir string) string {
+	return strings.TrimSuffix(mirrorDir, ".git")
+}
+
+// syncMirrorWorktree checks out the default branch of a mirror in a
+// worktree next to it. The worktree is detached, since fetching into a
+// mirror updates the branches directly.
+func syncMirrorWorktree(mirrorDir string) ([]byte, error) {
+	worktreeDir := getMirrorWorktreeDir(mirrorDir)
+	branch, err := getRemoteDefaultBranch(mirrorDir)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := appFS.Stat(path.Join(worktreeDir, ".git"))
+	if err != nil {
+		return runGitCommands(mirrorDir,
+			[]string{"worktree", "prune"},
+			[]string{"worktree", "add", "--force", "--detach", worktreeDir, "refs/heads/" + branch},
+		)
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a clone, not a worktree of %s", worktreeDir, mirrorDir)
+	}
+	return runGitCommands(worktreeDir,
+		[]string{"checkout", "--force", "--detach", "refs/heads/" + branch},
+		[]string{"clean", "-ffdx"},
+	)
+}
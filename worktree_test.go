@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func gitOutput(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestBackupResetsWorkingTree(t *testing.T) {
+	var wg sync.WaitGroup
+	remote := newTestRemote(t)
+	backupDir := t.TempDir()
+	repoDir := filepath.Join(backupDir, "ns", "r1")
+	runTestGit(t, "clone", "-q", remote, repoDir)
+
+	// Local changes, a force push and a new branch upstream
+	os.WriteFile(filepath.Join(repoDir, "local.txt"), []byte("local"), 0644)
+	runTestGit(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "diverged")
+	runTestGit(t, "-C", remote, "commit", "-q", "--amend", "--allow-empty", "-m", "rewritten")
+	runTestGit(t, "-C", remote, "branch", "feature")
+
+	appFS = afero.NewOsFs()
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: remote}
+	wg.Add(1)
+	if out, err := backUp(backupDir, repo, false, &wg); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	if head, upstream := gitOutput(t, "-C", repoDir, "rev-parse", "HEAD"), gitOutput(t, "-C", remote, "rev-parse", "main"); head != upstream {
+		t.Errorf("Expected the default branch to be reset to %s, got %s", upstream, head)
+	}
+	if _, err := os.Stat(filepath.Join(repoDir, "local.txt")); err == nil {
+		t.Errorf("Expected the local changes to be discarded")
+	}
+	if upstream := gitOutput(t, "-C", repoDir, "rev-parse", "--abbrev-ref", "feature@{upstream}"); upstream != "origin/feature" {
+		t.Errorf("Expected the new branch to track origin/feature, got %s", upstream)
+	}
+}
+
+func TestBackupMirrorWorktree(t *testing.T) {
+	var wg sync.WaitGroup
+	remote := newTestRemote(t)
+	os.WriteFile(filepath.Join(remote, "README"), []byte("v1"), 0644)
+	runTestGit(t, "-C", remote, "add", "README")
+	runTestGit(t, "-C", remote, "commit", "-q", "-m", "v1")
+
+	backupDir := t.TempDir()
+	appFS = afero.NewOsFs()
+	appCfg.mirrorWorktree = true
+	defer func() { appCfg.mirrorWorktree = false }()
+
+	repo := &Repository{Namespace: "ns", Name: "r1", CloneURL: remote}
+	wg.Add(1)
+	if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	worktreeDir := filepath.Join(backupDir, "ns", "r1")
+	if data, _ := os.ReadFile(filepath.Join(worktreeDir, "README")); string(data) != "v1" {
+		t.Errorf("Expected the default branch to be checked out, got %q", data)
+	}
+
+	os.WriteFile(filepath.Join(remote, "README"), []byte("v2"), 0644)
+	runTestGit(t, "-C", remote, "commit", "-q", "-a", "-m", "v2")
+	wg.Add(1)
+	if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if data, _ := os.ReadFile(filepath.Join(worktreeDir, "README")); string(data) != "v2" {
+		t.Errorf("Expected the worktree to be updated, got %q", data)
+	}
+}